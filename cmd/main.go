@@ -2,15 +2,25 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/mstgnz/goteway/pkg/config"
 	"github.com/mstgnz/goteway/pkg/gateway"
 	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/middleware"
 )
 
 func main() {
+	// Run the sign subcommand if requested
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		os.Exit(runSign(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	// Parse command line flags
 	configPath := flag.String("config", "config.json", "Path to the configuration file")
 	logLevelFlag := flag.String("log-level", "info", "Log level (debug, info, warn, error, fatal)")
@@ -53,6 +63,17 @@ func main() {
 		}
 	}()
 
+	// Reload the configuration on SIGHUP
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			if err := gw.Reload(); err != nil {
+				log.Error("Failed to reload configuration: %v", err)
+			}
+		}
+	}()
+
 	log.Info("Gateway started. Press Ctrl+C to stop.")
 
 	// Wait for a signal
@@ -66,3 +87,78 @@ func main() {
 
 	log.Info("Gateway stopped.")
 }
+
+// runSign generates a signed, expiring URL for a route protected by the signedurl middleware
+func runSign(args []string, stdout, stderr io.Writer) int {
+	// Parse subcommand flags
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", "config.json", "Path to the configuration file")
+	routePath := fs.String("route", "", "Route whose signedUrl settings are used")
+	secret := fs.String("secret", "", "Signing secret (overrides the route configuration)")
+	expires := fs.Duration("expires", time.Hour, "How long the URL stays valid")
+	clientIP := fs.String("ip", "", "Client IP the URL is bound to")
+	method := fs.String("method", "GET", "HTTP method the URL is bound to")
+	bindMethod := fs.Bool("bind-method", false, "Bind the URL to the HTTP method (when -route is not used)")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: goteway sign [flags] URL")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	// Determine the signing settings
+	settings := config.SignedURLConfig{
+		Secret:     *secret,
+		BindIP:     *clientIP != "",
+		BindMethod: *bindMethod,
+	}
+	if *routePath != "" {
+		cfg, err := config.LoadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to load configuration: %v\n", err)
+			return 1
+		}
+
+		found := false
+		for _, route := range cfg.Routes {
+			if route.Path == *routePath && route.SignedURL != nil {
+				settings.BindIP = route.SignedURL.BindIP
+				settings.BindMethod = route.SignedURL.BindMethod
+				if settings.Secret == "" {
+					settings.Secret = route.SignedURL.Secret
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			fmt.Fprintf(stderr, "No signedUrl configuration for route %s\n", *routePath)
+			return 1
+		}
+	}
+	if settings.Secret == "" {
+		fmt.Fprintln(stderr, "A secret is required (use -secret or -route)")
+		return 1
+	}
+	if settings.BindIP && *clientIP == "" {
+		fmt.Fprintln(stderr, "The route binds URLs to a client IP, use -ip")
+		return 1
+	}
+
+	// Sign the URL
+	signer := middleware.NewURLSigner(settings.Secret, settings.BindIP, settings.BindMethod, logger.New(logger.ERROR))
+	signed, err := signer.Sign(fs.Arg(0), time.Now().Add(*expires), *clientIP, *method)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to sign URL: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintln(stdout, signed)
+	return 0
+}
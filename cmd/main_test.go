@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/middleware"
 )
 
 func TestMainSignalHandling(t *testing.T) {
@@ -31,3 +37,93 @@ func TestMainSignalHandling(t *testing.T) {
 		t.Error("Timeout waiting for signal handler")
 	}
 }
+
+func TestRunSign(t *testing.T) {
+	// Create a temporary config file
+	configContent := `{
+		"routes": [
+			{
+				"path": "/downloads",
+				"target": "http://localhost:3000",
+				"methods": ["GET"],
+				"middlewares": ["signedurl"],
+				"signedUrl": {
+					"secret": "config-secret",
+					"bindMethod": true
+				}
+			}
+		]
+	}`
+
+	tmpfile, err := os.CreateTemp("", "config-*.json")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(configContent)); err != nil {
+		t.Fatalf("Failed to write to temp file: %v", err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatalf("Failed to close temp file: %v", err)
+	}
+
+	// Test cases
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		secret     string
+		bindMethod bool
+	}{
+		{
+			name:     "explicit secret",
+			args:     []string{"-secret", "cli-secret", "-expires", "10m", "http://localhost:8080/downloads/file.zip"},
+			wantCode: 0,
+			secret:   "cli-secret",
+		},
+		{
+			name:       "secret from route",
+			args:       []string{"-config", tmpfile.Name(), "-route", "/downloads", "http://localhost:8080/downloads/file.zip"},
+			wantCode:   0,
+			secret:     "config-secret",
+			bindMethod: true,
+		},
+		{
+			name:     "unknown route",
+			args:     []string{"-config", tmpfile.Name(), "-route", "/missing", "http://localhost:8080/downloads/file.zip"},
+			wantCode: 1,
+		},
+		{
+			name:     "missing secret",
+			args:     []string{"http://localhost:8080/downloads/file.zip"},
+			wantCode: 1,
+		},
+		{
+			name:     "missing url",
+			args:     []string{"-secret", "cli-secret"},
+			wantCode: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Run the subcommand
+			var stdout, stderr bytes.Buffer
+			code := runSign(tt.args, &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Fatalf("runSign() = %v, want %v (stderr: %s)", code, tt.wantCode, stderr.String())
+			}
+			if tt.wantCode != 0 {
+				return
+			}
+
+			// Verify the generated URL with the same secret
+			req := httptest.NewRequest("GET", strings.TrimSpace(stdout.String()), nil)
+			signer := middleware.NewURLSigner(tt.secret, false, tt.bindMethod, logger.New(logger.ERROR))
+			if err := signer.Verify(req); err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+		})
+	}
+}
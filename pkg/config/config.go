@@ -8,26 +8,316 @@ import (
 // Config represents the configuration for the API gateway
 type Config struct {
 	Server struct {
-		Port int    `json:"port"`
-		Host string `json:"host"`
+		Port            int             `json:"port"`
+		Host            string          `json:"host"`
+		IPFilter        *IPFilterConfig `json:"ipFilter,omitempty"`
+		TrustedProxies  []string        `json:"trustedProxies"`  // CIDRs allowed to set forwarding headers
+		ClientIPHeaders []string        `json:"clientIPHeaders"` // forwarding headers consulted in order
 	} `json:"server"`
-	Routes []Route `json:"routes"`
+	Routes         []Route               `json:"routes"`
+	RateLimitStore *RateLimitStoreConfig `json:"rateLimitStore,omitempty"`
+	QuotaStore     *QuotaStoreConfig     `json:"quotaStore,omitempty"`
+	Admin          *AdminConfig          `json:"admin,omitempty"`
+	Consumers      []ConsumerConfig      `json:"consumers,omitempty"`
+	Plans          map[string]PlanConfig `json:"plans,omitempty"`
+	Upstreams      map[string]Upstream   `json:"upstreams,omitempty"` // by target URL
+	LoadShedding   *LoadSheddingConfig   `json:"loadShedding,omitempty"`
 }
 
 // Route represents a route configuration
 type Route struct {
-	Path        string           `json:"path"`
-	Target      string           `json:"target"`
-	Methods     []string         `json:"methods"`
-	Middlewares []string         `json:"middlewares"`
-	RateLimit   *RateLimitConfig `json:"rateLimit,omitempty"`
-	Auth        *AuthConfig      `json:"auth,omitempty"`
+	Name             string                 `json:"name"` // unique route name, defaults to the path
+	Path             string                 `json:"path"`
+	Target           string                 `json:"target"`                    // not used by aggregation routes and routes with targets, failover groups, discovery or a split
+	Targets          []string               `json:"targets,omitempty"`         // replicas balanced round robin
+	Failover         *FailoverConfig        `json:"failover,omitempty"`        // priority-ordered target groups
+	Discovery        *DiscoveryConfig       `json:"discovery,omitempty"`       // targets discovered at runtime
+	HealthCheck      *HealthCheckConfig     `json:"healthCheck,omitempty"`     // of the targets
+	SessionAffinity  *SessionAffinityConfig `json:"sessionAffinity,omitempty"` // keeps clients on one of the targets
+	Split            *SplitConfig           `json:"split,omitempty"`           // weighted target groups replacing the target
+	Mirror           *MirrorConfig          `json:"mirror,omitempty"`
+	Methods          []string               `json:"methods"`
+	Match            *MatchConfig           `json:"match,omitempty"`
+	Rewrite          *RewriteConfig         `json:"rewrite,omitempty"`
+	Headers          *HeadersConfig         `json:"headers,omitempty"`
+	Transform        *TransformConfig       `json:"transform,omitempty"`
+	Aggregate        *AggregateConfig       `json:"aggregate,omitempty"` // calls several backends instead of proxying to the target
+	Middlewares      []string               `json:"middlewares"`
+	RateLimit        *RateLimitConfig       `json:"rateLimit,omitempty"`
+	RateLimits       []RateLimitConfig      `json:"rateLimits,omitempty"` // additional limits, all have to pass
+	RateLimitHeaders string                 `json:"rateLimitHeaders"`     // "xratelimit" (default), "ietf" or "none"
+	Quotas           []QuotaConfig          `json:"quotas,omitempty"`
+	Auth             *AuthConfig            `json:"auth,omitempty"`
+	SignedURL        *SignedURLConfig       `json:"signedUrl,omitempty"`
+	IPFilter         *IPFilterConfig        `json:"ipFilter,omitempty"`
+	PreserveHost     bool                   `json:"preserveHost"` // forward the client Host header instead of the target host
+	Forwarded        bool                   `json:"forwarded"`    // add an RFC 7239 Forwarded header
+	Via              bool                   `json:"via"`          // add the gateway to the Via header
+	Concurrency      *ConcurrencyConfig     `json:"concurrency,omitempty"`
+	AdaptiveLimit    *AdaptiveLimitConfig   `json:"adaptiveLimit,omitempty"`
+	Priority         string                 `json:"priority"` // "critical", "high", "normal" (default) or "low"
+}
+
+// MatchConfig represents request conditions a route matches on in addition to its path and methods
+type MatchConfig struct {
+	Hosts   []string          `json:"hosts"`   // e.g. "api.example.com" or "*.example.com"
+	Headers map[string]string `json:"headers"` // header values, "*" matches any value
+	Query   map[string]string `json:"query"`   // query parameter values, "*" matches any value
+}
+
+// RewriteConfig represents how a route rewrites the path and query it forwards. At
+// most one of keepPrefix, replacePrefix, regex and template can be set; without
+// any of them the matched route prefix is stripped.
+type RewriteConfig struct {
+	KeepPrefix    bool              `json:"keepPrefix"`    // forward the path unchanged
+	ReplacePrefix string            `json:"replacePrefix"` // replace the matched prefix, e.g. "/v2"
+	Regex         string            `json:"regex"`         // applied to the whole path
+	Replacement   string            `json:"replacement"`   // may refer to capture groups as $1 or ${name}
+	Template      string            `json:"template"`      // e.g. "/users/${param.id}/profile"
+	Query         map[string]string `json:"query"`         // query parameters to set, may use templates
+}
+
+// HeadersConfig represents the header transformations of a route
+type HeadersConfig struct {
+	Request  []HeaderRulesConfig `json:"request"`  // applied to the request sent upstream
+	Response []HeaderRulesConfig `json:"response"` // applied to the upstream response
+}
+
+// HeaderRulesConfig represents header transformations applied together, in the
+// order rename, remove, set and add. Values may use templates.
+type HeaderRulesConfig struct {
+	Status []string          `json:"status"` // response only: statuses such as "404" or "5xx", all if empty
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+	Remove []string          `json:"remove"` // names, or prefixes ending in "*"
+	Rename map[string]string `json:"rename"` // old names to new names
+}
+
+// TransformConfig represents the JSON body transformations of a route
+type TransformConfig struct {
+	Request     *BodyTransformConfig `json:"request,omitempty"`
+	Response    *BodyTransformConfig `json:"response,omitempty"`
+	MaxBodySize int64                `json:"maxBodySize"` // in bytes, larger bodies are passed untouched, defaults to 1 MiB
+}
+
+// BodyTransformConfig represents transformations of a JSON body, applied in the
+// order unwrap, remove, rename, move, set, filter and wrap. Fields are given by
+// dot-separated paths such as "data.items.*.id".
+type BodyTransformConfig struct {
+	Unwrap string                     `json:"unwrap"` // field replacing the whole body
+	Remove []string                   `json:"remove"`
+	Rename map[string]string          `json:"rename"` // field paths to new names
+	Move   map[string]string          `json:"move"`   // field paths to new paths
+	Set    map[string]json.RawMessage `json:"set"`    // field paths to JSON values
+	Filter []ArrayFilterConfig        `json:"filter"`
+	Wrap   string                     `json:"wrap"` // field the whole body is wrapped in
+}
+
+// ArrayFilterConfig represents a filter keeping the array elements whose fields have the given values
+type ArrayFilterConfig struct {
+	Path  string                     `json:"path"` // the array, the body itself if empty
+	Where map[string]json.RawMessage `json:"where"`
+}
+
+// FailoverConfig represents target groups in priority order, such as the local
+// zone, another zone and another region. A group gets all traffic while the
+// healthy fraction of its targets is at least the threshold; below it the
+// traffic gradually spills over to the next groups.
+type FailoverConfig struct {
+	Groups    []FailoverGroupConfig `json:"groups"`
+	Threshold float64               `json:"threshold"` // healthy fraction below which traffic spills over, defaults to 0.7
+}
+
+// FailoverGroupConfig represents a group of targets balanced round robin
+type FailoverGroupConfig struct {
+	Name      string           `json:"name"`
+	Targets   []string         `json:"targets"`
+	Discovery *DiscoveryConfig `json:"discovery,omitempty"` // instead of targets
+}
+
+// DiscoveryConfig represents a source of targets looked up at runtime. The
+// targets are refreshed in the background and replace the previous ones
+// without a restart.
+type DiscoveryConfig struct {
+	Provider   string `json:"provider"`   // "dns", "file" or "consul"
+	Name       string `json:"name"`       // DNS name or Consul service
+	Record     string `json:"record"`     // DNS record type, "A" (with AAAA, the default) or "SRV"
+	Port       int    `json:"port"`       // port of the targets found by A and AAAA records
+	Server     string `json:"server"`     // DNS server, defaults to the first one of /etc/resolv.conf
+	Path       string `json:"path"`       // file listing the targets, one per line
+	Address    string `json:"address"`    // Consul agent URL, defaults to http://127.0.0.1:8500
+	Tag        string `json:"tag"`        // Consul service tag
+	Datacenter string `json:"datacenter"` // Consul datacenter
+	Token      string `json:"token"`      // Consul ACL token
+	Scheme     string `json:"scheme"`     // scheme of the discovered targets, defaults to http
+	Interval   int    `json:"interval"`   // in seconds, the refresh interval of files and Consul, defaults to 10
+}
+
+// HealthCheckConfig represents how the health of a route's targets is checked.
+// Targets failing active checks or too many requests in a row get no traffic
+// while another target is healthy.
+type HealthCheckConfig struct {
+	Path               string `json:"path"`               // requested on every target, no active checks if empty
+	Interval           int    `json:"interval"`           // in seconds, defaults to 10
+	Timeout            int    `json:"timeout"`            // in milliseconds, defaults to 2000
+	UnhealthyThreshold int    `json:"unhealthyThreshold"` // failed checks in a row marking a target down, defaults to 2
+	HealthyThreshold   int    `json:"healthyThreshold"`   // passed checks in a row marking it up again, defaults to 2
+	MaxFailures        int    `json:"maxFailures"`        // failed requests in a row ejecting a target, defaults to 5
+	EjectionTime       int    `json:"ejectionTime"`       // in seconds, defaults to 30
+}
+
+// SessionAffinityConfig represents a signed cookie keeping a client on one target
+type SessionAffinityConfig struct {
+	Cookie string `json:"cookie"` // defaults to a name derived from the route
+	Secret string `json:"secret"` // signs the cookie
+	TTL    int    `json:"ttl"`    // in seconds, the cookie lasts for the browser session if 0
+}
+
+// SplitConfig represents the distribution of a route's traffic over target groups
+type SplitConfig struct {
+	Groups      []TargetGroupConfig `json:"groups"`
+	Sticky      string              `json:"sticky"`      // "cookie" or a rate limit key such as "consumer" or "header:X-User-ID"
+	Cookie      string              `json:"cookie"`      // sticky cookie name, defaults to "goteway_group"
+	ForceHeader string              `json:"forceHeader"` // header naming a group to send the request to
+	Canary      *CanaryConfig       `json:"canary,omitempty"`
+}
+
+// CanaryConfig represents the progressive shift of a route's traffic to a
+// canary group, promoted or rolled back by comparing it to a baseline group
+type CanaryConfig struct {
+	Group                string  `json:"group"`                // the canary target group
+	Baseline             string  `json:"baseline"`             // defaults to the other group
+	Steps                []int   `json:"steps"`                // canary weights in percent, e.g. [5, 25, 50]
+	Interval             int     `json:"interval"`             // in seconds per step, defaults to 60
+	MinRequests          int     `json:"minRequests"`          // canary requests needed to evaluate a step, defaults to 50
+	MaxErrorRateIncrease float64 `json:"maxErrorRateIncrease"` // tolerated error rate above the baseline, defaults to 0.01
+	MaxLatencyRatio      float64 `json:"maxLatencyRatio"`      // tolerated mean latency relative to the baseline, defaults to 1.5
+}
+
+// TargetGroupConfig represents a target receiving a share of a route's traffic
+type TargetGroupConfig struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	Weight int    `json:"weight"` // share of the traffic relative to the other groups, e.g. a percentage
+}
+
+// MirrorConfig represents a secondary target receiving copies of a route's
+// requests, whose responses are discarded
+type MirrorConfig struct {
+	Target      string   `json:"target"`
+	Percentage  *float64 `json:"percentage"`  // share of the requests mirrored, defaults to 100, 0 disables the mirror
+	MaxBodySize int64    `json:"maxBodySize"` // in bytes, requests with larger bodies are not mirrored, defaults to 64 KiB
+	Timeout     int      `json:"timeout"`     // in milliseconds, defaults to 5000
+}
+
+// AggregateConfig represents a route composing the JSON responses of several backends
+type AggregateConfig struct {
+	Backends []AggregateBackendConfig `json:"backends"`
+	Flatten  bool                     `json:"flatten"` // merge the fields of the responses instead of keying them
+}
+
+// AggregateBackendConfig represents a backend called by an aggregation route
+type AggregateBackendConfig struct {
+	Key      string `json:"key"`      // field the response is placed under
+	Target   string `json:"target"`   // base URL
+	Path     string `json:"path"`     // may use templates, e.g. "/users/${param.id}"
+	Method   string `json:"method"`   // defaults to GET
+	Timeout  int    `json:"timeout"`  // in milliseconds, defaults to 5000
+	Required bool   `json:"required"` // fail the whole request if the backend fails
 }
 
 // RateLimitConfig represents rate limiting configuration
 type RateLimitConfig struct {
-	Limit  int `json:"limit"`
-	Window int `json:"window"` // in seconds
+	Name      string `json:"name"` // policy name in the IETF headers, defaults to the key
+	Limit     int    `json:"limit"`
+	Window    int    `json:"window"`    // in seconds
+	Algorithm string `json:"algorithm"` // "tokenbucket" (default) or "gcra"
+	Burst     int    `json:"burst"`     // requests allowed at once, defaults to limit
+	Key       string `json:"key"`       // e.g. "ip" (default), "principal", "apikey", "header:X-Tenant", "claim:sub", "route", "principal+route"
+	Fallback  string `json:"fallback"`  // for requests without the key: "ip" (default), "shared", "skip" or "deny"
+}
+
+// RateLimitStoreConfig represents the shared rate limit store configuration
+type RateLimitStoreConfig struct {
+	Type        string `json:"type"` // "memory" or "redis"
+	Address     string `json:"address"`
+	Password    string `json:"password"`
+	DB          int    `json:"db"`
+	Prefix      string `json:"prefix"`
+	Timeout     int    `json:"timeout"` // in milliseconds
+	PoolSize    int    `json:"poolSize"`
+	FailureMode string `json:"failureMode"` // "local" (default), "allow" or "deny"
+}
+
+// QuotaConfig represents a request quota over a calendar period
+type QuotaConfig struct {
+	Name     string `json:"name"` // quotas with the same name share their usage, defaults to the route
+	Limit    int64  `json:"limit"`
+	Period   string `json:"period"`   // "hourly", "daily" or "monthly", calendar periods in UTC
+	Key      string `json:"key"`      // same keys as rate limits, e.g. "principal" or "apikey"
+	Fallback string `json:"fallback"` // for requests without the key: "ip" (default), "shared", "skip" or "deny"
+}
+
+// QuotaStoreConfig represents the quota usage store configuration
+type QuotaStoreConfig struct {
+	Path          string `json:"path"`          // file the usage is saved to, kept in memory only if empty
+	FlushInterval int    `json:"flushInterval"` // in seconds
+}
+
+// AdminConfig represents the admin API configuration
+type AdminConfig struct {
+	Path   string `json:"path"`   // defaults to "/_admin"
+	APIKey string `json:"apiKey"` // required in the X-Admin-Key header
+}
+
+// ConsumerConfig represents a consumer of the gateway and its credentials
+type ConsumerConfig struct {
+	ID          string            `json:"id"`
+	Plan        string            `json:"plan"`
+	APIKeys     []string          `json:"apiKeys"`     // keys sent in the X-API-Key header
+	BasicAuth   map[string]string `json:"basicAuth"`   // user names and passwords
+	JWTSubjects []string          `json:"jwtSubjects"` // subjects of tokens verified by the jwt auth middleware
+}
+
+// PlanConfig represents the limits and permissions shared by the consumers of a plan
+type PlanConfig struct {
+	Routes     []string          `json:"routes"`     // route paths the plan allows, all routes if empty
+	RateLimits []RateLimitConfig `json:"rateLimits"` // keyed by consumer unless a key is given
+	Quotas     []QuotaConfig     `json:"quotas"`     // keyed by consumer unless a key is given
+	Priority   string            `json:"priority"`   // load shedding priority of the plan's requests
+}
+
+// Upstream represents settings shared by all routes forwarding to a target
+type Upstream struct {
+	Concurrency *ConcurrencyConfig `json:"concurrency,omitempty"`
+}
+
+// ConcurrencyConfig represents a limit on the number of requests in flight
+type ConcurrencyConfig struct {
+	MaxInFlight  int `json:"maxInFlight"`
+	MaxQueue     int `json:"maxQueue"`     // requests waiting for a slot, none if 0
+	QueueTimeout int `json:"queueTimeout"` // in milliseconds, defaults to 1000
+}
+
+// AdaptiveLimitConfig represents a concurrency limit adjusted to the observed upstream latency
+type AdaptiveLimitConfig struct {
+	Algorithm        string  `json:"algorithm"` // "aimd" (default) or "gradient"
+	InitialLimit     int     `json:"initialLimit"`
+	MinLimit         int     `json:"minLimit"`
+	MaxLimit         int     `json:"maxLimit"`
+	LatencyThreshold int     `json:"latencyThreshold"` // aimd: in milliseconds, slower responses shrink the limit
+	BackoffRatio     float64 `json:"backoffRatio"`     // aimd: factor the limit is cut by, e.g. 0.9
+	Tolerance        float64 `json:"tolerance"`        // gradient: latency increase tolerated, e.g. 1.5
+}
+
+// LoadSheddingConfig represents the overload detection settings. Limits that
+// are zero are not checked.
+type LoadSheddingConfig struct {
+	MaxInFlight     int     `json:"maxInFlight"`
+	MaxQueueLatency int     `json:"maxQueueLatency"` // in milliseconds
+	MaxCPU          float64 `json:"maxCPU"`          // fraction of the available CPU, e.g. 0.8
+	PriorityHeader  string  `json:"priorityHeader"`  // honored from trusted proxies only
+	RetryAfter      int     `json:"retryAfter"`      // in seconds
 }
 
 // AuthConfig represents authentication configuration
@@ -36,6 +326,22 @@ type AuthConfig struct {
 	Config map[string]string `json:"config"`
 }
 
+// SignedURLConfig represents signed URL validation configuration
+type SignedURLConfig struct {
+	Secret     string `json:"secret"`
+	BindIP     bool   `json:"bindIP"`     // signature is only valid for the client IP it was issued to
+	BindMethod bool   `json:"bindMethod"` // signature is only valid for the HTTP method it was issued for
+}
+
+// IPFilterConfig represents IP allow/deny list configuration
+type IPFilterConfig struct {
+	Allow          []string `json:"allow"`          // CIDRs or addresses
+	Deny           []string `json:"deny"`           // CIDRs or addresses, take precedence over allow
+	AllowFile      string   `json:"allowFile"`      // file with one allow entry per line
+	DenyFile       string   `json:"denyFile"`       // file with one deny entry per line
+	ReloadInterval int      `json:"reloadInterval"` // in seconds
+}
+
 // LoadConfig loads the configuration from a file
 func LoadConfig(path string) (*Config, error) {
 	file, err := os.Open(path)
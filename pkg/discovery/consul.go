@@ -0,0 +1,130 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultConsulAddress is the default address of the Consul agent
+	defaultConsulAddress = "http://127.0.0.1:8500"
+	// consulTimeout is the timeout of a Consul request on top of its wait time
+	consulTimeout = 10 * time.Second
+)
+
+// consulEntry represents an instance of a service in the Consul health API
+type consulEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// consulProvider represents the passing instances of a service in the Consul
+// catalog. It uses blocking queries, so changes are seen as soon as Consul
+// reports them while idle services cost one request per wait time.
+type consulProvider struct {
+	address    string
+	service    string
+	tag        string
+	datacenter string
+	token      string
+	scheme     string
+	wait       time.Duration
+	client     *http.Client
+	index      uint64 // of the last response, 0 before the first one
+}
+
+// newConsulProvider creates a provider for the instances of a Consul service
+func newConsulProvider(address, service, tag, datacenter, token, scheme string, wait time.Duration) (*consulProvider, error) {
+	if service == "" {
+		return nil, fmt.Errorf("consul discovery requires a service name")
+	}
+	if address == "" {
+		address = defaultConsulAddress
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Consul address: %q", address)
+	}
+
+	return &consulProvider{
+		address:    strings.TrimSuffix(address, "/"),
+		service:    service,
+		tag:        tag,
+		datacenter: datacenter,
+		token:      token,
+		scheme:     scheme,
+		wait:       wait,
+		client:     &http.Client{Timeout: wait + consulTimeout},
+	}, nil
+}
+
+// Resolve returns the addresses of the passing instances. After the first
+// lookup it blocks until the service changes or the wait time passes.
+func (p *consulProvider) Resolve(ctx context.Context) ([]string, time.Duration, error) {
+	query := url.Values{"passing": {"true"}}
+	if p.tag != "" {
+		query.Set("tag", p.tag)
+	}
+	if p.datacenter != "" {
+		query.Set("dc", p.datacenter)
+	}
+	if p.index > 0 {
+		query.Set("index", strconv.FormatUint(p.index, 10))
+		query.Set("wait", strconv.Itoa(int(p.wait/time.Second))+"s")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.address+"/v1/health/service/"+url.PathEscape(p.service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.token != "" {
+		req.Header.Set("X-Consul-Token", p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned status %d", resp.StatusCode)
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("invalid Consul response: %w", err)
+	}
+
+	// Start over with a non-blocking query if the index went backwards
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || index < p.index {
+		index = 0
+	}
+	p.index = index
+
+	targets := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		targets = append(targets, p.scheme+"://"+net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+
+	// Blocking queries wait themselves, others are repeated after the wait time
+	if p.index > 0 {
+		return targets, 0, nil
+	}
+	return targets, p.wait, nil
+}
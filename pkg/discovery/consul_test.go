@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConsulProvider(t *testing.T) {
+	// Create a Consul stand-in whose service changes at index 8
+	var index atomic.Int64
+	index.Store(7)
+	var queries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/users" || r.Header.Get("X-Consul-Token") != "t0ken" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		queries = append(queries, r.URL.RawQuery)
+		w.Header().Set("X-Consul-Index", "7")
+		if index.Load() == 8 {
+			w.Header().Set("X-Consul-Index", "8")
+			w.Write([]byte(`[{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 3000}}]`))
+			return
+		}
+		w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 3000}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "fd00::2", "Port": 3001}}
+		]`))
+	}))
+	defer ts.Close()
+
+	p, err := newConsulProvider(ts.URL, "users", "v2", "eu", "t0ken", "http", 30*time.Second)
+	if err != nil {
+		t.Fatalf("newConsulProvider() error = %v", err)
+	}
+
+	// The first lookup does not block
+	got, wait, err := p.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if want := []string{"http://10.0.0.1:3000", "http://[fd00::2]:3001"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() = %v, want %v", got, want)
+	}
+	if wait != 0 {
+		t.Errorf("Resolve() wait = %v, want 0 for blocking queries", wait)
+	}
+
+	// Later lookups block on the last index
+	index.Store(8)
+	got, _, err = p.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if want := []string{"http://10.0.0.1:3000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() = %v, want %v", got, want)
+	}
+	wantQueries := []string{
+		"dc=eu&passing=true&tag=v2",
+		"dc=eu&index=7&passing=true&tag=v2&wait=30s",
+	}
+	if !reflect.DeepEqual(queries, wantQueries) {
+		t.Errorf("queries = %v, want %v", queries, wantQueries)
+	}
+}
+
+func TestConsulProviderErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	p, err := newConsulProvider(ts.URL, "users", "", "", "", "http", time.Second)
+	if err != nil {
+		t.Fatalf("newConsulProvider() error = %v", err)
+	}
+	if _, _, err := p.Resolve(context.Background()); err == nil {
+		t.Error("Resolve() error = nil, want error")
+	}
+
+	if _, err := newConsulProvider(ts.URL, "", "", "", "", "http", time.Second); err == nil {
+		t.Error("newConsulProvider() without a service error = nil, want error")
+	}
+	if _, err := newConsulProvider("consul:8500", "users", "", "", "", "http", time.Second); err == nil {
+		t.Error("newConsulProvider() with an invalid address error = nil, want error")
+	}
+}
@@ -0,0 +1,126 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+const (
+	// defaultInterval is the default refresh interval of providers without TTLs
+	defaultInterval = 10 * time.Second
+	// minRefresh is the shortest time between two lookups
+	minRefresh = time.Second
+)
+
+// retryInterval is the time before a failed lookup is retried
+var retryInterval = 5 * time.Second
+
+// Provider looks up the targets of a service
+type Provider interface {
+	// Resolve returns the target URLs and how long they stay valid
+	Resolve(ctx context.Context) ([]string, time.Duration, error)
+}
+
+// New creates the provider of a discovery configuration
+func New(cfg *config.DiscoveryConfig) (Provider, error) {
+	scheme := cfg.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	interval := time.Duration(cfg.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	switch cfg.Provider {
+	case "dns":
+		return newDNSProvider(cfg.Name, cfg.Record, cfg.Port, cfg.Server, scheme)
+	case "file":
+		return newFileProvider(cfg.Path, interval)
+	case "consul":
+		return newConsulProvider(cfg.Address, cfg.Name, cfg.Tag, cfg.Datacenter, cfg.Token, scheme, interval)
+	default:
+		return nil, fmt.Errorf("unknown discovery provider: %q", cfg.Provider)
+	}
+}
+
+// Watcher keeps the targets of a provider up to date. It resolves them again
+// when they expire and reports every changed set of targets.
+type Watcher struct {
+	name     string
+	provider Provider
+	update   func([]string)
+	current  []string
+	resolved bool // whether current holds a lookup result
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	log      *logger.Logger
+}
+
+// Watch resolves the targets of a provider, reports them to update and keeps
+// refreshing them in the background until Close is called. A failed lookup
+// keeps the previous targets.
+func Watch(name string, provider Provider, update func([]string), log *logger.Logger) *Watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		name:     name,
+		provider: provider,
+		update:   update,
+		cancel:   cancel,
+		log:      log,
+	}
+
+	wait := w.refresh(ctx)
+	w.wg.Add(1)
+	go w.loop(ctx, wait)
+	return w
+}
+
+// loop refreshes the targets until the watcher is closed
+func (w *Watcher) loop(ctx context.Context, wait time.Duration) {
+	defer w.wg.Done()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(w.refresh(ctx))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh resolves the targets, reports them if they changed and returns the
+// time until the next refresh
+func (w *Watcher) refresh(ctx context.Context) time.Duration {
+	targets, ttl, err := w.provider.Resolve(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			w.log.Warn("Failed to discover targets of %s: %v", w.name, err)
+		}
+		return retryInterval
+	}
+
+	slices.Sort(targets)
+	targets = slices.Compact(targets)
+	if !w.resolved || !slices.Equal(targets, w.current) {
+		w.current = targets
+		w.resolved = true
+		w.log.Info("Discovered %d targets of %s", len(targets), w.name)
+		w.update(targets)
+	}
+	return max(ttl, minRefresh)
+}
+
+// Close stops refreshing the targets
+func (w *Watcher) Close() {
+	w.cancel()
+	w.wg.Wait()
+}
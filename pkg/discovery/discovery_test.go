@@ -0,0 +1,97 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+// stubProvider represents a provider returning preset results
+type stubProvider struct {
+	mu      sync.Mutex
+	targets []string
+	err     error
+	calls   int
+}
+
+// Resolve returns the preset targets, refreshing them immediately
+func (p *stubProvider) Resolve(ctx context.Context) ([]string, time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	return append([]string(nil), p.targets...), 0, p.err
+}
+
+// set changes the result of the next lookups
+func (p *stubProvider) set(targets []string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets, p.err = targets, err
+}
+
+func TestNew(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		cfg     config.DiscoveryConfig
+		wantErr bool
+	}{
+		{cfg: config.DiscoveryConfig{Provider: "dns", Name: "api.example.com", Port: 80, Server: "127.0.0.1"}},
+		{cfg: config.DiscoveryConfig{Provider: "file", Path: "targets.txt"}},
+		{cfg: config.DiscoveryConfig{Provider: "consul", Name: "users"}},
+		{cfg: config.DiscoveryConfig{Provider: "file"}, wantErr: true},
+		{cfg: config.DiscoveryConfig{Provider: "etcd"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(&tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("New(%+v) error = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	defer func(interval time.Duration) { retryInterval = interval }(retryInterval)
+	retryInterval = 100 * time.Millisecond
+
+	provider := &stubProvider{targets: []string{"http://b", "http://a", "http://a"}}
+	updates := make(chan []string, 10)
+	w := Watch("users", provider, func(targets []string) { updates <- targets }, logger.New(logger.ERROR))
+	defer w.Close()
+
+	// The first targets are reported before Watch returns
+	select {
+	case got := <-updates:
+		if want := []string{"http://a", "http://b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("targets = %v, want %v", got, want)
+		}
+	default:
+		t.Fatal("no targets reported by Watch")
+	}
+
+	// Failed lookups and unchanged targets are not reported
+	provider.set(nil, errors.New("lookup failed"))
+	time.Sleep(1200 * time.Millisecond)
+	provider.set([]string{"http://a", "http://b"}, nil)
+	select {
+	case got := <-updates:
+		t.Fatalf("targets = %v reported without a change", got)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// Changed targets are reported
+	provider.set([]string{"http://c"}, nil)
+	select {
+	case got := <-updates:
+		if want := []string{"http://c"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("targets = %v, want %v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("changed targets not reported")
+	}
+}
@@ -0,0 +1,382 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsClassIN  = 1
+
+	// dnsTimeout is the timeout of a DNS lookup
+	dnsTimeout = 5 * time.Second
+	// maxPointers is the most compression pointers followed in a name
+	maxPointers = 32
+)
+
+// resolvConf is the file the default DNS server is read from
+var resolvConf = "/etc/resolv.conf"
+
+// errShortMessage is returned for DNS messages ending unexpectedly
+var errShortMessage = errors.New("short DNS message")
+
+// dnsRecord represents an A, AAAA or SRV record of a DNS answer
+type dnsRecord struct {
+	ttl      uint32
+	ip       net.IP // of A and AAAA records
+	priority uint16 // of SRV records
+	port     uint16 // of SRV records
+	target   string // of SRV records
+}
+
+// dnsProvider represents targets found by querying a DNS server directly, so
+// that the TTLs of the records decide when they are looked up again
+type dnsProvider struct {
+	name   string // fully qualified
+	srv    bool
+	port   int
+	server string
+	scheme string
+}
+
+// newDNSProvider creates a provider looking up the A and AAAA records of a
+// name, whose targets use the given port, or its SRV records
+func newDNSProvider(name, record string, port int, server, scheme string) (*dnsProvider, error) {
+	if name == "" {
+		return nil, fmt.Errorf("dns discovery requires a name")
+	}
+
+	p := &dnsProvider{
+		name:   strings.TrimSuffix(name, ".") + ".",
+		port:   port,
+		server: server,
+		scheme: scheme,
+	}
+	switch strings.ToUpper(record) {
+	case "", "A":
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("dns discovery of A records requires a port")
+		}
+	case "SRV":
+		p.srv = true
+	default:
+		return nil, fmt.Errorf("unknown DNS record type: %q", record)
+	}
+
+	if p.server == "" {
+		s, err := systemNameserver()
+		if err != nil {
+			return nil, err
+		}
+		p.server = s
+	}
+	if _, _, err := net.SplitHostPort(p.server); err != nil {
+		p.server = net.JoinHostPort(p.server, "53")
+	}
+	return p, nil
+}
+
+// systemNameserver returns the first DNS server of the system configuration
+func systemNameserver() (string, error) {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return "", fmt.Errorf("no DNS server configured: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("no DNS server in %s", resolvConf)
+}
+
+// Resolve returns the targets of the records and the lowest TTL among them.
+// Failed AAAA lookups count as no records if the A lookup succeeded, and only
+// the SRV records of the lowest priority are used.
+func (p *dnsProvider) Resolve(ctx context.Context) ([]string, time.Duration, error) {
+	var records []dnsRecord
+	if p.srv {
+		srv, err := p.lookup(ctx, dnsTypeSRV)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = lowestPriority(srv)
+	} else {
+		a, err := p.lookup(ctx, dnsTypeA)
+		if err != nil {
+			return nil, 0, err
+		}
+		aaaa, err := p.lookup(ctx, dnsTypeAAAA)
+		if err != nil && ctx.Err() != nil {
+			return nil, 0, err
+		}
+		records = append(a, aaaa...)
+	}
+	if len(records) == 0 {
+		return nil, retryInterval, nil
+	}
+
+	targets := make([]string, 0, len(records))
+	ttl := records[0].ttl
+	for _, record := range records {
+		ttl = min(ttl, record.ttl)
+		if p.srv {
+			// A target of "." means that the service is not available
+			if record.target == "." {
+				continue
+			}
+			host := strings.TrimSuffix(record.target, ".")
+			targets = append(targets, p.scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(record.port))))
+		} else {
+			targets = append(targets, p.scheme+"://"+net.JoinHostPort(record.ip.String(), strconv.Itoa(p.port)))
+		}
+	}
+	return targets, time.Duration(ttl) * time.Second, nil
+}
+
+// lowestPriority returns the SRV records with the lowest priority value. The
+// records of higher values are backups, only to be contacted when all of the
+// preferred ones fail.
+func lowestPriority(records []dnsRecord) []dnsRecord {
+	var lowest []dnsRecord
+	for _, record := range records {
+		switch {
+		case len(lowest) == 0 || record.priority < lowest[0].priority:
+			lowest = []dnsRecord{record}
+		case record.priority == lowest[0].priority:
+			lowest = append(lowest, record)
+		}
+	}
+	return lowest
+}
+
+// lookup queries the records of a type over UDP, falling back to TCP for
+// truncated answers
+func (p *dnsProvider) lookup(ctx context.Context, typ uint16) ([]dnsRecord, error) {
+	id := uint16(rand.Uint32())
+	query, err := buildQuery(id, p.name, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	resp, err := p.exchange(ctx, "udp", id, query)
+	if err != nil {
+		return nil, err
+	}
+	records, truncated, err := parseResponse(resp, id, typ)
+	if err != nil || !truncated {
+		return records, err
+	}
+
+	resp, err = p.exchange(ctx, "tcp", id, query)
+	if err != nil {
+		return nil, err
+	}
+	records, _, err = parseResponse(resp, id, typ)
+	return records, err
+}
+
+// exchange sends a query to the server and returns its response
+func (p *dnsProvider) exchange(ctx context.Context, network string, id uint16, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, p.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if network == "tcp" {
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := conn.Write(append(msg, query...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray responses to other queries
+		if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+// buildQuery returns a recursive query for the records of a type
+func buildQuery(id uint16, name string, typ uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)      // one question
+
+	if name != "." {
+		for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid DNS name: %q", name)
+			}
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	msg = append(msg, 0)
+	if len(msg)-12 > 255 {
+		return nil, fmt.Errorf("DNS name too long: %q", name)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	return msg, nil
+}
+
+// parseResponse returns the records of a type in the answer section of a
+// response and whether the response was truncated
+func parseResponse(msg []byte, id uint16, typ uint16) ([]dnsRecord, bool, error) {
+	if len(msg) < 12 {
+		return nil, false, errShortMessage
+	}
+	if binary.BigEndian.Uint16(msg) != id {
+		return nil, false, fmt.Errorf("DNS response to another query")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return nil, false, fmt.Errorf("DNS message is not a response")
+	}
+	switch rcode := flags & 0x000F; rcode {
+	case 0:
+	case 3:
+		return nil, false, fmt.Errorf("no such host")
+	default:
+		return nil, false, fmt.Errorf("DNS server failed with code %d", rcode)
+	}
+	truncated := flags&0x0200 != 0
+
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, false, err
+		}
+		off = next + 4
+	}
+
+	var records []dnsRecord
+	for i := 0; i < answers; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, false, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, false, errShortMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, false, errShortMessage
+		}
+		data := msg[off : off+length]
+
+		// Answers may hold other records, such as the CNAMEs leading to the name
+		if rtype == typ && class == dnsClassIN {
+			record := dnsRecord{ttl: ttl}
+			switch {
+			case typ == dnsTypeA && length == net.IPv4len, typ == dnsTypeAAAA && length == net.IPv6len:
+				record.ip = net.IP(append([]byte(nil), data...))
+			case typ == dnsTypeSRV && length > 6:
+				record.priority = binary.BigEndian.Uint16(data)
+				record.port = binary.BigEndian.Uint16(data[4:])
+				if record.target, _, err = readName(msg, off+6); err != nil {
+					return nil, false, err
+				}
+			default:
+				return nil, false, fmt.Errorf("invalid DNS record of type %d", rtype)
+			}
+			records = append(records, record)
+		}
+		off += length
+	}
+	return records, truncated, nil
+}
+
+// readName returns the name at an offset of a message, following compression
+// pointers, and the offset after it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errShortMessage
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errShortMessage
+			}
+			if pointers++; pointers > maxPointers {
+				return "", 0, fmt.Errorf("too many compression pointers in DNS name")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		case n&0xC0 != 0:
+			return "", 0, fmt.Errorf("invalid DNS label")
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errShortMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubDNS represents a DNS server answering from a fixed set of records
+type stubDNS struct {
+	addr     string
+	records  map[string][][]byte // resource records by name and type
+	failing  map[string]bool     // names and types answered with SERVFAIL
+	truncate atomic.Bool         // truncate UDP responses, so TCP is used
+	mu       sync.Mutex
+}
+
+// newStubDNS starts a DNS server on UDP and TCP on the same local port
+func newStubDNS(t *testing.T) *stubDNS {
+	t.Helper()
+	var (
+		udp net.PacketConn
+		tcp net.Listener
+		err error
+	)
+	for i := 0; i < 10; i++ {
+		if udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatalf("ListenPacket() error = %v", err)
+		}
+		if tcp, err = net.Listen("tcp", udp.LocalAddr().String()); err == nil {
+			break
+		}
+		udp.Close()
+	}
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	s := &stubDNS{addr: udp.LocalAddr().String(), records: make(map[string][][]byte), failing: make(map[string]bool)}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(s.respond(buf[:n], s.truncate.Load()), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err == nil {
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err == nil {
+					resp := s.respond(query, false)
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return s
+}
+
+// add adds a record whose owner name points to the question
+func (s *stubDNS) add(name string, typ uint16, ttl uint32, data []byte) {
+	rr := []byte{0xC0, 12} // compression pointer to the question name
+	rr = binary.BigEndian.AppendUint16(rr, typ)
+	rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+	rr = binary.BigEndian.AppendUint32(rr, ttl)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(data)))
+	key := fmt.Sprintf("%s/%d", strings.ToLower(name), typ)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = append(s.records[key], append(rr, data...))
+}
+
+// fail makes the server answer queries for the records of a name with SERVFAIL
+func (s *stubDNS) fail(name string, typ uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing[fmt.Sprintf("%s/%d", strings.ToLower(name), typ)] = true
+}
+
+// respond returns the response to a query, NXDOMAIN for unknown names
+func (s *stubDNS) respond(query []byte, truncate bool) []byte {
+	name, end, err := readName(query, 12)
+	if err != nil {
+		return nil
+	}
+	typ := binary.BigEndian.Uint16(query[end:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rcode := uint16(3)
+	for key := range s.records {
+		if strings.HasPrefix(key, strings.ToLower(name)+"/") {
+			rcode = 0
+		}
+	}
+	key := fmt.Sprintf("%s/%d", strings.ToLower(name), typ)
+	answers := s.records[key]
+	if s.failing[key] {
+		rcode = 2
+		answers = nil
+	}
+	flags := 0x8180 | rcode
+	if truncate {
+		flags |= 0x0200
+		answers = nil
+	}
+
+	resp := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(query))
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+	resp = binary.BigEndian.AppendUint32(resp, 0)
+	resp = append(resp, query[12:end+4]...)
+	for _, answer := range answers {
+		resp = append(resp, answer...)
+	}
+	return resp
+}
+
+// srvData returns the data of an SRV record
+func srvData(priority, port uint16, target string) []byte {
+	data := binary.BigEndian.AppendUint16(nil, priority)
+	data = binary.BigEndian.AppendUint16(data, 5) // weight
+	data = binary.BigEndian.AppendUint16(data, port)
+	for _, label := range strings.Split(strings.TrimSuffix(target, "."), ".") {
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	return append(data, 0)
+}
+
+func TestDNSProvider(t *testing.T) {
+	server := newStubDNS(t)
+	server.add("api.example.com.", dnsTypeA, 30, net.ParseIP("10.0.0.1").To4())
+	server.add("api.example.com.", dnsTypeA, 20, net.ParseIP("10.0.0.2").To4())
+	server.add("api.example.com.", dnsTypeAAAA, 60, net.ParseIP("fd00::1"))
+	server.add("_http._tcp.api.example.com.", dnsTypeSRV, 15, srvData(10, 8080, "node-1.example.com."))
+	server.add("_http._tcp.api.example.com.", dnsTypeSRV, 45, srvData(10, 8081, "node-2.example.com."))
+	server.add("_http._tcp.api.example.com.", dnsTypeSRV, 5, srvData(20, 8082, "backup.example.com."))
+	server.add("v4.example.com.", dnsTypeA, 30, net.ParseIP("10.0.0.3").To4())
+	server.fail("v4.example.com.", dnsTypeAAAA)
+
+	// Test cases
+	tests := []struct {
+		name     string
+		record   string
+		truncate bool
+		want     []string
+		wantTTL  time.Duration
+	}{
+		{
+			name:    "api.example.com",
+			want:    []string{"http://10.0.0.1:3000", "http://10.0.0.2:3000", "http://[fd00::1]:3000"},
+			wantTTL: 20 * time.Second,
+		},
+		{
+			name:    "v4.example.com",
+			want:    []string{"http://10.0.0.3:3000"},
+			wantTTL: 30 * time.Second,
+		},
+		{
+			name:    "_http._tcp.api.example.com.",
+			record:  "SRV",
+			want:    []string{"http://node-1.example.com:8080", "http://node-2.example.com:8081"},
+			wantTTL: 15 * time.Second,
+		},
+		{
+			name:     "_http._tcp.api.example.com",
+			record:   "srv",
+			truncate: true,
+			want:     []string{"http://node-1.example.com:8080", "http://node-2.example.com:8081"},
+			wantTTL:  15 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.truncate.Store(tt.truncate)
+			p, err := newDNSProvider(tt.name, tt.record, 3000, server.addr, "http")
+			if err != nil {
+				t.Fatalf("newDNSProvider() error = %v", err)
+			}
+			got, ttl, err := p.Resolve(context.Background())
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			slices.Sort(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+			if ttl != tt.wantTTL {
+				t.Errorf("Resolve() ttl = %v, want %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestDNSProviderErrors(t *testing.T) {
+	server := newStubDNS(t)
+
+	server.add("broken.example.com.", dnsTypeAAAA, 30, net.ParseIP("fd00::1"))
+	server.fail("broken.example.com.", dnsTypeA)
+
+	// Unknown names and failed A lookups fail, so the previous targets are kept
+	for _, name := range []string{"missing.example.com", "broken.example.com"} {
+		p, err := newDNSProvider(name, "A", 80, server.addr, "http")
+		if err != nil {
+			t.Fatalf("newDNSProvider() error = %v", err)
+		}
+		if _, _, err := p.Resolve(context.Background()); err == nil {
+			t.Errorf("Resolve() of %s error = nil, want error", name)
+		}
+	}
+
+	// Invalid configurations
+	tests := []struct {
+		name   string
+		record string
+		port   int
+	}{
+		{name: "", port: 80},
+		{name: "api.example.com"},
+		{name: "api.example.com", record: "MX", port: 80},
+	}
+	for _, tt := range tests {
+		if _, err := newDNSProvider(tt.name, tt.record, tt.port, server.addr, "http"); err == nil {
+			t.Errorf("newDNSProvider(%q, %q, %d) error = nil, want error", tt.name, tt.record, tt.port)
+		}
+	}
+}
+
+func TestParseResponseErrors(t *testing.T) {
+	query, err := buildQuery(1, "api.example.com", dnsTypeA)
+	if err != nil {
+		t.Fatalf("buildQuery() error = %v", err)
+	}
+
+	// A compression pointer to itself
+	loop := append([]byte(nil), query...)
+	loop[2] = 0x80
+	loop[7] = 1
+	loop = append(loop, 0xC0, byte(len(query)))
+
+	for name, msg := range map[string][]byte{
+		"short":        query[:8],
+		"query":        query,
+		"other id":     append([]byte{0, 2}, query[2:]...),
+		"pointer loop": loop,
+	} {
+		if _, _, err := parseResponse(msg, 1, dnsTypeA); err == nil {
+			t.Errorf("parseResponse(%s) error = nil, want error", name)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// fileProvider represents targets listed in a local file, one per line. Empty
+// lines and lines starting with # are ignored. The file is read again every
+// interval, so it can be rewritten by a deployment tool or an agent.
+type fileProvider struct {
+	path     string
+	interval time.Duration
+}
+
+// newFileProvider creates a provider reading targets from a file
+func newFileProvider(path string, interval time.Duration) (*fileProvider, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file discovery requires a path")
+	}
+	return &fileProvider{path: path, interval: interval}, nil
+}
+
+// Resolve returns the targets listed in the file
+func (p *fileProvider) Resolve(ctx context.Context) ([]string, time.Duration, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var targets []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		targets = append(targets, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return targets, p.interval, nil
+}
@@ -0,0 +1,39 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets")
+	content := "# users service\nhttp://10.0.0.1:3000\n\n  http://10.0.0.2:3000  \n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	p, err := newFileProvider(path, 5*time.Second)
+	if err != nil {
+		t.Fatalf("newFileProvider() error = %v", err)
+	}
+	got, interval, err := p.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if want := []string{"http://10.0.0.1:3000", "http://10.0.0.2:3000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() = %v, want %v", got, want)
+	}
+	if interval != 5*time.Second {
+		t.Errorf("Resolve() interval = %v, want 5s", interval)
+	}
+
+	// A missing file fails, so the previous targets are kept
+	os.Remove(path)
+	if _, _, err := p.Resolve(context.Background()); err == nil {
+		t.Error("Resolve() of a missing file error = nil, want error")
+	}
+}
@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/mstgnz/goteway/pkg/middleware"
+)
+
+// AdminKeyHeader is the header carrying the admin API key
+const AdminKeyHeader = "X-Admin-Key"
+
+// adminPath returns the path prefix of the admin API
+func (g *Gateway) adminPath() string {
+	path := strings.TrimSuffix(g.config.Admin.Path, "/")
+	if path == "" {
+		path = "/_admin"
+	}
+	return path
+}
+
+// adminHandler returns the handler of the admin API
+func (g *Gateway) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(g.adminPath()+"/quotas", g.handleQuotas)
+	mux.HandleFunc(g.adminPath()+"/stats", g.handleStats)
+	mux.HandleFunc(g.adminPath()+"/weights", g.handleWeights)
+	mux.HandleFunc(g.adminPath()+"/canaries", g.handleCanaries)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Check the admin key, which initialize requires
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(AdminKeyHeader)), []byte(g.config.Admin.APIKey)) != 1 {
+			g.log.Warn("Unauthorized admin request from %s", middleware.ClientIP(r))
+			middleware.WriteError(w, http.StatusUnauthorized, "unauthorized", "Invalid admin key")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleQuotas lists quota usage on GET and resets it on DELETE. Usage can be
+// filtered by the policy and key query parameters; an apikey parameter selects
+// the usage counted for a raw API key.
+func (g *Gateway) handleQuotas(w http.ResponseWriter, r *http.Request) {
+	if g.quotaStore == nil {
+		middleware.WriteError(w, http.StatusNotFound, "not_found", "No quotas configured")
+		return
+	}
+
+	query := r.URL.Query()
+	policy, key := query.Get("policy"), query.Get("key")
+	if apiKey := query.Get("apikey"); apiKey != "" {
+		key = middleware.HashAPIKey(apiKey)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"quotas": g.quotaStore.Usage(policy, key)})
+	case http.MethodDelete:
+		if policy == "" {
+			middleware.WriteError(w, http.StatusBadRequest, "bad_request", "The policy parameter is required")
+			return
+		}
+		cleared := g.quotaStore.Reset(policy, key)
+		g.log.Info("Reset quota %s for %q (%d entries)", policy, key, cleared)
+		writeJSON(w, http.StatusOK, map[string]any{"cleared": cleared})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		middleware.WriteError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+	}
+}
+
+// handleStats lists the gateway metrics
+func (g *Gateway) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		middleware.WriteError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"metrics": g.stats.Snapshot()})
+}
+
+// handleWeights lists the weights of the routes' target groups on GET and
+// replaces the weights of the route given by the route query parameter on PUT
+func (g *Gateway) handleWeights(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		routes := make(map[string]map[string]int)
+		for name, route := range g.routes {
+			if route.split != nil {
+				routes[name] = route.split.currentWeights()
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"routes": routes})
+	case http.MethodPut:
+		name := r.URL.Query().Get("route")
+		route, ok := g.routes[name]
+		if !ok || route.split == nil {
+			middleware.WriteError(w, http.StatusNotFound, "not_found", "No target groups for route")
+			return
+		}
+		if route.split.canary != nil {
+			middleware.WriteError(w, http.StatusConflict, "conflict", "Weights are managed by the canary analysis")
+			return
+		}
+
+		var body struct {
+			Weights map[string]int `json:"weights"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			middleware.WriteError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+			return
+		}
+		if err := route.split.setWeights(body.Weights); err != nil {
+			middleware.WriteError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		g.log.Info("Set weights of route %s: %v", name, body.Weights)
+		writeJSON(w, http.StatusOK, map[string]any{"weights": route.split.currentWeights()})
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		middleware.WriteError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+	}
+}
+
+// handleCanaries lists the state and decisions of the canary analyses
+func (g *Gateway) handleCanaries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		middleware.WriteError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	canaries := make(map[string]canaryStatus)
+	for name, route := range g.routes {
+		if route.split != nil && route.split.canary != nil {
+			canaries[name] = route.split.canary.status()
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"canaries": canaries})
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+func TestGatewayQuotasAdmin(t *testing.T) {
+	// Create a test server
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// Create a gateway with a quota per API key and the admin API
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{
+				"path": "/api",
+				"target": %q,
+				"methods": ["GET"],
+				"middlewares": ["quota"],
+				"quotas": [{"name": "plan", "limit": 1, "period": "monthly", "key": "apikey"}]
+			}
+		],
+		"admin": {"apiKey": "admin-secret"}
+	}`, ts.URL))
+	defer gw.Stop()
+	handler := gw.Handler()
+
+	send := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	client := http.Header{"X-Api-Key": {"k1"}}
+	admin := http.Header{AdminKeyHeader: {"admin-secret"}}
+
+	// Use up the quota
+	if w := send("GET", "/api", client); w.Code != http.StatusOK {
+		t.Fatalf("first request status code = %v, want %v", w.Code, http.StatusOK)
+	}
+	if w := send("GET", "/api", client); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request status code = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+
+	// The admin API requires the admin key
+	if w := send("GET", "/_admin/quotas", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated admin status code = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+
+	// Inspect the usage of the API key
+	w := send("GET", "/_admin/quotas?apikey=k1", admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin status code = %v, want %v", w.Code, http.StatusOK)
+	}
+	var body struct {
+		Quotas []struct {
+			Policy string `json:"policy"`
+			Used   int64  `json:"used"`
+		} `json:"quotas"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+	if len(body.Quotas) != 1 || body.Quotas[0].Policy != "plan" || body.Quotas[0].Used != 1 {
+		t.Errorf("quotas = %+v, want one plan entry with 1 used", body.Quotas)
+	}
+
+	// Reset the usage
+	if w := send("DELETE", "/_admin/quotas?policy=plan&apikey=k1", admin); w.Code != http.StatusOK {
+		t.Fatalf("reset status code = %v, want %v", w.Code, http.StatusOK)
+	}
+	if w := send("GET", "/api", client); w.Code != http.StatusOK {
+		t.Errorf("request after reset status code = %v, want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestAdminRequiresKey(t *testing.T) {
+	// An admin API without a key is refused
+	tmpfile := writeTestConfig(t, `{
+		"routes": [{"path": "/api", "target": "http://localhost:3000", "methods": ["GET"]}],
+		"admin": {"path": "/_admin"}
+	}`)
+	if _, err := New(tmpfile, logger.INFO); err == nil {
+		t.Error("New() with an admin API without apiKey succeeded")
+	}
+}
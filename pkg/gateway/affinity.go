@@ -0,0 +1,85 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+)
+
+// sessionAffinity represents a signed cookie pinning a client to a target. The
+// cookie holds an opaque target ID, so it does not reveal upstream addresses,
+// and a signature over the route and ID, so clients cannot pick targets.
+type sessionAffinity struct {
+	route  string
+	cookie string
+	secret []byte
+	ttl    time.Duration
+}
+
+// newSessionAffinity creates a session affinity from its configuration
+func newSessionAffinity(route string, cfg *config.SessionAffinityConfig) (*sessionAffinity, error) {
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("session affinity requires a secret")
+	}
+
+	a := &sessionAffinity{
+		route:  route,
+		cookie: cfg.Cookie,
+		secret: []byte(cfg.Secret),
+		ttl:    time.Duration(cfg.TTL) * time.Second,
+	}
+	if a.cookie == "" {
+		sum := sha256.Sum256([]byte(route))
+		a.cookie = "goteway_session_" + hex.EncodeToString(sum[:4])
+	}
+	return a, nil
+}
+
+// id returns the opaque ID of a target
+func (a *sessionAffinity) id(target *upstreamTarget) string {
+	sum := sha256.Sum256([]byte(target.url.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sign returns the signature of a target ID
+func (a *sessionAffinity) sign(id string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(a.route + "|" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// pinned returns the target ID of a request's cookie if its signature is valid
+func (a *sessionAffinity) pinned(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(a.cookie)
+	if err != nil {
+		return "", false
+	}
+	id, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(a.sign(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// pin sets the cookie pinning the client to a target
+func (a *sessionAffinity) pin(w http.ResponseWriter, target *upstreamTarget) {
+	id := a.id(target)
+	cookie := &http.Cookie{
+		Name:     a.cookie,
+		Value:    id + "." + a.sign(id),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if a.ttl > 0 {
+		cookie.MaxAge = int(a.ttl / time.Second)
+	}
+	http.SetCookie(w, cookie)
+}
@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mstgnz/goteway/pkg/config"
+)
+
+func TestSessionAffinity(t *testing.T) {
+	if _, err := newSessionAffinity("/api", &config.SessionAffinityConfig{}); err == nil {
+		t.Error("newSessionAffinity() without a secret error = nil, want error")
+	}
+
+	a, err := newSessionAffinity("/api", &config.SessionAffinityConfig{Secret: "s3cret", TTL: 3600})
+	if err != nil {
+		t.Fatalf("newSessionAffinity() error = %v", err)
+	}
+	target := &upstreamTarget{url: &url.URL{Scheme: "http", Host: "10.0.0.1:8080"}}
+
+	// Pin a client to the target
+	w := httptest.NewRecorder()
+	a.pin(w, target)
+	cookie := w.Result().Cookies()[0]
+	if strings.Contains(cookie.Value, "10.0.0.1") {
+		t.Errorf("cookie %q reveals the target address", cookie.Value)
+	}
+	if cookie.MaxAge != 3600 || !cookie.HttpOnly {
+		t.Errorf("cookie = %+v, want a max age of 3600 and HttpOnly", cookie)
+	}
+
+	// Test cases
+	other, _ := newSessionAffinity("/other", &config.SessionAffinityConfig{Secret: "s3cret", Cookie: cookie.Name})
+	tests := []struct {
+		name     string
+		affinity *sessionAffinity
+		value    string
+		wantOK   bool
+	}{
+		{name: "valid", affinity: a, value: cookie.Value, wantOK: true},
+		{name: "tampered ID", affinity: a, value: "0000000000000000." + strings.SplitN(cookie.Value, ".", 2)[1]},
+		{name: "no signature", affinity: a, value: a.id(target)},
+		{name: "other route", affinity: other, value: cookie.Value},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api", nil)
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: tt.value})
+			id, ok := tt.affinity.pinned(req)
+			if ok != tt.wantOK {
+				t.Fatalf("pinned() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && id != a.id(target) {
+				t.Errorf("pinned() = %q, want %q", id, a.id(target))
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/middleware"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+const (
+	// AggregatePartialHeader lists the backends missing from a partial aggregated response
+	AggregatePartialHeader = "X-Aggregate-Partial"
+
+	// defaultAggregateTimeout is the default timeout of a backend request
+	defaultAggregateTimeout = 5 * time.Second
+	// maxAggregateBodySize is the maximum size of a backend response
+	maxAggregateBodySize = 10 << 20
+)
+
+// hopHeaders are the request headers not forwarded to aggregation and mirror backends
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length", "Accept-Encoding",
+}
+
+// aggregateBackend represents a backend called by an aggregation route
+type aggregateBackend struct {
+	key      string
+	target   *url.URL
+	path     *valueTemplate
+	method   string
+	timeout  time.Duration
+	required bool
+	bulkhead *middleware.Bulkhead // concurrency limit of the upstream, if any
+}
+
+// aggregateResult represents the response of a backend
+type aggregateResult struct {
+	value any
+	err   error
+}
+
+// aggregator represents a handler calling several backends in parallel and
+// merging their JSON responses into one
+type aggregator struct {
+	backends        []*aggregateBackend
+	flatten         bool
+	tail            string // wildcard tail parameter of the route, keeping its slashes
+	client          *http.Client
+	requestHeaders  []*headerRules
+	responseHeaders []*headerRules
+	transform       *bodyTransform
+	stats           *stats.Registry
+	log             *logger.Logger
+}
+
+// newAggregator creates an aggregator from its configuration, given the
+// wildcard tail parameter of the route
+func newAggregator(cfg *config.AggregateConfig, tail string, log *logger.Logger) (*aggregator, error) {
+	if len(cfg.Backends) == 0 {
+		return nil, fmt.Errorf("no aggregation backends")
+	}
+
+	a := &aggregator{flatten: cfg.Flatten, tail: tail, client: &http.Client{Transport: middleware.UpstreamTransport(nil)}, log: log}
+	keys := make(map[string]bool)
+	for _, backendConfig := range cfg.Backends {
+		if backendConfig.Key == "" {
+			return nil, fmt.Errorf("aggregation backend without a key")
+		}
+		if keys[backendConfig.Key] {
+			return nil, fmt.Errorf("duplicate aggregation backend: %s", backendConfig.Key)
+		}
+		keys[backendConfig.Key] = true
+
+		target, err := url.Parse(backendConfig.Target)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid target of aggregation backend %s: %q", backendConfig.Key, backendConfig.Target)
+		}
+		path, err := parseTemplate(backendConfig.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path of aggregation backend %s: %w", backendConfig.Key, err)
+		}
+
+		backend := &aggregateBackend{
+			key:      backendConfig.Key,
+			target:   target,
+			path:     path,
+			method:   backendConfig.Method,
+			timeout:  time.Duration(backendConfig.Timeout) * time.Millisecond,
+			required: backendConfig.Required,
+		}
+		if backend.method == "" {
+			backend.method = http.MethodGet
+		}
+		if backend.timeout <= 0 {
+			backend.timeout = defaultAggregateTimeout
+		}
+		a.backends = append(a.backends, backend)
+	}
+
+	return a, nil
+}
+
+// ServeHTTP implements http.Handler
+func (a *aggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Build the backend URLs
+	urls := make([]*url.URL, len(a.backends))
+	for i, backend := range a.backends {
+		u, err := backend.url(r, a.tail)
+		if err != nil {
+			a.log.Warn("Rejected aggregation request %s: %v", r.URL.Path, err)
+			middleware.WriteError(w, http.StatusBadRequest, "bad_request", "Invalid path parameter")
+			return
+		}
+		urls[i] = u
+	}
+
+	// Call the backends in parallel
+	results := make([]aggregateResult, len(a.backends))
+	var wg sync.WaitGroup
+	for i, backend := range a.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := a.fetch(r, backend, urls[i])
+			results[i] = aggregateResult{value: value, err: err}
+		}()
+	}
+	wg.Wait()
+
+	// Merge the responses
+	var failed []string
+	doc := make(map[string]any)
+	for i, backend := range a.backends {
+		result := results[i]
+		if result.err != nil {
+			a.log.Warn("Aggregation backend %s failed: %v", backend.key, result.err)
+			if backend.required {
+				middleware.WriteError(w, http.StatusBadGateway, "bad_gateway", "Backend request failed")
+				return
+			}
+			failed = append(failed, backend.key)
+			continue
+		}
+
+		if object, ok := result.value.(map[string]any); ok && a.flatten {
+			for key, value := range object {
+				doc[key] = value
+			}
+			continue
+		}
+		doc[backend.key] = result.value
+	}
+	if len(failed) == len(a.backends) {
+		middleware.WriteError(w, http.StatusBadGateway, "bad_gateway", "Backend request failed")
+		return
+	}
+
+	var result any = doc
+	if a.transform != nil {
+		result = a.transform.apply(result)
+	}
+	body, err := encodeJSON(result)
+	if err != nil {
+		middleware.WriteError(w, http.StatusInternalServerError, "internal_error", "Failed to encode response")
+		return
+	}
+
+	// Write the response
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if len(failed) > 0 {
+		header.Set(AggregatePartialHeader, strings.Join(failed, ","))
+	}
+	applyHeaderRules(a.responseHeaders, header, r, http.StatusOK)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// url returns the URL of a backend for a request, appending the path of the
+// backend to its target and replacing the query of the target if the path has one
+func (b *aggregateBackend) url(r *http.Request, tail string) (*url.URL, error) {
+	path, query, err := b.path.executePath(r, tail)
+	if err != nil {
+		return nil, err
+	}
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *b.target
+	u.Path = strings.TrimSuffix(u.Path, "/") + unescaped
+	u.RawPath = strings.TrimSuffix(b.target.EscapedPath(), "/") + path
+	if query != "" {
+		u.RawQuery = query
+	}
+	return &u, nil
+}
+
+// fetch calls a backend at a URL and returns its decoded JSON response
+func (a *aggregator) fetch(r *http.Request, backend *aggregateBackend, u *url.URL) (any, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), backend.timeout)
+	defer cancel()
+
+	// Wait for a slot of the upstream
+	if bulkhead := backend.bulkhead; bulkhead != nil {
+		if !bulkhead.Acquire(ctx) {
+			if a.stats != nil {
+				a.stats.Counter("bulkhead_rejected_total", "bulkhead", bulkhead.Name).Inc()
+			}
+			return nil, fmt.Errorf("bulkhead %s saturated", bulkhead.Name)
+		}
+		defer bulkhead.Release()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, backend.method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Forward the client's headers
+	req.Header = r.Header.Clone()
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	applyHeaderRules(a.requestHeaders, req.Header, r, 0)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAggregateBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAggregateBodySize {
+		return nil, fmt.Errorf("response larger than %d bytes", maxAggregateBodySize)
+	}
+	return decodeJSON(data)
+}
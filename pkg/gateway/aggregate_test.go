@@ -0,0 +1,226 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+func TestNewAggregatorErrors(t *testing.T) {
+	for _, cfg := range []*config.AggregateConfig{
+		{},
+		{Backends: []config.AggregateBackendConfig{{Target: "http://users"}}},
+		{Backends: []config.AggregateBackendConfig{{Key: "a", Target: "http://a"}, {Key: "a", Target: "http://b"}}},
+		{Backends: []config.AggregateBackendConfig{{Key: "a", Target: "users"}}},
+		{Backends: []config.AggregateBackendConfig{{Key: "a", Target: "http://a", Path: "/${param}"}}},
+	} {
+		if _, err := newAggregator(cfg, "", logger.New(logger.INFO)); err == nil {
+			t.Errorf("newAggregator(%+v) error = nil, want error", cfg)
+		}
+	}
+}
+
+func TestGatewayAggregate(t *testing.T) {
+	// Create backends
+	users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":%q,"name":"Ada","tenant":%q}`, r.URL.Path, r.Header.Get("X-Tenant"))
+	}))
+	defer users.Close()
+	orders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[{"user":%q}]`, r.URL.Query().Get("user"))
+	}))
+	defer orders.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	// Create a gateway with aggregation routes
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{
+				"path": "/screens/home/{id}",
+				"methods": ["GET"],
+				"middlewares": ["ratelimit"],
+				"rateLimit": {"limit": 2, "window": 60},
+				"aggregate": {
+					"backends": [
+						{"key": "user", "target": %[1]q, "path": "/users/${param.id}", "required": true},
+						{"key": "orders", "target": %[2]q, "path": "/orders?user=${param.id}"},
+						{"key": "recommendations", "target": %[3]q, "timeout": 50}
+					]
+				}
+			},
+			{
+				"path": "/screens/profile",
+				"methods": ["GET"],
+				"aggregate": {
+					"flatten": true,
+					"backends": [
+						{"key": "user", "target": %[1]q, "path": "/me"},
+						{"key": "orders", "target": %[2]q}
+					]
+				}
+			},
+			{
+				"path": "/screens/broken",
+				"methods": ["GET"],
+				"aggregate": {
+					"backends": [
+						{"key": "user", "target": %[4]q, "required": true},
+						{"key": "orders", "target": %[2]q}
+					]
+				}
+			}
+		]
+	}`, users.URL, orders.URL, slow.URL, failing.URL))
+	handler := gw.Handler()
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Tenant", "acme")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) map[string]any {
+		var doc map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+			t.Fatalf("Failed to decode response %q: %v", w.Body.String(), err)
+		}
+		return doc
+	}
+
+	// Check a partial response keyed by backend
+	w := send("/screens/home/42")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code = %v, want %v", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get(AggregatePartialHeader); got != "recommendations" {
+		t.Errorf("%s = %q, want %q", AggregatePartialHeader, got, "recommendations")
+	}
+	want := map[string]any{
+		"user":   map[string]any{"id": "/users/42", "name": "Ada", "tenant": "acme"},
+		"orders": []any{map[string]any{"user": "42"}},
+	}
+	if got := decode(w); !reflect.DeepEqual(got, want) {
+		t.Errorf("response = %v, want %v", got, want)
+	}
+
+	// Check a flattened response
+	w = send("/screens/profile")
+	want = map[string]any{
+		"id":     "/me",
+		"name":   "Ada",
+		"tenant": "acme",
+		"orders": []any{map[string]any{"user": ""}},
+	}
+	if got := decode(w); !reflect.DeepEqual(got, want) {
+		t.Errorf("response = %v, want %v", got, want)
+	}
+	if got := w.Header().Get(AggregatePartialHeader); got != "" {
+		t.Errorf("%s = %q, want none", AggregatePartialHeader, got)
+	}
+
+	// Check that a failing required backend fails the request
+	if w := send("/screens/broken"); w.Code != http.StatusBadGateway {
+		t.Errorf("status code = %v, want %v", w.Code, http.StatusBadGateway)
+	}
+
+	// Check that the route middlewares apply
+	send("/screens/home/42")
+	if w := send("/screens/home/42"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("status code = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestGatewayAggregatePathParams(t *testing.T) {
+	// Create a backend echoing the requested path
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"path":%q}`, r.URL.EscapedPath())
+	}))
+	defer ts.Close()
+
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{
+				"path": "/screens/{id}",
+				"methods": ["GET"],
+				"aggregate": {"backends": [{"key": "user", "target": %q, "path": "/v2/users/${param.id}/profile"}]}
+			}
+		]
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	// Encoded slashes stay inside the parameter's segment
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/screens/x%2F..%2F..%2Fadmin", nil))
+	if want := `{"user":{"path":"/v2/users/x%2F..%2F..%2Fadmin/profile"}}`; w.Body.String() != want {
+		t.Errorf("response = %s, want %s", w.Body.String(), want)
+	}
+
+	// Dot segments are rejected
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/screens/%2E%2E", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGatewayAggregateQueryParams(t *testing.T) {
+	// Create a backend echoing the requested query
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"path":%q,"query":%q,"admin":%q}`, r.URL.Path, r.URL.RawQuery, r.URL.Query().Get("admin"))
+	}))
+	defer ts.Close()
+
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{
+				"path": "/screens/{id}",
+				"methods": ["GET"],
+				"aggregate": {"backends": [{"key": "orders", "target": %q, "path": "/orders?user=${param.id}&limit=5"}]}
+			}
+		]
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	// Test cases
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "plain", path: "/screens/1", want: `{"orders":{"admin":"","path":"/orders","query":"user=1&limit=5"}}`},
+		{name: "injected parameter", path: "/screens/1&admin=true", want: `{"orders":{"admin":"","path":"/orders","query":"user=1%26admin%3Dtrue&limit=5"}}`},
+		{name: "injected fragment", path: "/screens/1%23x%3Fadmin=true", want: `{"orders":{"admin":"","path":"/orders","query":"user=1%23x%3Fadmin%3Dtrue&limit=5"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Body.String() != tt.want {
+				t.Errorf("response = %s, want %s", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,475 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/discovery"
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/middleware"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+const (
+	// defaultHealthInterval is the default time between active health checks
+	defaultHealthInterval = 10 * time.Second
+	// defaultHealthTimeout is the default timeout of an active health check
+	defaultHealthTimeout = 2 * time.Second
+	// defaultHealthThreshold is the default number of checks in a row changing the health of a target
+	defaultHealthThreshold = 2
+	// defaultMaxFailures is the default number of failed requests in a row ejecting a target
+	defaultMaxFailures = 5
+	// defaultEjectionTime is the default time an ejected target gets no traffic
+	defaultEjectionTime = 30 * time.Second
+	// defaultFailoverThreshold is the default healthy fraction of a target pool
+	// below which its traffic spills over to the next pool
+	defaultFailoverThreshold = 0.7
+)
+
+// upstreamTarget represents one of the targets of a route with its health
+type upstreamTarget struct {
+	url          *url.URL
+	down         atomic.Bool  // failed the active health checks
+	failures     atomic.Int32 // failed requests in a row
+	ejectedUntil atomic.Int64 // unix nanoseconds, ejected by failed requests before
+	streak       int          // checks in a row contradicting down, used by the checker only
+}
+
+// healthy reports whether the target passed its health checks and is not ejected
+func (t *upstreamTarget) healthy(now time.Time) bool {
+	return !t.down.Load() && now.UnixNano() >= t.ejectedUntil.Load()
+}
+
+// targetPool represents a group of targets balanced round robin. The targets
+// of discovered pools are replaced while requests are served.
+type targetPool struct {
+	name    string
+	targets atomic.Pointer[[]*upstreamTarget]
+	next    atomic.Uint64
+}
+
+// list returns the current targets of the pool
+func (p *targetPool) list() []*upstreamTarget {
+	return *p.targets.Load()
+}
+
+// healthyFraction returns the fraction of the pool's targets that are healthy
+func (p *targetPool) healthyFraction(now time.Time) float64 {
+	targets := p.list()
+	if len(targets) == 0 {
+		return 0
+	}
+	healthy := 0
+	for _, target := range targets {
+		if target.healthy(now) {
+			healthy++
+		}
+	}
+	return float64(healthy) / float64(len(targets))
+}
+
+// roundRobin returns the next healthy target, or the next target if none is
+// healthy. It returns nil if the pool has no targets.
+func (p *targetPool) roundRobin(now time.Time) *upstreamTarget {
+	targets := p.list()
+	n := uint64(len(targets))
+	if n == 0 {
+		return nil
+	}
+	start := p.next.Add(1) - 1
+	for i := uint64(0); i < n; i++ {
+		if target := targets[(start+i)%n]; target.healthy(now) {
+			return target
+		}
+	}
+	return targets[start%n]
+}
+
+// balancer represents the distribution of a route's requests over its targets.
+// Targets are grouped in pools by priority, and each pool gets a share of the
+// traffic depending on the health of its own and higher priority pools. Within
+// a pool requests go round robin to the healthy targets, or to all targets if
+// none is healthy. Targets are checked actively by requesting a health path and
+// passively by ejecting targets failing too many requests in a row. Pools may
+// have their targets looked up by a discovery provider instead.
+type balancer struct {
+	route     string
+	pools     []*targetPool // in priority order
+	watchers  []*discovery.Watcher
+	threshold float64
+	affinity  *sessionAffinity // keeps clients on one target, if configured
+
+	checkPath          string
+	checkInterval      time.Duration
+	checkTimeout       time.Duration
+	unhealthyThreshold int
+	healthyThreshold   int
+	maxFailures        int32
+	ejectionTime       time.Duration
+
+	client *http.Client
+	done   chan struct{}
+	wg     sync.WaitGroup
+	stats  *stats.Registry
+	log    *logger.Logger
+	now    func() time.Time
+}
+
+// newBalancer creates a balancer over the target pools of a route, given in
+// priority order. Active health checks run in the background until Close is
+// called.
+func newBalancer(route string, failover *config.FailoverConfig, health *config.HealthCheckConfig, affinity *config.SessionAffinityConfig, registry *stats.Registry, log *logger.Logger) (*balancer, error) {
+	if health == nil {
+		health = &config.HealthCheckConfig{}
+	}
+
+	b := &balancer{
+		route:              route,
+		threshold:          failover.Threshold,
+		checkPath:          health.Path,
+		checkInterval:      time.Duration(health.Interval) * time.Second,
+		checkTimeout:       time.Duration(health.Timeout) * time.Millisecond,
+		unhealthyThreshold: health.UnhealthyThreshold,
+		healthyThreshold:   health.HealthyThreshold,
+		maxFailures:        int32(health.MaxFailures),
+		ejectionTime:       time.Duration(health.EjectionTime) * time.Second,
+		client: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		done:  make(chan struct{}),
+		stats: registry,
+		log:   log,
+		now:   time.Now,
+	}
+	if b.checkInterval <= 0 {
+		b.checkInterval = defaultHealthInterval
+	}
+	if b.checkTimeout <= 0 {
+		b.checkTimeout = defaultHealthTimeout
+	}
+	if b.unhealthyThreshold <= 0 {
+		b.unhealthyThreshold = defaultHealthThreshold
+	}
+	if b.healthyThreshold <= 0 {
+		b.healthyThreshold = defaultHealthThreshold
+	}
+	if b.maxFailures <= 0 {
+		b.maxFailures = defaultMaxFailures
+	}
+	if b.ejectionTime <= 0 {
+		b.ejectionTime = defaultEjectionTime
+	}
+	if b.threshold == 0 {
+		b.threshold = defaultFailoverThreshold
+	}
+	if b.threshold < 0 || b.threshold > 1 {
+		return nil, fmt.Errorf("failover threshold must be between 0 and 1")
+	}
+	if b.checkPath != "" && !strings.HasPrefix(b.checkPath, "/") {
+		return nil, fmt.Errorf("health check path must start with /: %q", b.checkPath)
+	}
+
+	if len(failover.Groups) == 0 {
+		return nil, fmt.Errorf("no target groups")
+	}
+	seen := make(map[string]bool)
+	names := make(map[string]bool)
+	providers := make(map[*targetPool]discovery.Provider)
+	for _, group := range failover.Groups {
+		if names[group.Name] {
+			return nil, fmt.Errorf("duplicate target group: %q", group.Name)
+		}
+		names[group.Name] = true
+
+		pool := &targetPool{name: group.Name}
+		var targets []*upstreamTarget
+		switch {
+		case group.Discovery != nil:
+			if len(group.Targets) > 0 {
+				return nil, fmt.Errorf("group %q cannot have both targets and discovery", group.Name)
+			}
+			provider, err := discovery.New(group.Discovery)
+			if err != nil {
+				return nil, fmt.Errorf("invalid discovery of group %q: %w", group.Name, err)
+			}
+			providers[pool] = provider
+		case len(group.Targets) == 0:
+			return nil, fmt.Errorf("no targets in group %q", group.Name)
+		}
+		for _, target := range group.Targets {
+			u, err := url.Parse(target)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("invalid target: %q", target)
+			}
+			if seen[u.String()] {
+				return nil, fmt.Errorf("duplicate target: %s", target)
+			}
+			seen[u.String()] = true
+			targets = append(targets, &upstreamTarget{url: u})
+		}
+		pool.targets.Store(&targets)
+		b.pools = append(b.pools, pool)
+	}
+
+	if affinity != nil {
+		a, err := newSessionAffinity(route, affinity)
+		if err != nil {
+			return nil, err
+		}
+		b.affinity = a
+	}
+
+	// Look up the targets of discovered pools before serving requests
+	for _, pool := range b.pools {
+		if provider, ok := providers[pool]; ok {
+			name := fmt.Sprintf("route %s", route)
+			if len(b.pools) > 1 {
+				name += fmt.Sprintf(" group %s", pool.name)
+			}
+			b.watchers = append(b.watchers, discovery.Watch(name, provider, func(targets []string) {
+				b.setTargets(pool, targets)
+			}, log))
+		}
+	}
+
+	if b.checkPath != "" {
+		b.wg.Add(1)
+		go b.checkLoop()
+	}
+
+	return b, nil
+}
+
+// serve sends a request to a target through next and records the outcome
+// for passive health checking
+func (b *balancer) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	target := b.pick(w, r)
+	if target == nil {
+		middleware.WriteError(w, http.StatusServiceUnavailable, "service_unavailable", "No targets available")
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(sw, withTarget(r, target.url))
+	b.report(target, sw.status >= http.StatusInternalServerError)
+}
+
+// pick selects the target of a request. A client pinned to a healthy target
+// by its session cookie stays on it; others are balanced round robin and
+// pinned to the selected target. It returns nil if no target is known.
+func (b *balancer) pick(w http.ResponseWriter, r *http.Request) *upstreamTarget {
+	now := b.now()
+	if b.affinity != nil {
+		if id, ok := b.affinity.pinned(r); ok {
+			for _, target := range b.allTargets() {
+				if b.affinity.id(target) == id && target.healthy(now) {
+					return target
+				}
+			}
+		}
+	}
+
+	target := b.choosePool(now).roundRobin(now)
+	if target != nil && b.affinity != nil {
+		b.affinity.pin(w, target)
+	}
+	return target
+}
+
+// allTargets returns the current targets of all pools
+func (b *balancer) allTargets() []*upstreamTarget {
+	var targets []*upstreamTarget
+	for _, pool := range b.pools {
+		targets = append(targets, pool.list()...)
+	}
+	return targets
+}
+
+// setTargets replaces the targets of a pool with discovered ones. Targets
+// that remain keep their health.
+func (b *balancer) setTargets(pool *targetPool, urls []string) {
+	current := make(map[string]*upstreamTarget)
+	for _, target := range pool.list() {
+		current[target.url.String()] = target
+	}
+
+	targets := make([]*upstreamTarget, 0, len(urls))
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			b.log.Warn("Ignoring invalid discovered target %q of route %s", raw, b.route)
+			continue
+		}
+		target, ok := current[u.String()]
+		if !ok {
+			target = &upstreamTarget{url: u}
+		}
+		targets = append(targets, target)
+	}
+	pool.targets.Store(&targets)
+}
+
+// choosePool selects the pool of a request at random, weighted by the loads
+func (b *balancer) choosePool(now time.Time) *targetPool {
+	if len(b.pools) == 1 {
+		return b.pools[0]
+	}
+
+	x := rand.Float64()
+	for i, load := range b.loads(now) {
+		if x < load {
+			b.stats.Counter("failover_requests_total", "route", b.route, "group", b.pools[i].name).Inc()
+			return b.pools[i]
+		}
+		x -= load
+	}
+	return b.pools[0]
+}
+
+// loads returns the share of the traffic each pool gets. A pool's health is
+// its healthy fraction relative to the threshold, capped at 1. Pools take as
+// much of the traffic left by higher priority pools as their health allows, so
+// traffic spills over gradually as a pool loses targets. If the pools together
+// are not fully healthy their loads are scaled up in proportion.
+func (b *balancer) loads(now time.Time) []float64 {
+	health := make([]float64, len(b.pools))
+	total := 0.0
+	for i, pool := range b.pools {
+		health[i] = min(1, pool.healthyFraction(now)/b.threshold)
+		total += health[i]
+	}
+
+	loads := make([]float64, len(b.pools))
+	switch {
+	case total == 0:
+		loads[0] = 1
+	case total < 1:
+		for i := range loads {
+			loads[i] = health[i] / total
+		}
+	default:
+		remaining := 1.0
+		for i := range loads {
+			loads[i] = min(remaining, health[i])
+			remaining -= loads[i]
+		}
+	}
+	return loads
+}
+
+// report records the outcome of a request, ejecting the target when too many
+// requests in a row have failed
+func (b *balancer) report(target *upstreamTarget, failed bool) {
+	if !failed {
+		target.failures.Store(0)
+		return
+	}
+	if target.failures.Add(1) < b.maxFailures {
+		return
+	}
+
+	target.failures.Store(0)
+	target.ejectedUntil.Store(b.now().Add(b.ejectionTime).UnixNano())
+	b.stats.Counter("upstream_ejections_total", "route", b.route, "target", target.url.String()).Inc()
+	b.log.Warn("Ejected target %s of route %s for %s after %d failed requests", target.url, b.route, b.ejectionTime, b.maxFailures)
+}
+
+// checkLoop runs the active health checks until the balancer is closed
+func (b *balancer) checkLoop() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.checkInterval)
+	defer ticker.Stop()
+	for {
+		b.checkAll()
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// checkAll checks the health of every target
+func (b *balancer) checkAll() {
+	var wg sync.WaitGroup
+	for _, target := range b.allTargets() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.update(target, b.check(target))
+		}()
+	}
+	wg.Wait()
+}
+
+// check requests the health path of a target and reports whether it succeeded
+func (b *balancer) check(target *upstreamTarget) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), b.checkTimeout)
+	defer cancel()
+
+	u := *target.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + b.checkPath
+	u.RawPath = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// update applies the result of a health check to a target, changing its
+// health after enough checks in a row
+func (b *balancer) update(target *upstreamTarget, passed bool) {
+	down := target.down.Load()
+	if passed != down {
+		target.streak = 0
+		return
+	}
+
+	target.streak++
+	threshold := b.unhealthyThreshold
+	if down {
+		threshold = b.healthyThreshold
+	}
+	if target.streak < threshold {
+		return
+	}
+
+	target.streak = 0
+	target.down.Store(!down)
+	healthy := 1.0
+	if !down {
+		healthy = 0
+		b.log.Warn("Target %s of route %s is down", target.url, b.route)
+	} else {
+		b.log.Info("Target %s of route %s is up", target.url, b.route)
+	}
+	b.stats.Gauge("upstream_healthy", "route", b.route, "target", target.url.String()).Set(healthy)
+}
+
+// Close stops the active health checks and the discovery of targets
+func (b *balancer) Close() {
+	select {
+	case <-b.done:
+		return
+	default:
+		close(b.done)
+	}
+	for _, watcher := range b.watchers {
+		watcher.Close()
+	}
+	b.wg.Wait()
+}
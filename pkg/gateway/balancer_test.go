@@ -0,0 +1,414 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+func TestNewBalancerErrors(t *testing.T) {
+	group := func(name string, targets ...string) config.FailoverGroupConfig {
+		return config.FailoverGroupConfig{Name: name, Targets: targets}
+	}
+	tests := []struct {
+		failover config.FailoverConfig
+		health   *config.HealthCheckConfig
+		affinity *config.SessionAffinityConfig
+	}{
+		{},
+		{failover: config.FailoverConfig{Groups: []config.FailoverGroupConfig{group("a")}}},
+		{failover: config.FailoverConfig{Groups: []config.FailoverGroupConfig{group("a", "backend")}}},
+		{failover: config.FailoverConfig{Groups: []config.FailoverGroupConfig{group("a", "http://a", "http://a")}}},
+		{failover: config.FailoverConfig{Groups: []config.FailoverGroupConfig{group("a", "http://a"), group("b", "http://a")}}},
+		{failover: config.FailoverConfig{Groups: []config.FailoverGroupConfig{group("a", "http://a"), group("a", "http://b")}}},
+		{failover: config.FailoverConfig{Groups: []config.FailoverGroupConfig{group("a", "http://a")}, Threshold: 1.5}},
+		{failover: config.FailoverConfig{Groups: []config.FailoverGroupConfig{group("a", "http://a")}}, health: &config.HealthCheckConfig{Path: "health"}},
+		{failover: config.FailoverConfig{Groups: []config.FailoverGroupConfig{group("a", "http://a")}}, affinity: &config.SessionAffinityConfig{}},
+	}
+	for _, tt := range tests {
+		if _, err := newBalancer("/api", &tt.failover, tt.health, tt.affinity, stats.NewRegistry(), logger.New(logger.INFO)); err == nil {
+			t.Errorf("newBalancer(%+v) error = nil, want error", tt.failover)
+		}
+	}
+}
+
+func TestBalancerHealth(t *testing.T) {
+	b, err := newBalancer("/api", &config.FailoverConfig{
+		Groups: []config.FailoverGroupConfig{{Targets: []string{"http://a", "http://b", "http://c"}}},
+	}, &config.HealthCheckConfig{
+		MaxFailures:  2,
+		EjectionTime: 30,
+	}, nil, stats.NewRegistry(), logger.New(logger.INFO))
+	if err != nil {
+		t.Fatalf("newBalancer() error = %v", err)
+	}
+	targets := b.allTargets()
+	now := time.Unix(1700000000, 0)
+	b.now = func() time.Time { return now }
+
+	// pickHosts returns the hosts of the next picks
+	pickHosts := func(n int) map[string]int {
+		hosts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			hosts[b.pick(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil)).url.Host]++
+		}
+		return hosts
+	}
+
+	if hosts := pickHosts(6); hosts["a"] != 2 || hosts["b"] != 2 || hosts["c"] != 2 {
+		t.Errorf("picks = %v, want round robin", hosts)
+	}
+
+	// Failed requests in a row eject a target
+	b.report(targets[0], true)
+	b.report(targets[0], false)
+	b.report(targets[0], true)
+	if hosts := pickHosts(3); hosts["a"] != 1 {
+		t.Fatalf("picks = %v, want a not ejected after interrupted failures", hosts)
+	}
+	b.report(targets[0], true)
+	if hosts := pickHosts(4); hosts["a"] != 0 || hosts["b"] == 0 || hosts["c"] == 0 {
+		t.Errorf("picks = %v, want a ejected", hosts)
+	}
+
+	// Failed health checks mark a target down until enough checks pass
+	for i := 0; i < defaultHealthThreshold; i++ {
+		b.update(targets[1], false)
+	}
+	if hosts := pickHosts(2); hosts["c"] != 2 {
+		t.Errorf("picks = %v, want only c", hosts)
+	}
+
+	// Without healthy targets all targets are used
+	targets[2].down.Store(true)
+	if hosts := pickHosts(3); len(hosts) != 3 {
+		t.Errorf("picks = %v, want all targets", hosts)
+	}
+
+	// Targets come back after their ejection and passed checks
+	targets[2].down.Store(false)
+	now = now.Add(31 * time.Second)
+	b.update(targets[1], true)
+	if hosts := pickHosts(3); hosts["b"] != 0 {
+		t.Errorf("picks = %v, want b still down after one passed check", hosts)
+	}
+	b.update(targets[1], true)
+	if hosts := pickHosts(3); len(hosts) != 3 {
+		t.Errorf("picks = %v, want all targets", hosts)
+	}
+}
+
+func TestGatewaySessionAffinity(t *testing.T) {
+	// Create replicas, the first of which can be made unhealthy
+	var unhealthy atomic.Bool
+	newReplica := func(name string, health *atomic.Bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" && health != nil && health.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(name))
+		}))
+	}
+	first := newReplica("first", &unhealthy)
+	defer first.Close()
+	second := newReplica("second", nil)
+	defer second.Close()
+
+	// Create a gateway with sticky sessions over the replicas
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{
+				"path": "/api",
+				"targets": [%q, %q],
+				"methods": ["GET"],
+				"healthCheck": {"path": "/healthz", "interval": 1, "unhealthyThreshold": 1, "healthyThreshold": 1},
+				"sessionAffinity": {"secret": "s3cret"}
+			}
+		]
+	}`, first.URL, second.URL))
+	defer gw.Stop()
+	handler := gw.Handler()
+
+	send := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Find the client pinned to the first replica
+	var cookie *http.Cookie
+	for i := 0; i < 2 && cookie == nil; i++ {
+		if w := send(nil); w.Body.String() == "first" {
+			cookie = w.Result().Cookies()[0]
+		}
+	}
+	if cookie == nil {
+		t.Fatal("no request reached the first replica")
+	}
+
+	// The client stays on its replica without a new cookie
+	for i := 0; i < 5; i++ {
+		w := send(cookie)
+		if w.Body.String() != "first" {
+			t.Fatalf("pinned request reached %q, want first", w.Body.String())
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Fatal("pinned request got a new cookie")
+		}
+	}
+
+	// The client is re-pinned when its replica is down
+	unhealthy.Store(true)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		w := send(cookie)
+		if w.Body.String() == "second" {
+			if len(w.Result().Cookies()) != 1 {
+				t.Error("re-pinned request got no new cookie")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request not moved off the unhealthy replica")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestGatewayClosesBalancersOnError(t *testing.T) {
+	// Create a server counting its health checks
+	var checks atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+	}))
+	defer ts.Close()
+
+	// A health-checked route followed by an invalid one
+	tmpfile := writeTestConfig(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/api", "targets": [%q], "methods": ["GET"], "healthCheck": {"path": "/healthz", "interval": 1}},
+			{"path": "/api", "target": %q, "methods": ["GET"]}
+		]
+	}`, ts.URL, ts.URL))
+	if _, err := New(tmpfile, logger.INFO); err == nil {
+		t.Fatal("New() with a duplicate route succeeded")
+	}
+
+	// The health checks stopped with the failed initialization
+	before := checks.Load()
+	time.Sleep(1500 * time.Millisecond)
+	if after := checks.Load(); after != before {
+		t.Errorf("health checks after failed New() = %v, want %v", after, before)
+	}
+}
+
+func TestBalancerLoads(t *testing.T) {
+	b, err := newBalancer("/api", &config.FailoverConfig{
+		Groups: []config.FailoverGroupConfig{
+			{Name: "local", Targets: []string{"http://a1", "http://a2", "http://a3", "http://a4"}},
+			{Name: "zone", Targets: []string{"http://b1", "http://b2"}},
+			{Name: "region", Targets: []string{"http://c1", "http://c2"}},
+		},
+	}, nil, nil, stats.NewRegistry(), logger.New(logger.INFO))
+	if err != nil {
+		t.Fatalf("newBalancer() error = %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	// setDown marks the first n targets of a pool down
+	setDown := func(pool, n int) {
+		for i, target := range b.pools[pool].list() {
+			target.down.Store(i < n)
+		}
+	}
+
+	// Test cases
+	tests := []struct {
+		name string
+		down [3]int
+		want []float64
+	}{
+		{name: "healthy", want: []float64{1, 0, 0}},
+		{name: "above threshold", down: [3]int{1, 0, 0}, want: []float64{1, 0, 0}},
+		{name: "spillover", down: [3]int{2, 0, 0}, want: []float64{0.5 / 0.7, 1 - 0.5/0.7, 0}},
+		{name: "next pool degraded", down: [3]int{2, 1, 0}, want: []float64{0.5 / 0.7, 1 - 0.5/0.7, 0}},
+		{name: "two pools down", down: [3]int{4, 2, 0}, want: []float64{0, 0, 1}},
+		{name: "scaled up", down: [3]int{4, 2, 1}, want: []float64{0, 0, 1}},
+		{name: "all degraded", down: [3]int{3, 2, 2}, want: []float64{1, 0, 0}},
+		{name: "all down", down: [3]int{4, 2, 2}, want: []float64{1, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for pool, n := range tt.down {
+				setDown(pool, n)
+			}
+			got := b.loads(now)
+			for i := range got {
+				if diff := got[i] - tt.want[i]; diff > 1e-9 || diff < -1e-9 {
+					t.Fatalf("loads() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGatewayFailover(t *testing.T) {
+	// Create a replica per zone, the primary of which can be made unhealthy
+	var unhealthy atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unhealthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secondary"))
+	}))
+	defer secondary.Close()
+
+	// Create a gateway failing over from the primary to the secondary zone
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{
+				"path": "/api",
+				"failover": {
+					"groups": [
+						{"name": "primary", "targets": [%q]},
+						{"name": "secondary", "targets": [%q]}
+					]
+				},
+				"methods": ["GET"],
+				"healthCheck": {"maxFailures": 1}
+			}
+		]
+	}`, primary.URL, secondary.URL))
+	defer gw.Stop()
+	handler := gw.Handler()
+
+	send := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api", nil))
+		return w.Body.String()
+	}
+
+	// Healthy primaries get all the traffic
+	for i := 0; i < 5; i++ {
+		if got := send(); got != "primary" {
+			t.Fatalf("response = %q, want primary", got)
+		}
+	}
+
+	// An ejected primary fails over to the secondary zone
+	unhealthy.Store(true)
+	send()
+	for i := 0; i < 5; i++ {
+		if got := send(); got != "secondary" {
+			t.Fatalf("response = %q, want secondary", got)
+		}
+	}
+	if got := gw.stats.Counter("failover_requests_total", "route", "/api", "group", "secondary").Value(); got < 5 {
+		t.Errorf("failover_requests_total{group=secondary} = %d, want at least 5", got)
+	}
+}
+
+func TestBalancerSetTargets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets")
+	if err := os.WriteFile(path, []byte("http://a\nhttp://b\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	b, err := newBalancer("/api", &config.FailoverConfig{
+		Groups: []config.FailoverGroupConfig{{Discovery: &config.DiscoveryConfig{Provider: "file", Path: path}}},
+	}, nil, nil, stats.NewRegistry(), logger.New(logger.ERROR))
+	if err != nil {
+		t.Fatalf("newBalancer() error = %v", err)
+	}
+	defer b.Close()
+
+	// The discovered targets are known before requests are served
+	targets := b.allTargets()
+	if len(targets) != 2 || targets[0].url.Host != "a" || targets[1].url.Host != "b" {
+		t.Fatalf("targets = %v, want a and b", targets)
+	}
+
+	// Remaining targets keep their health, invalid ones are ignored
+	targets[1].down.Store(true)
+	b.setTargets(b.pools[0], []string{"http://b", "http://c", "c:80"})
+	targets = b.allTargets()
+	if len(targets) != 2 || targets[0].url.Host != "b" || targets[1].url.Host != "c" {
+		t.Fatalf("targets = %v, want b and c", targets)
+	}
+	if targets[0].healthy(time.Now()) || !targets[1].healthy(time.Now()) {
+		t.Error("b healthy or c down after the update, want b down and c healthy")
+	}
+
+	// Without targets requests are rejected
+	b.setTargets(b.pools[0], nil)
+	w := httptest.NewRecorder()
+	b.serve(w, httptest.NewRequest("GET", "/api", nil), http.NotFoundHandler())
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestGatewayDiscovery(t *testing.T) {
+	newReplica := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	first := newReplica("first")
+	defer first.Close()
+	second := newReplica("second")
+	defer second.Close()
+
+	// Create a gateway whose targets are listed in a file
+	path := filepath.Join(t.TempDir(), "targets")
+	if err := os.WriteFile(path, []byte(first.URL+"\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/api", "discovery": {"provider": "file", "path": %q, "interval": 1}, "methods": ["GET"]}
+		]
+	}`, path))
+	defer gw.Stop()
+	handler := gw.Handler()
+
+	send := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api", nil))
+		return w.Body.String()
+	}
+	if got := send(); got != "first" {
+		t.Fatalf("response = %q, want first", got)
+	}
+
+	// A changed file moves the traffic without a restart
+	if err := os.WriteFile(path, []byte(second.URL+"\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for send() != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("requests not moved to the discovered target")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,268 @@
+package gateway
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+const (
+	// CanaryProgressing is the state of a canary being shifted traffic step by step
+	CanaryProgressing = "progressing"
+	// CanaryPromoted is the state of a canary that received all traffic
+	CanaryPromoted = "promoted"
+	// CanaryRolledBack is the state of a canary that lost all traffic
+	CanaryRolledBack = "rolled_back"
+
+	// maxCanaryDecisions is the number of decisions kept for the admin API
+	maxCanaryDecisions = 50
+)
+
+// canaryDecision represents an evaluation of a canary step
+type canaryDecision struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"` // "advance", "hold", "promote" or "rollback"
+	Weight int       `json:"weight"` // canary weight after the decision
+	Reason string    `json:"reason"`
+}
+
+// canaryStatus represents the state of a canary analysis
+type canaryStatus struct {
+	Canary         string           `json:"canary"`
+	Baseline       string           `json:"baseline"`
+	State          string           `json:"state"`
+	Step           int              `json:"step"`
+	Weight         int              `json:"weight"`
+	NextEvaluation *time.Time       `json:"nextEvaluation,omitempty"`
+	Decisions      []canaryDecision `json:"decisions"`
+}
+
+// groupSample represents the responses of a target group counted so far
+type groupSample struct {
+	requests     int64
+	errors       int64
+	microseconds int64
+}
+
+// canaryAnalysis represents the progressive promotion of a canary target group.
+// Steps are evaluated lazily by the requests of the route once their interval
+// has passed.
+type canaryAnalysis struct {
+	split                *trafficSplit
+	canary, baseline     *targetGroup
+	steps                []int
+	interval             time.Duration
+	minRequests          int64
+	maxErrorRateIncrease float64
+	maxLatencyRatio      float64
+	log                  *logger.Logger
+	now                  func() time.Time
+
+	next      atomic.Int64 // unix nanoseconds of the next evaluation, 0 when done
+	mu        sync.Mutex
+	state     string
+	step      int
+	start     [2]groupSample // canary and baseline samples at the start of the step
+	decisions []canaryDecision
+}
+
+// newCanaryAnalysis creates a canary analysis for a traffic split and sets the
+// weights of its first step
+func newCanaryAnalysis(split *trafficSplit, cfg *config.CanaryConfig, log *logger.Logger) (*canaryAnalysis, error) {
+	a := &canaryAnalysis{
+		split:                split,
+		canary:               split.group(cfg.Group),
+		steps:                cfg.Steps,
+		interval:             time.Duration(cfg.Interval) * time.Second,
+		minRequests:          int64(cfg.MinRequests),
+		maxErrorRateIncrease: cfg.MaxErrorRateIncrease,
+		maxLatencyRatio:      cfg.MaxLatencyRatio,
+		log:                  log,
+		now:                  time.Now,
+		state:                CanaryProgressing,
+	}
+	if a.canary == nil {
+		return nil, fmt.Errorf("unknown canary group: %q", cfg.Group)
+	}
+
+	if cfg.Baseline != "" {
+		a.baseline = split.group(cfg.Baseline)
+	} else if len(split.groups) == 2 {
+		a.baseline = split.groups[0]
+		if a.baseline == a.canary {
+			a.baseline = split.groups[1]
+		}
+	}
+	if a.baseline == nil || a.baseline == a.canary {
+		return nil, fmt.Errorf("invalid canary baseline group: %q", cfg.Baseline)
+	}
+
+	if len(a.steps) == 0 {
+		return nil, fmt.Errorf("no canary steps")
+	}
+	for i, weight := range a.steps {
+		if weight <= 0 || weight > 100 || (i > 0 && weight <= a.steps[i-1]) {
+			return nil, fmt.Errorf("canary steps must increase from above 0 to at most 100")
+		}
+	}
+	if a.interval <= 0 {
+		a.interval = time.Minute
+	}
+	if a.minRequests <= 0 {
+		a.minRequests = 50
+	}
+	if a.maxErrorRateIncrease <= 0 {
+		a.maxErrorRateIncrease = 0.01
+	}
+	if a.maxLatencyRatio <= 0 {
+		a.maxLatencyRatio = 1.5
+	}
+
+	a.setWeight(a.steps[0])
+	a.startStep()
+	return a, nil
+}
+
+// tick evaluates the current step if its interval has passed
+func (a *canaryAnalysis) tick() {
+	next := a.next.Load()
+	if next == 0 || a.now().UnixNano() < next {
+		return
+	}
+	if !a.mu.TryLock() {
+		return
+	}
+	defer a.mu.Unlock()
+	if a.state == CanaryProgressing && a.now().UnixNano() >= a.next.Load() {
+		a.evaluate()
+	}
+}
+
+// evaluate compares the canary to the baseline over the current step and
+// advances, holds, promotes or rolls back. a.mu has to be held.
+func (a *canaryAnalysis) evaluate() {
+	canary := a.sample(a.canary).since(a.start[0])
+	baseline := a.sample(a.baseline).since(a.start[1])
+
+	// Wait for enough canary traffic
+	if canary.requests < a.minRequests {
+		a.decide("hold", a.steps[a.step], fmt.Sprintf("%d of %d canary requests", canary.requests, a.minRequests))
+		a.next.Store(a.now().Add(a.interval).UnixNano())
+		return
+	}
+
+	// Roll back if the canary does worse than the baseline
+	canaryErrors, baselineErrors := canary.errorRate(), baseline.errorRate()
+	if canaryErrors > baselineErrors+a.maxErrorRateIncrease {
+		a.rollback(fmt.Sprintf("error rate %.4f above baseline %.4f", canaryErrors, baselineErrors))
+		return
+	}
+	if baseline.requests > 0 {
+		canaryLatency, baselineLatency := canary.meanLatency(), baseline.meanLatency()
+		if canaryLatency > time.Duration(float64(baselineLatency)*a.maxLatencyRatio) {
+			a.rollback(fmt.Sprintf("mean latency %s above baseline %s", canaryLatency, baselineLatency))
+			return
+		}
+	}
+
+	reason := fmt.Sprintf("error rate %.4f, baseline %.4f", canaryErrors, baselineErrors)
+	if a.step == len(a.steps)-1 {
+		a.state = CanaryPromoted
+		a.setWeight(100)
+		a.next.Store(0)
+		a.decide("promote", 100, reason)
+		return
+	}
+
+	a.step++
+	a.setWeight(a.steps[a.step])
+	a.startStep()
+	a.decide("advance", a.steps[a.step], reason)
+}
+
+// rollback sends all traffic back to the baseline. a.mu has to be held.
+func (a *canaryAnalysis) rollback(reason string) {
+	a.state = CanaryRolledBack
+	a.setWeight(0)
+	a.next.Store(0)
+	a.decide("rollback", 0, reason)
+}
+
+// decide records and logs a decision. a.mu has to be held.
+func (a *canaryAnalysis) decide(action string, weight int, reason string) {
+	a.log.Info("Canary %s of route %s: %s to weight %d (%s)", a.canary.name, a.split.route, action, weight, reason)
+	a.decisions = append(a.decisions, canaryDecision{Time: a.now(), Action: action, Weight: weight, Reason: reason})
+	if len(a.decisions) > maxCanaryDecisions {
+		a.decisions = a.decisions[len(a.decisions)-maxCanaryDecisions:]
+	}
+}
+
+// setWeight gives the canary a percentage of the traffic and the baseline the rest
+func (a *canaryAnalysis) setWeight(weight int) {
+	a.split.setWeights(map[string]int{a.canary.name: weight, a.baseline.name: 100 - weight})
+}
+
+// startStep starts the interval of the current step
+func (a *canaryAnalysis) startStep() {
+	a.start = [2]groupSample{a.sample(a.canary), a.sample(a.baseline)}
+	a.next.Store(a.now().Add(a.interval).UnixNano())
+}
+
+// sample returns the responses counted for a group
+func (a *canaryAnalysis) sample(group *targetGroup) groupSample {
+	return groupSample{
+		requests:     a.split.responses(group, false).Value() + a.split.responses(group, true).Value(),
+		errors:       a.split.responses(group, true).Value(),
+		microseconds: a.split.responseTime(group).Value(),
+	}
+}
+
+// status returns the state of the analysis
+func (a *canaryAnalysis) status() canaryStatus {
+	a.tick()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	status := canaryStatus{
+		Canary:    a.canary.name,
+		Baseline:  a.baseline.name,
+		State:     a.state,
+		Step:      a.step,
+		Weight:    a.split.currentWeights()[a.canary.name],
+		Decisions: append([]canaryDecision(nil), a.decisions...),
+	}
+	if next := a.next.Load(); next != 0 {
+		t := time.Unix(0, next)
+		status.NextEvaluation = &t
+	}
+	return status
+}
+
+// since returns the responses counted after an earlier sample
+func (s groupSample) since(earlier groupSample) groupSample {
+	return groupSample{
+		requests:     s.requests - earlier.requests,
+		errors:       s.errors - earlier.errors,
+		microseconds: s.microseconds - earlier.microseconds,
+	}
+}
+
+// errorRate returns the fraction of failed responses
+func (s groupSample) errorRate() float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	return float64(s.errors) / float64(s.requests)
+}
+
+// meanLatency returns the mean response time
+func (s groupSample) meanLatency() time.Duration {
+	if s.requests == 0 {
+		return 0
+	}
+	return time.Duration(s.microseconds/s.requests) * time.Microsecond
+}
@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+// newTestCanary creates a canary analysis of a stable and a canary group with a fake clock
+func newTestCanary(t *testing.T, cfg config.CanaryConfig) (*canaryAnalysis, *time.Time) {
+	t.Helper()
+
+	split, err := newTrafficSplit("/api", &config.SplitConfig{
+		Groups: []config.TargetGroupConfig{
+			{Name: "stable", Target: "http://stable", Weight: 100},
+			{Name: "canary", Target: "http://canary"},
+		},
+	}, stats.NewRegistry(), logger.New(logger.INFO))
+	if err != nil {
+		t.Fatalf("newTrafficSplit() error = %v", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	cfg.Group = "canary"
+	canary, err := newCanaryAnalysis(split, &cfg, logger.New(logger.INFO))
+	if err != nil {
+		t.Fatalf("newCanaryAnalysis() error = %v", err)
+	}
+	canary.now = func() time.Time { return now }
+	canary.startStep()
+	return canary, &now
+}
+
+func TestNewCanaryAnalysisErrors(t *testing.T) {
+	split, err := newTrafficSplit("/api", &config.SplitConfig{
+		Groups: []config.TargetGroupConfig{
+			{Name: "a", Target: "http://a", Weight: 1},
+			{Name: "b", Target: "http://b"},
+			{Name: "c", Target: "http://c"},
+		},
+	}, stats.NewRegistry(), logger.New(logger.INFO))
+	if err != nil {
+		t.Fatalf("newTrafficSplit() error = %v", err)
+	}
+
+	for _, cfg := range []*config.CanaryConfig{
+		{Group: "d", Baseline: "a", Steps: []int{10}},
+		{Group: "b", Steps: []int{10}},
+		{Group: "b", Baseline: "b", Steps: []int{10}},
+		{Group: "b", Baseline: "a"},
+		{Group: "b", Baseline: "a", Steps: []int{10, 10}},
+		{Group: "b", Baseline: "a", Steps: []int{50, 150}},
+	} {
+		if _, err := newCanaryAnalysis(split, cfg, logger.New(logger.INFO)); err == nil {
+			t.Errorf("newCanaryAnalysis(%+v) error = nil, want error", cfg)
+		}
+	}
+}
+
+func TestCanaryAnalysis(t *testing.T) {
+	// respond records responses of a group
+	respond := func(a *canaryAnalysis, name string, ok, failed int64, latency time.Duration) {
+		group := a.split.group(name)
+		a.split.responses(group, false).Add(ok)
+		a.split.responses(group, true).Add(failed)
+		a.split.responseTime(group).Add((ok + failed) * latency.Microseconds())
+	}
+
+	// Test cases
+	tests := []struct {
+		name        string
+		canaryOK    int64
+		canaryFail  int64
+		latency     time.Duration
+		wantState   string
+		wantWeights []int
+	}{
+		{name: "promotion", canaryOK: 100, latency: 10 * time.Millisecond, wantState: CanaryPromoted, wantWeights: []int{25, 50, 100}},
+		{name: "rollback on errors", canaryOK: 90, canaryFail: 10, latency: 10 * time.Millisecond, wantState: CanaryRolledBack, wantWeights: []int{0, 0, 0}},
+		{name: "rollback on latency", canaryOK: 100, latency: 50 * time.Millisecond, wantState: CanaryRolledBack, wantWeights: []int{0, 0, 0}},
+		{name: "hold on low traffic", canaryOK: 10, latency: 10 * time.Millisecond, wantState: CanaryProgressing, wantWeights: []int{10, 10, 10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, now := newTestCanary(t, config.CanaryConfig{Steps: []int{10, 25, 50}, Interval: 60, MinRequests: 50})
+			if got := a.split.currentWeights()["canary"]; got != 10 {
+				t.Fatalf("initial canary weight = %d, want 10", got)
+			}
+
+			for i, want := range tt.wantWeights {
+				// Nothing happens before the interval has passed
+				respond(a, "stable", 1000, 5, 10*time.Millisecond)
+				respond(a, "canary", tt.canaryOK, tt.canaryFail, tt.latency)
+				*now = now.Add(30 * time.Second)
+				a.tick()
+				*now = now.Add(30 * time.Second)
+				a.tick()
+
+				if got := a.split.currentWeights()["canary"]; got != want {
+					t.Fatalf("canary weight after step %d = %d, want %d", i, got, want)
+				}
+				if got := a.split.currentWeights()["stable"]; got != 100-want {
+					t.Fatalf("stable weight after step %d = %d, want %d", i, got, 100-want)
+				}
+			}
+
+			status := a.status()
+			if status.State != tt.wantState {
+				t.Errorf("state = %s, want %s", status.State, tt.wantState)
+			}
+			if len(status.Decisions) == 0 {
+				t.Error("no decisions recorded")
+			}
+		})
+	}
+}
+
+func TestGatewayCanaryAdmin(t *testing.T) {
+	// Create a test server
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// Create a gateway with a canary analysis
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{
+				"path": "/api/users",
+				"methods": ["GET"],
+				"split": {
+					"groups": [
+						{"name": "stable", "target": %[1]q, "weight": 100},
+						{"name": "canary", "target": %[1]q}
+					],
+					"canary": {"group": "canary", "steps": [5, 50]}
+				}
+			}
+		],
+		"admin": {"apiKey": "admin-secret"}
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	// Serve some requests
+	for i := 0; i < 20; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users", nil))
+	}
+
+	// Check the status of the analysis
+	req := httptest.NewRequest("GET", "/_admin/canaries", nil)
+	req.Header.Set(AdminKeyHeader, "admin-secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var body struct {
+		Canaries map[string]canaryStatus `json:"canaries"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode response %q: %v", w.Body.String(), err)
+	}
+	status, ok := body.Canaries["/api/users"]
+	if !ok || status.State != CanaryProgressing || status.Weight != 5 || status.Baseline != "stable" || status.NextEvaluation == nil {
+		t.Errorf("canary status = %+v, want progressing at weight 5 against stable", status)
+	}
+
+	// Check that the weights cannot be changed by hand
+	req = httptest.NewRequest("PUT", "/_admin/weights?route=/api/users", strings.NewReader(`{"weights": {"canary": 100}}`))
+	req.Header.Set(AdminKeyHeader, "admin-secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("status code = %v, want %v", w.Code, http.StatusConflict)
+	}
+
+	// Check the responses counted per group
+	var requests int64
+	for _, metric := range gw.stats.Snapshot() {
+		if metric.Name == "split_responses_total" && metric.Labels["result"] == "ok" {
+			requests += int64(metric.Value)
+		}
+	}
+	if requests != 20 {
+		t.Errorf("responses counted = %d, want 20", requests)
+	}
+}
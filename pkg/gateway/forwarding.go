@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/middleware"
+)
+
+const (
+	// XForwardedProtoHeader is the header carrying the original request scheme
+	XForwardedProtoHeader = "X-Forwarded-Proto"
+	// XForwardedHostHeader is the header carrying the original Host header
+	XForwardedHostHeader = "X-Forwarded-Host"
+	// XForwardedPrefixHeader is the header carrying the path prefix stripped by the gateway
+	XForwardedPrefixHeader = "X-Forwarded-Prefix"
+	// ViaHeader is the header listing the proxies a request passed through
+	ViaHeader = "Via"
+	// viaPseudonym is the name the gateway uses for itself in the Via header
+	viaPseudonym = "goteway"
+)
+
+// setForwardingHeaders sets the forwarding headers on an outgoing proxy request.
+// Headers received from the client are only extended when the peer is a trusted
+// proxy, otherwise they are replaced.
+func (g *Gateway) setForwardingHeaders(pr *httputil.ProxyRequest, routeConfig *config.Route, prefix string) {
+	in := pr.In
+	out := pr.Out
+	trusted := g.clientIP.TrustedPeer(in)
+
+	peer, _, err := net.SplitHostPort(in.RemoteAddr)
+	if err != nil {
+		peer = in.RemoteAddr
+	}
+
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+
+	// X-Forwarded-For lists every hop, the connected peer last
+	forwardedFor := peer
+	if prior := strings.Join(in.Header.Values(middleware.XForwardedForHeader), ", "); trusted && prior != "" {
+		forwardedFor = prior + ", " + peer
+	}
+	out.Header.Set(middleware.XForwardedForHeader, forwardedFor)
+
+	// X-Forwarded-Proto and X-Forwarded-Host describe the request as the client sent it
+	forwardedProto := proto
+	forwardedHost := in.Host
+	if trusted {
+		if prior := in.Header.Get(XForwardedProtoHeader); prior != "" {
+			forwardedProto = prior
+		}
+		if prior := in.Header.Get(XForwardedHostHeader); prior != "" {
+			forwardedHost = prior
+		}
+	}
+	out.Header.Set(XForwardedProtoHeader, forwardedProto)
+	out.Header.Set(XForwardedHostHeader, forwardedHost)
+
+	// X-Forwarded-Prefix is the path the gateway stripped, below any upstream proxy prefix
+	forwardedPrefix := strings.TrimSuffix(prefix, "/")
+	if prior := in.Header.Get(XForwardedPrefixHeader); trusted && prior != "" {
+		forwardedPrefix = strings.TrimSuffix(prior, "/") + forwardedPrefix
+	}
+	if forwardedPrefix != "" {
+		out.Header.Set(XForwardedPrefixHeader, forwardedPrefix)
+	}
+
+	// RFC 7239 Forwarded
+	if routeConfig.Forwarded {
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peer), quoteForwarded(in.Host), proto)
+		if prior := strings.Join(in.Header.Values(middleware.ForwardedHeader), ", "); trusted && prior != "" {
+			element = prior + ", " + element
+		}
+		out.Header.Set(middleware.ForwardedHeader, element)
+	}
+
+	// Via is extended regardless of trust, it describes the path, not the client
+	if routeConfig.Via {
+		via := fmt.Sprintf("%d.%d %s", in.ProtoMajor, in.ProtoMinor, viaPseudonym)
+		if prior := strings.Join(in.Header.Values(ViaHeader), ", "); prior != "" {
+			via = prior + ", " + via
+		}
+		out.Header.Set(ViaHeader, via)
+	}
+}
+
+// forwardedNode formats an address as an RFC 7239 node, quoting IPv6 addresses
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// quoteForwarded quotes an RFC 7239 value if it is not a plain token
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+		}
+	}
+	return value
+}
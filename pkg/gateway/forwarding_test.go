@@ -0,0 +1,183 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardingHeaders(t *testing.T) {
+	// Create a test server that records the received headers
+	var received http.Header
+	var receivedHost string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		receivedHost = r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// Create a gateway
+	gw := newTestGateway(t, `{
+		"server": {
+			"trustedProxies": ["10.0.0.0/8"]
+		},
+		"routes": [
+			{
+				"path": "/api",
+				"target": "`+ts.URL+`",
+				"methods": ["GET"],
+				"middlewares": []
+			},
+			{
+				"path": "/full",
+				"target": "`+ts.URL+`",
+				"methods": ["GET"],
+				"middlewares": [],
+				"preserveHost": true,
+				"forwarded": true,
+				"via": true
+			},
+			{"path": "/keep", "target": "`+ts.URL+`", "methods": ["GET"], "rewrite": {"keepPrefix": true}},
+			{"path": "/replace", "target": "`+ts.URL+`", "methods": ["GET"], "rewrite": {"replacePrefix": "/v2"}},
+			{"path": "/regex", "target": "`+ts.URL+`", "methods": ["GET"], "rewrite": {"regex": "^/regex/(.*)$", "replacement": "/v2/$1"}},
+			{"path": "/template", "target": "`+ts.URL+`", "methods": ["GET"], "rewrite": {"template": "/v2/items"}}
+		]
+	}`)
+	handler := gw.Handler()
+
+	// Test cases
+	tests := []struct {
+		name        string
+		path        string
+		remoteAddr  string
+		setHeaders  map[string]string
+		wantHeaders map[string]string
+		wantHost    string
+	}{
+		{
+			name:       "direct client",
+			path:       "/api",
+			remoteAddr: "203.0.113.7:1234",
+			setHeaders: map[string]string{"X-Forwarded-For": "6.6.6.6", "X-Forwarded-Host": "evil.example"},
+			wantHeaders: map[string]string{
+				"X-Forwarded-For":    "203.0.113.7",
+				"X-Forwarded-Proto":  "http",
+				"X-Forwarded-Host":   "gateway.example",
+				"X-Forwarded-Prefix": "/api",
+				"Forwarded":          "",
+				"Via":                "",
+			},
+			wantHost: ts.Listener.Addr().String(),
+		},
+		{
+			name:       "behind trusted proxy",
+			path:       "/api",
+			remoteAddr: "10.0.0.2:1234",
+			setHeaders: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example",
+			},
+			wantHeaders: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7, 10.0.0.2",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example",
+			},
+			wantHost: ts.Listener.Addr().String(),
+		},
+		{
+			name:       "forwarded, via and preserved host",
+			path:       "/full",
+			remoteAddr: "203.0.113.7:1234",
+			setHeaders: map[string]string{"Via": "1.1 cdn"},
+			wantHeaders: map[string]string{
+				"Forwarded":          "for=203.0.113.7;host=gateway.example;proto=http",
+				"Via":                "1.1 cdn, 1.1 goteway",
+				"X-Forwarded-Prefix": "/full",
+			},
+			wantHost: "gateway.example",
+		},
+		{
+			name:        "kept prefix",
+			path:        "/keep/items",
+			remoteAddr:  "203.0.113.7:1234",
+			wantHeaders: map[string]string{"X-Forwarded-Prefix": ""},
+			wantHost:    ts.Listener.Addr().String(),
+		},
+		{
+			name:        "replaced prefix",
+			path:        "/replace/items",
+			remoteAddr:  "203.0.113.7:1234",
+			wantHeaders: map[string]string{"X-Forwarded-Prefix": ""},
+			wantHost:    ts.Listener.Addr().String(),
+		},
+		{
+			name:        "regex rewrite",
+			path:        "/regex/items",
+			remoteAddr:  "203.0.113.7:1234",
+			wantHeaders: map[string]string{"X-Forwarded-Prefix": ""},
+			wantHost:    ts.Listener.Addr().String(),
+		},
+		{
+			name:        "template rewrite",
+			path:        "/template/items",
+			remoteAddr:  "203.0.113.7:1234",
+			wantHeaders: map[string]string{"X-Forwarded-Prefix": ""},
+			wantHost:    ts.Listener.Addr().String(),
+		},
+		{
+			name:        "stripped prefix below a trusted proxy prefix",
+			path:        "/api/items",
+			remoteAddr:  "10.0.0.2:1234",
+			setHeaders:  map[string]string{"X-Forwarded-Prefix": "/edge/"},
+			wantHeaders: map[string]string{"X-Forwarded-Prefix": "/edge/api"},
+			wantHost:    ts.Listener.Addr().String(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a request
+			req := httptest.NewRequest("GET", "http://gateway.example"+tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.setHeaders {
+				req.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+
+			// Call the handler
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Status code = %v, want %v", w.Code, http.StatusOK)
+			}
+
+			// Check the forwarded headers
+			for key, want := range tt.wantHeaders {
+				if got := received.Get(key); got != want {
+					t.Errorf("Header %q = %q, want %q", key, got, want)
+				}
+			}
+			if receivedHost != tt.wantHost {
+				t.Errorf("Host = %q, want %q", receivedHost, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestForwardedNode(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "192.0.2.60", want: "192.0.2.60"},
+		{ip: "2001:db8:cafe::17", want: `"[2001:db8:cafe::17]"`},
+	}
+
+	for _, tt := range tests {
+		if got := forwardedNode(tt.ip); got != tt.want {
+			t.Errorf("forwardedNode(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
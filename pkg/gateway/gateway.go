@@ -2,6 +2,7 @@ package gateway
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -12,22 +13,41 @@ import (
 	"github.com/mstgnz/goteway/pkg/logger"
 	"github.com/mstgnz/goteway/pkg/middleware"
 	"github.com/mstgnz/goteway/pkg/plugin"
+	"github.com/mstgnz/goteway/pkg/stats"
 )
 
 // Gateway represents an API gateway
 type Gateway struct {
 	config        *config.Config
+	configPath    string
 	log           *logger.Logger
 	pluginManager *plugin.Manager
 	server        *http.Server
 	routes        map[string]*Route
+	ipFilter      *middleware.IPFilter
+	clientIP      *middleware.ClientIPResolver
+	store         middleware.RateLimitStore
+	quotaStore    *middleware.QuotaStore
+	limiters      map[string]middleware.Limiter
+	bulkheads     map[string]*middleware.Bulkhead
+	upstreams     map[string]*middleware.Bulkhead // by target URL
+	consumers     *middleware.ConsumerRegistry
+	stats         *stats.Registry
+	shedder       *middleware.LoadShedder
 }
 
 // Route represents a route
 type Route struct {
+	Name        string
 	Path        string
 	Target      *url.URL
 	Methods     map[string]bool
+	pattern     *pathPattern
+	Hosts       []string          // exact or wildcard hosts, any host if empty
+	Headers     map[string]string // required header values, "*" for any value
+	Query       map[string]string // required query parameter values, "*" for any value
+	split       *trafficSplit     // weighted target groups, the target if nil
+	balancer    *balancer         // replicas replacing the target, if configured
 	Middlewares []middleware.Middleware
 	Handler     http.Handler
 }
@@ -53,9 +73,14 @@ func New(configPath string, logLevel logger.LogLevel) (*Gateway, error) {
 	// Create a gateway
 	g := &Gateway{
 		config:        cfg,
+		configPath:    configPath,
 		log:           log,
 		pluginManager: pluginManager,
 		routes:        make(map[string]*Route),
+		limiters:      make(map[string]middleware.Limiter),
+		bulkheads:     make(map[string]*middleware.Bulkhead),
+		upstreams:     make(map[string]*middleware.Bulkhead),
+		stats:         stats.NewRegistry(),
 	}
 
 	// Initialize the gateway
@@ -67,7 +92,120 @@ func New(configPath string, logLevel logger.LogLevel) (*Gateway, error) {
 }
 
 // initialize initializes the gateway
-func (g *Gateway) initialize() error {
+func (g *Gateway) initialize() (err error) {
+	// Stop the health checks and discovery of the balancers built before an error
+	var balancers []*balancer
+	defer func() {
+		if err != nil {
+			for _, b := range balancers {
+				b.Close()
+			}
+		}
+	}()
+
+	// The admin API changes quotas and traffic weights, so it needs a key
+	if g.config.Admin != nil && g.config.Admin.APIKey == "" {
+		return fmt.Errorf("admin API requires an apiKey")
+	}
+
+	// Initialize the client IP resolver
+	resolver, err := middleware.NewClientIPResolver(g.config.Server.TrustedProxies, g.config.Server.ClientIPHeaders)
+	if err != nil {
+		return fmt.Errorf("failed to create client IP resolver: %w", err)
+	}
+	g.clientIP = resolver
+
+	// Initialize the shared rate limit store
+	if storeConfig := g.config.RateLimitStore; storeConfig != nil {
+		switch storeConfig.Type {
+		case "memory":
+			g.store = middleware.NewMemoryStore()
+		case "redis":
+			prefix := storeConfig.Prefix
+			if prefix == "" {
+				prefix = "goteway:ratelimit:"
+			}
+			g.store = middleware.NewRedisStore(
+				storeConfig.Address,
+				storeConfig.Password,
+				storeConfig.DB,
+				prefix,
+				time.Duration(storeConfig.Timeout)*time.Millisecond,
+				storeConfig.PoolSize,
+			)
+		default:
+			return fmt.Errorf("unknown rate limit store type: %s", storeConfig.Type)
+		}
+	}
+
+	// Initialize the quota store
+	if storeConfig := g.config.QuotaStore; storeConfig != nil {
+		store, err := middleware.NewQuotaStore(storeConfig.Path, time.Duration(storeConfig.FlushInterval)*time.Second, g.log)
+		if err != nil {
+			return fmt.Errorf("failed to create quota store: %w", err)
+		}
+		g.quotaStore = store
+	}
+
+	// Initialize the consumers
+	if len(g.config.Consumers) > 0 {
+		g.consumers = middleware.NewConsumerRegistry()
+		for _, consumerConfig := range g.config.Consumers {
+			if _, ok := g.config.Plans[consumerConfig.Plan]; consumerConfig.Plan != "" && !ok {
+				return fmt.Errorf("unknown plan %s of consumer %s", consumerConfig.Plan, consumerConfig.ID)
+			}
+			consumer := &middleware.Consumer{ID: consumerConfig.ID, Plan: consumerConfig.Plan}
+			credentials := middleware.ConsumerCredentials{
+				APIKeys:     consumerConfig.APIKeys,
+				BasicUsers:  consumerConfig.BasicAuth,
+				JWTSubjects: consumerConfig.JWTSubjects,
+			}
+			if err := g.consumers.Add(consumer, credentials); err != nil {
+				return fmt.Errorf("failed to add consumer: %w", err)
+			}
+		}
+	}
+
+	// Initialize the load shedder
+	if sheddingConfig := g.config.LoadShedding; sheddingConfig != nil {
+		planPriorities := make(map[string]middleware.Priority)
+		for name, plan := range g.config.Plans {
+			if plan.Priority == "" {
+				continue
+			}
+			priority, err := middleware.ParsePriority(plan.Priority)
+			if err != nil {
+				return fmt.Errorf("invalid priority of plan %s: %w", name, err)
+			}
+			planPriorities[name] = priority
+		}
+		shedder, err := middleware.NewLoadShedder(middleware.LoadShedderConfig{
+			MaxInFlight:     sheddingConfig.MaxInFlight,
+			MaxQueueLatency: time.Duration(sheddingConfig.MaxQueueLatency) * time.Millisecond,
+			MaxCPU:          sheddingConfig.MaxCPU,
+			PriorityHeader:  sheddingConfig.PriorityHeader,
+			TrustHeader:     g.clientIP.TrustedPeer,
+			PlanPriorities:  planPriorities,
+			RetryAfter:      time.Duration(sheddingConfig.RetryAfter) * time.Second,
+		}, g.stats)
+		if err != nil {
+			return fmt.Errorf("failed to create load shedder: %w", err)
+		}
+		g.shedder = shedder
+	}
+
+	// Initialize the concurrency limits shared by the routes forwarding to an upstream
+	for target, upstream := range g.config.Upstreams {
+		if upstream.Concurrency == nil {
+			continue
+		}
+		bulkhead, err := g.newBulkhead("upstream:"+target, upstream.Concurrency)
+		if err != nil {
+			return fmt.Errorf("failed to create concurrency limit for upstream %s: %w", target, err)
+		}
+		g.upstreams[strings.TrimSuffix(target, "/")] = bulkhead
+	}
+
 	// Initialize routes
 	for _, routeConfig := range g.config.Routes {
 		// Parse the target URL
@@ -78,18 +216,156 @@ func (g *Gateway) initialize() error {
 
 		// Create a route
 		route := &Route{
+			Name:    routeConfig.Name,
 			Path:    routeConfig.Path,
 			Target:  targetURL,
 			Methods: make(map[string]bool),
 		}
+		if route.Name == "" {
+			route.Name = route.Path
+		}
+		if route.pattern, err = parsePathPattern(route.Path); err != nil {
+			return fmt.Errorf("invalid path of route %s: %w", route.Name, err)
+		}
+		if _, ok := g.routes[route.Name]; ok {
+			return fmt.Errorf("duplicate route: %s", route.Name)
+		}
+		if match := routeConfig.Match; match != nil {
+			route.Hosts = match.Hosts
+			route.Headers = match.Headers
+			route.Query = match.Query
+		}
+
+		// Split the traffic over target groups
+		if routeConfig.Split != nil {
+			if route.split, err = newTrafficSplit(route.Name, routeConfig.Split, g.stats, g.log); err != nil {
+				return fmt.Errorf("invalid split of route %s: %w", route.Name, err)
+			}
+		}
+
+		// Balance the traffic over the targets
+		failover := routeConfig.Failover
+		if len(routeConfig.Targets) > 0 || routeConfig.Discovery != nil {
+			if failover != nil {
+				return fmt.Errorf("route %s cannot have both targets and failover groups", route.Name)
+			}
+			failover = &config.FailoverConfig{Groups: []config.FailoverGroupConfig{{
+				Name:      "default",
+				Targets:   routeConfig.Targets,
+				Discovery: routeConfig.Discovery,
+			}}}
+		}
+		if failover != nil {
+			if route.split != nil {
+				return fmt.Errorf("route %s cannot have both targets and a split", route.Name)
+			}
+			route.balancer, err = newBalancer(route.Name, failover, routeConfig.HealthCheck, routeConfig.SessionAffinity, g.stats, g.log)
+			if err != nil {
+				return fmt.Errorf("invalid targets of route %s: %w", route.Name, err)
+			}
+			balancers = append(balancers, route.balancer)
+		}
 
 		// Add allowed methods
 		for _, method := range routeConfig.Methods {
 			route.Methods[method] = true
 		}
 
+		// Create a path rewriter
+		rewriter, err := newPathRewriter(routeConfig.Rewrite, route.pattern.tail)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite of route %s: %w", route.Name, err)
+		}
+
+		// Create the header transformations
+		var requestHeaders, responseHeaders []*headerRules
+		if routeConfig.Headers != nil {
+			if requestHeaders, err = newHeaderRules(routeConfig.Headers.Request, false); err != nil {
+				return fmt.Errorf("invalid request headers of route %s: %w", route.Name, err)
+			}
+			if responseHeaders, err = newHeaderRules(routeConfig.Headers.Response, true); err != nil {
+				return fmt.Errorf("invalid response headers of route %s: %w", route.Name, err)
+			}
+		}
+		needsRequestID := usesRequestID(requestHeaders, responseHeaders)
+
+		// Create the body transformations
+		var requestTransform, responseTransform *bodyTransform
+		if cfg := routeConfig.Transform; cfg != nil {
+			if requestTransform, err = newBodyTransform(cfg.Request, cfg.MaxBodySize); err != nil {
+				return fmt.Errorf("invalid request transform of route %s: %w", route.Name, err)
+			}
+			if responseTransform, err = newBodyTransform(cfg.Response, cfg.MaxBodySize); err != nil {
+				return fmt.Errorf("invalid response transform of route %s: %w", route.Name, err)
+			}
+		}
+
+		// Create a mirror
+		var mirror *mirror
+		if routeConfig.Mirror != nil {
+			if mirror, err = newMirror(route.Name, routeConfig.Mirror, g.stats, g.log); err != nil {
+				return fmt.Errorf("invalid mirror of route %s: %w", route.Name, err)
+			}
+			mirror.requestHeaders = requestHeaders
+		}
+
+		// Create an aggregator for aggregation routes
+		var aggregate *aggregator
+		if routeConfig.Aggregate != nil {
+			if aggregate, err = newAggregator(routeConfig.Aggregate, route.pattern.tail, g.log); err != nil {
+				return fmt.Errorf("invalid aggregation of route %s: %w", route.Name, err)
+			}
+			aggregate.requestHeaders = requestHeaders
+			aggregate.responseHeaders = responseHeaders
+			aggregate.transform = responseTransform
+			aggregate.stats = g.stats
+			for _, backend := range aggregate.backends {
+				backend.bulkhead = g.upstreamBulkhead(backend.target)
+			}
+		}
+
 		// Create a reverse proxy
-		proxy := httputil.NewSingleHostReverseProxy(targetURL)
+		proxy := &httputil.ReverseProxy{
+			Transport: middleware.UpstreamTransport(nil),
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				target := requestTarget(pr.In, targetURL)
+				pr.SetURL(target)
+				rewriter.rewriteQuery(pr.Out.URL, target, pr.In)
+				if routeConfig.PreserveHost {
+					pr.Out.Host = pr.In.Host
+				}
+				g.setForwardingHeaders(pr, &routeConfig, matchedPrefix(pr.In))
+				if responseTransform != nil {
+					// Let the transport negotiate and decode the compression, so
+					// the response reaches the transform as plain JSON
+					pr.Out.Header.Del("Accept-Encoding")
+				}
+				applyHeaderRules(requestHeaders, pr.Out.Header, pr.In, 0)
+			},
+		}
+		if len(responseHeaders) > 0 || responseTransform != nil {
+			proxy.ModifyResponse = func(resp *http.Response) error {
+				if responseTransform != nil {
+					if err := responseTransform.transformResponse(resp); err != nil {
+						return err
+					}
+				}
+				applyHeaderRules(responseHeaders, resp.Header, resp.Request, resp.StatusCode)
+				return nil
+			}
+		}
+
+		// Limit the requests in flight to the upstream chosen for a request
+		var forward http.Handler = proxy
+		if len(g.upstreams) > 0 {
+			forward = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if bulkhead := g.upstreamBulkhead(requestTarget(r, targetURL)); bulkhead != nil {
+					middleware.BulkheadMiddleware(g.stats, g.log, bulkhead)(proxy).ServeHTTP(w, r)
+					return
+				}
+				proxy.ServeHTTP(w, r)
+			})
+		}
 
 		// Create a handler
 		var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -100,26 +376,99 @@ func (g *Gateway) initialize() error {
 				return
 			}
 
-			// Modify the request URL
-			r.URL.Host = targetURL.Host
-			r.URL.Scheme = targetURL.Scheme
-			r.Host = targetURL.Host
+			// Rewrite the path, stripping the matched prefix by default
+			if prefix, params, ok := route.pattern.match(r.URL.EscapedPath()); ok {
+				if middleware.PathParams(r) == nil && params != nil {
+					r = middleware.WithPathParams(r, params)
+				}
+				if rewriter.stripsPrefix() {
+					r = withMatchedPrefix(r, prefix)
+				}
+				path, err := rewriter.rewritePath(r, prefix)
+				if err != nil {
+					g.log.Warn("Rejected path %s: %v", r.URL.Path, err)
+					middleware.WriteError(w, http.StatusBadRequest, "bad_request", "Invalid path parameter")
+					return
+				}
+				setEscapedPath(r.URL, path)
+			}
 
-			// Remove the route path prefix
-			if strings.HasPrefix(r.URL.Path, route.Path) {
-				r.URL.Path = strings.TrimPrefix(r.URL.Path, route.Path)
-				if r.URL.Path == "" {
-					r.URL.Path = "/"
+			if needsRequestID {
+				ensureRequestID(r)
+			}
+			if aggregate != nil {
+				aggregate.ServeHTTP(w, r)
+				return
+			}
+			if requestTransform != nil {
+				if err := requestTransform.transformRequest(r); err != nil {
+					g.log.Warn("Failed to read request body: %v", err)
+					middleware.WriteError(w, http.StatusBadRequest, "bad_request", "Failed to read request body")
+					return
 				}
 			}
 
+			// Send a copy of the request to the mirror
+			if mirror != nil {
+				mirror.send(r)
+			}
+
+			// Proxy the request to one of the targets
+			if route.balancer != nil {
+				g.log.Debug("Proxying request: %s %s -> %s", r.Method, r.URL.Path, route.Name)
+				route.balancer.serve(w, r, forward)
+				return
+			}
+
+			// Proxy the request to a target group
+			if route.split != nil {
+				g.log.Debug("Proxying request: %s %s -> %s", r.Method, r.URL.Path, route.Name)
+				route.split.serve(w, r, forward)
+				return
+			}
+
 			// Log the proxy request
 			g.log.Debug("Proxying request: %s %s -> %s", r.Method, r.URL.Path, targetURL)
 
 			// Proxy the request
-			proxy.ServeHTTP(w, r)
+			forward.ServeHTTP(w, r)
 		})
 
+		// Adapt the requests in flight to the upstream latency
+		if cfg := routeConfig.AdaptiveLimit; cfg != nil {
+			limiter, err := middleware.NewAdaptiveLimiter(middleware.AdaptiveLimiterConfig{
+				Algorithm:        cfg.Algorithm,
+				InitialLimit:     cfg.InitialLimit,
+				MinLimit:         cfg.MinLimit,
+				MaxLimit:         cfg.MaxLimit,
+				LatencyThreshold: time.Duration(cfg.LatencyThreshold) * time.Millisecond,
+				BackoffRatio:     cfg.BackoffRatio,
+				Tolerance:        cfg.Tolerance,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create adaptive limit for route %s: %w", routeConfig.Path, err)
+			}
+			handler = middleware.AdaptiveConcurrencyMiddleware(limiter, route.Name, g.stats, g.log)(handler)
+		}
+
+		// Limit the requests in flight to the route
+		if routeConfig.Concurrency != nil {
+			bulkhead, err := g.newBulkhead("route:"+route.Name, routeConfig.Concurrency)
+			if err != nil {
+				return fmt.Errorf("failed to create concurrency limit for route %s: %w", routeConfig.Path, err)
+			}
+			handler = middleware.BulkheadMiddleware(g.stats, g.log, bulkhead)(handler)
+		}
+
+		// Shed the route's requests by priority when the gateway is overloaded
+		priority, err := middleware.ParsePriority(routeConfig.Priority)
+		if err != nil {
+			return fmt.Errorf("invalid priority of route %s: %w", routeConfig.Path, err)
+		}
+		if g.shedder != nil {
+			handler = g.shedder.Middleware(priority, g.log)(handler)
+		}
+
 		// Add middlewares
 		for _, middlewareName := range routeConfig.Middlewares {
 			// Check if the middleware is a plugin
@@ -133,14 +482,55 @@ func (g *Gateway) initialize() error {
 			case "logging":
 				handler = middleware.LoggingMiddleware(g.log)(handler)
 			case "ratelimit":
+				var policies []middleware.RateLimitPolicy
+				var rateLimits []config.RateLimitConfig
 				if routeConfig.RateLimit != nil {
-					limiter := middleware.NewRateLimiter(
-						routeConfig.RateLimit.Limit,
-						time.Duration(routeConfig.RateLimit.Window)*time.Second,
-						g.log,
-					)
-					handler = middleware.RateLimitMiddleware(limiter)(handler)
+					rateLimits = append(rateLimits, *routeConfig.RateLimit)
+				}
+				rateLimits = append(rateLimits, routeConfig.RateLimits...)
+				for i, rateLimit := range rateLimits {
+					policy, err := g.newRateLimitPolicy(route.Name, fmt.Sprintf("%s#%d", route.Name, i), rateLimit)
+					if err != nil {
+						return fmt.Errorf("failed to create rate limiter for route %s: %w", routeConfig.Path, err)
+					}
+					policies = append(policies, policy)
+				}
+				switch routeConfig.RateLimitHeaders {
+				case "", middleware.HeadersXRateLimit, middleware.HeadersIETF, middleware.HeadersNone:
+				default:
+					return fmt.Errorf("unknown rate limit headers for route %s: %s", routeConfig.Path, routeConfig.RateLimitHeaders)
+				}
+				if len(policies) > 0 {
+					handler = middleware.RateLimitPoliciesMiddleware(routeConfig.RateLimitHeaders, policies...)(handler)
+				}
+			case "quota":
+				var policies []middleware.QuotaPolicy
+				for i, quota := range routeConfig.Quotas {
+					policy, err := g.newQuotaPolicy(route.Name, fmt.Sprintf("%s#%d", route.Name, i), quota)
+					if err != nil {
+						return fmt.Errorf("failed to create quota for route %s: %w", routeConfig.Path, err)
+					}
+					policies = append(policies, policy)
+				}
+				if len(policies) > 0 {
+					handler = middleware.QuotaMiddleware(g.getQuotaStore(), g.log, policies...)(handler)
+				}
+			case "consumer":
+				if g.consumers == nil {
+					return fmt.Errorf("consumer middleware of route %s requires consumers", routeConfig.Path)
+				}
+				plans, err := g.newPlans(route.Name)
+				if err != nil {
+					return err
 				}
+				handler = middleware.ConsumerMiddleware(
+					g.consumers,
+					plans,
+					routeConfig.Path,
+					routeConfig.RateLimitHeaders,
+					g.getQuotaStore(),
+					g.log,
+				)(handler)
 			case "auth":
 				if routeConfig.Auth != nil {
 					var authenticator middleware.Authenticator
@@ -157,12 +547,42 @@ func (g *Gateway) initialize() error {
 							routeConfig.Auth.Config["key"],
 							g.log,
 						)
+					case "jwt":
+						// An empty HMAC key would let anyone sign tokens
+						if routeConfig.Auth.Config["secret"] == "" {
+							return fmt.Errorf("JWT secret is required for route %s", routeConfig.Path)
+						}
+						authenticator = middleware.NewJWTAuthenticator(
+							routeConfig.Auth.Config["secret"],
+							g.log,
+						)
 					default:
 						g.log.Warn("Unsupported auth type: %s", routeConfig.Auth.Type)
 						continue
 					}
 					handler = middleware.AuthMiddleware(authenticator, g.log)(handler)
 				}
+			case "signedurl":
+				if routeConfig.SignedURL != nil {
+					if routeConfig.SignedURL.Secret == "" {
+						return fmt.Errorf("signed URL secret is required for route %s", routeConfig.Path)
+					}
+					signer := middleware.NewURLSigner(
+						routeConfig.SignedURL.Secret,
+						routeConfig.SignedURL.BindIP,
+						routeConfig.SignedURL.BindMethod,
+						g.log,
+					)
+					handler = middleware.SignedURLMiddleware(signer, g.log)(handler)
+				}
+			case "ipfilter":
+				if routeConfig.IPFilter != nil {
+					filter, err := g.newIPFilter(routeConfig.IPFilter)
+					if err != nil {
+						return fmt.Errorf("failed to create IP filter for route %s: %w", routeConfig.Path, err)
+					}
+					handler = middleware.IPFilterMiddleware(filter, g.log)(handler)
+				}
 			default:
 				g.log.Warn("Unknown middleware: %s", middlewareName)
 			}
@@ -172,27 +592,302 @@ func (g *Gateway) initialize() error {
 		route.Handler = handler
 
 		// Add the route
-		g.routes[route.Path] = route
-		g.log.Info("Added route: %s -> %s", route.Path, route.Target)
+		g.routes[route.Name] = route
+		if route.balancer != nil {
+			g.log.Info("Added route: %s -> %d targets", route.Path, len(route.balancer.allTargets()))
+		} else {
+			g.log.Info("Added route: %s -> %s", route.Path, route.Target)
+		}
+	}
+
+	// Initialize the server-wide IP filter
+	if g.config.Server.IPFilter != nil {
+		filter, err := g.newIPFilter(g.config.Server.IPFilter)
+		if err != nil {
+			return fmt.Errorf("failed to create server IP filter: %w", err)
+		}
+		g.ipFilter = filter
 	}
 
 	return nil
 }
 
-// Start starts the gateway
-func (g *Gateway) Start() error {
-	// Create a mux
-	mux := http.NewServeMux()
+// newPlans creates the plans applied by the consumer middleware of a route.
+// Limiters are shared by all routes of a plan, keys are specific to the route.
+func (g *Gateway) newPlans(route string) (map[string]*middleware.Plan, error) {
+	plans := make(map[string]*middleware.Plan, len(g.config.Plans))
+	for name, planConfig := range g.config.Plans {
+		plan := &middleware.Plan{Name: name, Routes: planConfig.Routes}
+		for i, rateLimit := range planConfig.RateLimits {
+			if rateLimit.Key == "" {
+				rateLimit.Key = "consumer"
+			}
+			policy, err := g.newRateLimitPolicy(route, fmt.Sprintf("plan:%s#%d", name, i), rateLimit)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create rate limiter for plan %s: %w", name, err)
+			}
+			plan.RateLimits = append(plan.RateLimits, policy)
+		}
+		for i, quota := range planConfig.Quotas {
+			if quota.Key == "" {
+				quota.Key = "consumer"
+			}
+			policy, err := g.newQuotaPolicy(route, fmt.Sprintf("plan:%s#%d", name, i), quota)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create quota for plan %s: %w", name, err)
+			}
+			plan.Quotas = append(plan.Quotas, policy)
+		}
+		plans[name] = plan
+	}
+	return plans, nil
+}
 
-	// Add routes
-	for _, route := range g.routes {
-		mux.Handle(route.Path, route.Handler)
+// getQuotaStore returns the quota store, creating an in-memory one if none is configured
+func (g *Gateway) getQuotaStore() *middleware.QuotaStore {
+	if g.quotaStore == nil {
+		g.quotaStore, _ = middleware.NewQuotaStore("", 0, g.log)
+	}
+	return g.quotaStore
+}
+
+// newRateLimitPolicy creates a rate limit policy of a route from its configuration.
+// Policies with the same namespace share their limiter. Limits are kept in the
+// shared store if one is configured.
+func (g *Gateway) newRateLimitPolicy(route string, namespace string, cfg config.RateLimitConfig) (middleware.RateLimitPolicy, error) {
+	limiter, err := g.newLimiter(namespace, cfg)
+	if err != nil {
+		return middleware.RateLimitPolicy{}, err
+	}
+
+	key, err := middleware.ParseKey(cfg.Key, route)
+	if err != nil {
+		return middleware.RateLimitPolicy{}, err
+	}
+
+	switch cfg.Fallback {
+	case "", middleware.FallbackIP, middleware.FallbackShared, middleware.FallbackSkip, middleware.FallbackDeny:
+	default:
+		return middleware.RateLimitPolicy{}, fmt.Errorf("unknown rate limit fallback: %s", cfg.Fallback)
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = cfg.Key
+	}
+	if name == "" {
+		name = middleware.FallbackIP
+	}
+
+	return middleware.RateLimitPolicy{
+		Name:     name,
+		Limiter:  limiter,
+		Key:      key,
+		Fallback: cfg.Fallback,
+	}, nil
+}
+
+// newLimiter returns the limiter of a namespace, creating it on first use
+func (g *Gateway) newLimiter(namespace string, cfg config.RateLimitConfig) (middleware.Limiter, error) {
+	if limiter, ok := g.limiters[namespace]; ok {
+		return limiter, nil
+	}
+
+	var limiter middleware.Limiter
+	var err error
+	if g.store != nil {
+		// The shared store always applies GCRA
+		if cfg.Algorithm != "" && cfg.Algorithm != middleware.GCRA {
+			return nil, fmt.Errorf("rate limit store only supports the %s algorithm, not %s", middleware.GCRA, cfg.Algorithm)
+		}
+		limiter, err = middleware.NewStoreLimiter(
+			g.store,
+			namespace,
+			cfg.Limit,
+			time.Duration(cfg.Window)*time.Second,
+			cfg.Burst,
+			g.config.RateLimitStore.FailureMode,
+			g.log,
+		)
+	} else {
+		limiter, err = middleware.NewLimiter(
+			cfg.Algorithm,
+			cfg.Limit,
+			time.Duration(cfg.Window)*time.Second,
+			cfg.Burst,
+			g.log,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	g.limiters[namespace] = limiter
+	return limiter, nil
+}
+
+// newQuotaPolicy creates a quota policy of a route from its configuration. The
+// policy is named defaultName unless the configuration names it.
+func (g *Gateway) newQuotaPolicy(route string, defaultName string, cfg config.QuotaConfig) (middleware.QuotaPolicy, error) {
+	if cfg.Limit <= 0 {
+		return middleware.QuotaPolicy{}, fmt.Errorf("quota limit must be positive")
+	}
+
+	switch cfg.Period {
+	case middleware.Hourly, middleware.Daily, middleware.Monthly:
+	default:
+		return middleware.QuotaPolicy{}, fmt.Errorf("unknown quota period: %s", cfg.Period)
+	}
+
+	key, err := middleware.ParseKey(cfg.Key, route)
+	if err != nil {
+		return middleware.QuotaPolicy{}, err
+	}
+
+	switch cfg.Fallback {
+	case "", middleware.FallbackIP, middleware.FallbackShared, middleware.FallbackSkip, middleware.FallbackDeny:
+	default:
+		return middleware.QuotaPolicy{}, fmt.Errorf("unknown quota fallback: %s", cfg.Fallback)
 	}
 
+	name := cfg.Name
+	if name == "" {
+		name = defaultName
+	}
+
+	return middleware.QuotaPolicy{
+		Name:     name,
+		Limit:    cfg.Limit,
+		Period:   cfg.Period,
+		Key:      key,
+		Fallback: cfg.Fallback,
+	}, nil
+}
+
+// newBulkhead returns the bulkhead with the given name, creating it on first use
+func (g *Gateway) newBulkhead(name string, cfg *config.ConcurrencyConfig) (*middleware.Bulkhead, error) {
+	if bulkhead, ok := g.bulkheads[name]; ok {
+		return bulkhead, nil
+	}
+
+	bulkhead, err := middleware.NewBulkhead(
+		name,
+		cfg.MaxInFlight,
+		cfg.MaxQueue,
+		time.Duration(cfg.QueueTimeout)*time.Millisecond,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	g.bulkheads[name] = bulkhead
+	return bulkhead, nil
+}
+
+// upstreamBulkhead returns the concurrency limit of the upstream at a target
+// URL, or nil if it has none
+func (g *Gateway) upstreamBulkhead(target *url.URL) *middleware.Bulkhead {
+	if target == nil {
+		return nil
+	}
+	return g.upstreams[strings.TrimSuffix(target.String(), "/")]
+}
+
+// newIPFilter creates an IP filter from its configuration
+func (g *Gateway) newIPFilter(cfg *config.IPFilterConfig) (*middleware.IPFilter, error) {
+	return middleware.NewIPFilter(
+		cfg.Allow,
+		cfg.Deny,
+		cfg.AllowFile,
+		cfg.DenyFile,
+		time.Duration(cfg.ReloadInterval)*time.Second,
+		g.log,
+	)
+}
+
+// Handler returns the HTTP handler serving all routes
+func (g *Gateway) Handler() http.Handler {
+	// Create a router in the configured route order
+	routes := make([]*Route, 0, len(g.routes))
+	for _, routeConfig := range g.config.Routes {
+		name := routeConfig.Name
+		if name == "" {
+			name = routeConfig.Path
+		}
+		routes = append(routes, g.routes[name])
+	}
+	router := newRouter(routes)
+
+	// Add the admin API
+	if g.config.Admin != nil {
+		router.adminPath = g.adminPath()
+		router.admin = g.adminHandler()
+	}
+
+	// Apply server-wide middlewares
+	var handler http.Handler = router
+	if g.ipFilter != nil {
+		handler = middleware.IPFilterMiddleware(g.ipFilter, g.log)(handler)
+	}
+	handler = middleware.MetricsMiddleware(g.stats)(handler)
+	handler = middleware.ClientIPMiddleware(g.clientIP)(handler)
+	if g.shedder != nil {
+		handler = middleware.ArrivalMiddleware()(handler)
+	}
+
+	return handler
+}
+
+// Reload reloads the configuration file and applies the settings that can
+// change while the gateway runs, currently the weights of target groups not
+// under canary analysis. Other changes require a restart.
+func (g *Gateway) Reload() error {
+	cfg, err := config.LoadConfig(g.configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	// Check all weights before applying any
+	updates := make(map[string][]int)
+	for _, routeConfig := range cfg.Routes {
+		name := routeConfig.Name
+		if name == "" {
+			name = routeConfig.Path
+		}
+		route, ok := g.routes[name]
+		if !ok || route.split == nil || routeConfig.Split == nil {
+			continue
+		}
+		if route.split.canary != nil {
+			// The weights are managed by the canary analysis
+			continue
+		}
+
+		weights := make(map[string]int, len(routeConfig.Split.Groups))
+		for _, group := range routeConfig.Split.Groups {
+			weights[group.Name] = group.Weight
+		}
+		list, err := route.split.checkWeights(weights)
+		if err != nil {
+			return fmt.Errorf("invalid weights of route %s: %w", name, err)
+		}
+		updates[name] = list
+	}
+
+	for name, list := range updates {
+		g.routes[name].split.weights.Store(&list)
+		g.log.Info("Reloaded weights of route %s: %v", name, g.routes[name].split.currentWeights())
+	}
+
+	return nil
+}
+
+// Start starts the gateway
+func (g *Gateway) Start() error {
 	// Create a server
 	g.server = &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", g.config.Server.Host, g.config.Server.Port),
-		Handler: mux,
+		Handler: g.Handler(),
 	}
 
 	// Start the server
@@ -202,6 +897,25 @@ func (g *Gateway) Start() error {
 
 // Stop stops the gateway
 func (g *Gateway) Stop() error {
+	// Close connections to the shared rate limit store
+	if closer, ok := g.store.(io.Closer); ok {
+		closer.Close()
+	}
+
+	// Stop the health checks
+	for _, route := range g.routes {
+		if route.balancer != nil {
+			route.balancer.Close()
+		}
+	}
+
+	// Save the quota usage
+	if g.quotaStore != nil {
+		if err := g.quotaStore.Close(); err != nil {
+			g.log.Error("Failed to save quota usage: %v", err)
+		}
+	}
+
 	if g.server != nil {
 		g.log.Info("Stopping server")
 		return g.server.Close()
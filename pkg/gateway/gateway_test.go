@@ -1,6 +1,7 @@
 package gateway
 
 import (
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -71,6 +72,33 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestGatewayJWTSecretRequired(t *testing.T) {
+	// A JWT route without a secret would accept tokens signed with an empty key
+	tmpfile := writeTestConfig(t, `{
+		"routes": [
+			{"path": "/api", "target": "http://localhost:3000", "methods": ["GET"],
+				"middlewares": ["auth"], "auth": {"type": "jwt", "config": {}}}
+		]
+	}`)
+	if _, err := New(tmpfile, logger.INFO); err == nil {
+		t.Error("New() with a JWT route without secret succeeded")
+	}
+}
+
+func TestGatewayRateLimitStoreAlgorithm(t *testing.T) {
+	// The shared store always applies GCRA, so other algorithms are refused
+	tmpfile := writeTestConfig(t, `{
+		"rateLimitStore": {"type": "memory"},
+		"routes": [
+			{"path": "/api", "target": "http://localhost:3000", "methods": ["GET"],
+				"middlewares": ["ratelimit"], "rateLimit": {"limit": 1, "window": 60, "algorithm": "tokenbucket"}}
+		]
+	}`)
+	if _, err := New(tmpfile, logger.INFO); err == nil {
+		t.Error("New() with a token bucket limit on a shared store succeeded")
+	}
+}
+
 func TestGatewayRouting(t *testing.T) {
 	// Create a test server
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -241,3 +269,464 @@ func TestGatewayStartStop(t *testing.T) {
 		t.Errorf("Failed to stop gateway: %v", err)
 	}
 }
+
+// newTestGateway creates a gateway from the given configuration content
+func newTestGateway(t *testing.T, configContent string) *Gateway {
+	t.Helper()
+
+	gw, err := New(writeTestConfig(t, configContent), logger.INFO)
+	if err != nil {
+		t.Fatalf("Failed to create gateway: %v", err)
+	}
+	return gw
+}
+
+// writeTestConfig writes configuration content to a temporary file and returns its path
+func writeTestConfig(t *testing.T, configContent string) string {
+	t.Helper()
+
+	tmpfile, err := os.CreateTemp("", "config-*.json")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+
+	if _, err := tmpfile.Write([]byte(configContent)); err != nil {
+		t.Fatalf("Failed to write to temp file: %v", err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatalf("Failed to close temp file: %v", err)
+	}
+	return tmpfile.Name()
+}
+
+func TestGatewayIPFilter(t *testing.T) {
+	// Create a test server
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// Create a gateway with a server-wide deny list and a route allow list
+	gw := newTestGateway(t, `{
+		"server": {
+			"ipFilter": {"deny": ["192.168.66.0/24"]}
+		},
+		"routes": [
+			{
+				"path": "/admin",
+				"target": "`+ts.URL+`",
+				"methods": ["GET"],
+				"middlewares": ["ipfilter"],
+				"ipFilter": {"allow": ["10.0.0.0/8"]}
+			},
+			{
+				"path": "/public",
+				"target": "`+ts.URL+`",
+				"methods": ["GET"],
+				"middlewares": []
+			}
+		]
+	}`)
+	handler := gw.Handler()
+
+	// Test cases
+	tests := []struct {
+		name           string
+		path           string
+		remoteAddr     string
+		wantStatusCode int
+	}{
+		{
+			name:           "admin from office",
+			path:           "/admin",
+			remoteAddr:     "10.1.1.1:1234",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "admin from elsewhere",
+			path:           "/admin",
+			remoteAddr:     "203.0.113.1:1234",
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:           "public from elsewhere",
+			path:           "/public",
+			remoteAddr:     "203.0.113.1:1234",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "public from denied network",
+			path:           "/public",
+			remoteAddr:     "192.168.66.7:1234",
+			wantStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a request
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+
+			// Call the handler
+			handler.ServeHTTP(w, req)
+
+			// Check the response
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Status code = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+		})
+	}
+}
+
+func TestGatewayTrustedProxies(t *testing.T) {
+	// Create a test server
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// Create a gateway behind a trusted load balancer
+	gw := newTestGateway(t, `{
+		"server": {
+			"trustedProxies": ["10.0.0.0/8"]
+		},
+		"routes": [
+			{
+				"path": "/admin",
+				"target": "`+ts.URL+`",
+				"methods": ["GET"],
+				"middlewares": ["ipfilter"],
+				"ipFilter": {"allow": ["203.0.113.0/24"]}
+			}
+		]
+	}`)
+	handler := gw.Handler()
+
+	// Test cases
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   string
+		wantStatusCode int
+	}{
+		{
+			name:           "client behind load balancer",
+			remoteAddr:     "10.0.0.2:1234",
+			forwardedFor:   "203.0.113.5",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "spoofed header from untrusted peer",
+			remoteAddr:     "198.51.100.1:1234",
+			forwardedFor:   "203.0.113.5",
+			wantStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a request
+			req := httptest.NewRequest("GET", "/admin", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			w := httptest.NewRecorder()
+
+			// Call the handler
+			handler.ServeHTTP(w, req)
+
+			// Check the response
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("Status code = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+		})
+	}
+}
+
+func TestGatewayConsumers(t *testing.T) {
+	// Create a test server
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// Create a gateway with a plan sharing one daily quota over two routes
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/users", "target": %[1]q, "methods": ["GET"], "middlewares": ["consumer"]},
+			{"path": "/orders", "target": %[1]q, "methods": ["GET"], "middlewares": ["consumer"]},
+			{"path": "/internal", "target": %[1]q, "methods": ["GET"], "middlewares": ["consumer"]}
+		],
+		"consumers": [
+			{"id": "acme", "plan": "starter", "apiKeys": ["acme-key"]}
+		],
+		"plans": {
+			"starter": {
+				"routes": ["/users", "/orders"],
+				"quotas": [{"limit": 2, "period": "daily"}]
+			}
+		},
+		"admin": {"apiKey": "admin-secret"}
+	}`, ts.URL))
+	defer gw.Stop()
+	handler := gw.Handler()
+
+	send := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-API-Key", "acme-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The quota is shared by the routes of the plan
+	for i, tt := range []struct {
+		path string
+		want int
+	}{
+		{path: "/users", want: http.StatusOK},
+		{path: "/orders", want: http.StatusOK},
+		{path: "/users", want: http.StatusTooManyRequests},
+		{path: "/internal", want: http.StatusForbidden},
+	} {
+		if got := send(tt.path); got != tt.want {
+			t.Errorf("request %d to %s status code = %v, want %v", i, tt.path, got, tt.want)
+		}
+	}
+
+	// Requests are counted by consumer
+	req := httptest.NewRequest("GET", "/_admin/stats", nil)
+	req.Header.Set(AdminKeyHeader, "admin-secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("stats status code = %v, want %v", w.Code, http.StatusOK)
+	}
+	if got := gw.stats.Counter("requests_total", "consumer", "acme", "code", "200").Value(); got != 2 {
+		t.Errorf("acme requests = %v, want %v", got, 2)
+	}
+}
+
+func TestGatewayConcurrencyLimits(t *testing.T) {
+	// Create a test server that blocks the products endpoint
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" && r.Header.Get("X-Slow") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	// Create a gateway limiting the products route to one request in flight
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/products", "target": %[1]q, "methods": ["GET"], "concurrency": {"maxInFlight": 1}},
+			{"path": "/users", "target": %[1]q, "methods": ["GET"]}
+		]
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	send := func(path string, slow bool) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if slow {
+			req.Header.Set("X-Slow", "1")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Saturate the products route
+	go send("/products", true)
+	<-entered
+
+	// The products route is saturated, the users route is not affected
+	if got := send("/products", false); got != http.StatusServiceUnavailable {
+		t.Errorf("products status code = %v, want %v", got, http.StatusServiceUnavailable)
+	}
+	if got := send("/users", false); got != http.StatusOK {
+		t.Errorf("users status code = %v, want %v", got, http.StatusOK)
+	}
+}
+
+func TestGatewayConcurrencyLimitsPerRouteName(t *testing.T) {
+	// Create a test server that blocks slow requests
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Slow") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	// Create routes sharing a path, each limited to one request in flight
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"name": "products-eu", "path": "/products", "target": %[1]q, "methods": ["GET"],
+				"match": {"hosts": ["eu.example.com"]}, "concurrency": {"maxInFlight": 1}},
+			{"name": "products-us", "path": "/products", "target": %[1]q, "methods": ["GET"],
+				"match": {"hosts": ["us.example.com"]}, "concurrency": {"maxInFlight": 1}}
+		]
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	send := func(url string, slow bool) int {
+		req := httptest.NewRequest("GET", url, nil)
+		if slow {
+			req.Header.Set("X-Slow", "1")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Saturating one route leaves the other one available
+	go send("http://eu.example.com/products", true)
+	<-entered
+	if got := send("http://us.example.com/products", false); got != http.StatusOK {
+		t.Errorf("us status code = %v, want %v", got, http.StatusOK)
+	}
+	if got := send("http://eu.example.com/products", false); got != http.StatusServiceUnavailable {
+		t.Errorf("eu status code = %v, want %v", got, http.StatusServiceUnavailable)
+	}
+	if got := gw.stats.Counter("bulkhead_rejected_total", "bulkhead", "route:products-eu").Value(); got != 1 {
+		t.Errorf("bulkhead_rejected_total{bulkhead=route:products-eu} = %v, want 1", got)
+	}
+}
+
+func TestGatewayUpstreamConcurrencyLimits(t *testing.T) {
+	// Create a test server that blocks slow requests
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Slow") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	// Create routes reaching the same upstream through different kinds of targets
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"upstreams": {%[1]q: {"concurrency": {"maxInFlight": 1}}},
+		"routes": [
+			{"path": "/target", "target": %[1]q, "methods": ["GET"]},
+			{"path": "/targets", "targets": [%[1]q], "methods": ["GET"]},
+			{"path": "/split", "methods": ["GET"], "split": {"groups": [
+				{"name": "stable", "target": %[1]q, "weight": 100}
+			]}},
+			{"path": "/aggregate", "methods": ["GET"], "aggregate": {"backends": [
+				{"key": "users", "target": %[1]q, "path": "/users", "required": true}
+			]}}
+		]
+	}`, ts.URL+"/"))
+	handler := gw.Handler()
+
+	send := func(path string, slow bool) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if slow {
+			req.Header.Set("X-Slow", "1")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Saturate the upstream through the balanced route
+	go send("/targets", true)
+	<-entered
+
+	// Test cases
+	tests := []struct {
+		path string
+		want int
+	}{
+		{path: "/target", want: http.StatusServiceUnavailable},
+		{path: "/targets", want: http.StatusServiceUnavailable},
+		{path: "/split", want: http.StatusServiceUnavailable},
+		{path: "/aggregate", want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := send(tt.path, false); got != tt.want {
+				t.Errorf("status code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	name := "upstream:" + ts.URL + "/"
+	if got := gw.stats.Counter("bulkhead_rejected_total", "bulkhead", name).Value(); got != int64(len(tests)) {
+		t.Errorf("bulkhead_rejected_total{bulkhead=%s} = %v, want %v", name, got, len(tests))
+	}
+}
+
+func TestGatewayLoadShedding(t *testing.T) {
+	// Create a test server that blocks slow requests
+	release := make(chan struct{})
+	entered := make(chan struct{}, 3)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Slow") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	// Create a gateway that is overloaded with four requests in flight
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/reports", "target": %[1]q, "methods": ["GET"], "priority": "low"},
+			{"path": "/checkout", "target": %[1]q, "methods": ["GET"], "priority": "high"},
+			{"path": "/healthz", "target": %[1]q, "methods": ["GET"], "priority": "critical"}
+		],
+		"loadShedding": {"maxInFlight": 4},
+		"admin": {"apiKey": "admin-secret"}
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	send := func(path string, slow bool) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if slow {
+			req.Header.Set("X-Slow", "1")
+		}
+		req.Header.Set(AdminKeyHeader, "admin-secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Put the gateway at three quarters of its capacity
+	for i := 0; i < 3; i++ {
+		go send("/checkout", true)
+		<-entered
+	}
+
+	// Low priority traffic is shed first, everything else is admitted
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{path: "/reports", want: http.StatusServiceUnavailable},
+		{path: "/checkout", want: http.StatusOK},
+		{path: "/healthz", want: http.StatusOK},
+		{path: "/_admin/stats", want: http.StatusOK},
+	} {
+		if got := send(tt.path, false); got != tt.want {
+			t.Errorf("%s status code = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
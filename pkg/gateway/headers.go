@@ -0,0 +1,211 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mstgnz/goteway/pkg/config"
+)
+
+// RequestIDHeader is the header carrying the ID of a request
+const RequestIDHeader = "X-Request-ID"
+
+// headerValue represents a header name and its templated value
+type headerValue struct {
+	name  string
+	value *valueTemplate
+}
+
+// statusRange represents an inclusive range of response status codes
+type statusRange struct {
+	min, max int
+}
+
+// headerRules represents header transformations applied together. Headers are
+// renamed first, then removed, set and added.
+type headerRules struct {
+	status []statusRange // response statuses the rules apply to, all if empty
+	rename [][2]string
+	remove []string // names, or prefixes ending in "*"
+	set    []headerValue
+	add    []headerValue
+}
+
+// newHeaderRules creates header rules from their configuration. Only response
+// rules may be conditional on the status.
+func newHeaderRules(cfgs []config.HeaderRulesConfig, response bool) ([]*headerRules, error) {
+	var rules []*headerRules
+	for _, cfg := range cfgs {
+		h := &headerRules{}
+
+		if len(cfg.Status) > 0 && !response {
+			return nil, fmt.Errorf("request header rules cannot depend on the status")
+		}
+		for _, status := range cfg.Status {
+			r, err := parseStatusRange(status)
+			if err != nil {
+				return nil, err
+			}
+			h.status = append(h.status, r)
+		}
+
+		for _, from := range sortedKeys(cfg.Rename) {
+			to := cfg.Rename[from]
+			if err := checkHeaderName(from); err != nil {
+				return nil, err
+			}
+			if err := checkHeaderName(to); err != nil {
+				return nil, err
+			}
+			h.rename = append(h.rename, [2]string{from, to})
+		}
+
+		for _, name := range cfg.Remove {
+			if err := checkHeaderName(strings.TrimSuffix(name, "*")); err != nil {
+				return nil, err
+			}
+			h.remove = append(h.remove, name)
+		}
+
+		var err error
+		if h.set, err = newHeaderValues(cfg.Set); err != nil {
+			return nil, err
+		}
+		if h.add, err = newHeaderValues(cfg.Add); err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, h)
+	}
+
+	return rules, nil
+}
+
+// newHeaderValues parses the templated values of headers, sorted by name
+func newHeaderValues(values map[string]string) ([]headerValue, error) {
+	var result []headerValue
+	for _, name := range sortedKeys(values) {
+		if err := checkHeaderName(name); err != nil {
+			return nil, err
+		}
+		template, err := parseTemplate(values[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of header %s: %w", name, err)
+		}
+		result = append(result, headerValue{name: name, value: template})
+	}
+	return result, nil
+}
+
+// applyHeaderRules applies the rules matching a response status to a header.
+// Values are filled in from the request r. A status of 0 matches all rules.
+func applyHeaderRules(rules []*headerRules, header http.Header, r *http.Request, status int) {
+	for _, h := range rules {
+		if status != 0 && !h.matchesStatus(status) {
+			continue
+		}
+
+		for _, rename := range h.rename {
+			if values := header.Values(rename[0]); len(values) > 0 {
+				header.Del(rename[0])
+				header[http.CanonicalHeaderKey(rename[1])] = values
+			}
+		}
+		for _, name := range h.remove {
+			if prefix, ok := strings.CutSuffix(name, "*"); ok {
+				prefix = http.CanonicalHeaderKey(prefix)
+				for key := range header {
+					if strings.HasPrefix(key, prefix) {
+						header.Del(key)
+					}
+				}
+				continue
+			}
+			header.Del(name)
+		}
+		for _, hv := range h.set {
+			header.Set(hv.name, hv.value.execute(r, nil))
+		}
+		for _, hv := range h.add {
+			header.Add(hv.name, hv.value.execute(r, nil))
+		}
+	}
+}
+
+// matchesStatus reports whether the rules apply to a response status
+func (h *headerRules) matchesStatus(status int) bool {
+	if len(h.status) == 0 {
+		return true
+	}
+	for _, r := range h.status {
+		if status >= r.min && status <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// usesRequestID reports whether any of the rules fill in the request ID
+func usesRequestID(rules ...[]*headerRules) bool {
+	for _, list := range rules {
+		for _, h := range list {
+			for _, hv := range slices.Concat(h.set, h.add) {
+				if hv.value.uses("request_id") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ensureRequestID sets a random request ID on a request without one
+func ensureRequestID(r *http.Request) {
+	if r.Header.Get(RequestIDHeader) != "" {
+		return
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	r.Header.Set(RequestIDHeader, hex.EncodeToString(id))
+}
+
+// parseStatusRange parses a status code such as "404" or a class such as "5xx"
+func parseStatusRange(status string) (statusRange, error) {
+	if len(status) == 3 && strings.HasSuffix(status, "xx") && status[0] >= '1' && status[0] <= '5' {
+		class := int(status[0]-'0') * 100
+		return statusRange{min: class, max: class + 99}, nil
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 100 || code > 599 {
+		return statusRange{}, fmt.Errorf("invalid status: %s", status)
+	}
+	return statusRange{min: code, max: code}, nil
+}
+
+// checkHeaderName returns an error if name is not a valid header name
+func checkHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty header name")
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return fmt.Errorf("invalid header name: %q", name)
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/middleware"
+)
+
+func TestNewHeaderRulesErrors(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		name     string
+		rules    config.HeaderRulesConfig
+		response bool
+	}{
+		{name: "request status", rules: config.HeaderRulesConfig{Status: []string{"200"}}},
+		{name: "invalid status", rules: config.HeaderRulesConfig{Status: []string{"6xx"}}, response: true},
+		{name: "invalid name", rules: config.HeaderRulesConfig{Set: map[string]string{"X Tenant": "a"}}},
+		{name: "invalid rename", rules: config.HeaderRulesConfig{Rename: map[string]string{"X-Old": ""}}},
+		{name: "invalid template", rules: config.HeaderRulesConfig{Add: map[string]string{"X-User": "${param}"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newHeaderRules([]config.HeaderRulesConfig{tt.rules}, tt.response); err == nil {
+				t.Error("newHeaderRules() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	rules, err := newHeaderRules([]config.HeaderRulesConfig{
+		{
+			Rename: map[string]string{"X-Old": "X-New"},
+			Remove: []string{"Server", "X-Internal-*"},
+			Set:    map[string]string{"X-User": "${param.id}"},
+			Add:    map[string]string{"X-Served-By": "gateway"},
+		},
+		{Status: []string{"5xx"}, Set: map[string]string{"Cache-Control": "no-store"}},
+	}, true)
+	if err != nil {
+		t.Fatalf("newHeaderRules() error = %v", err)
+	}
+
+	// Create a request
+	req := httptest.NewRequest("GET", "/users/42", nil)
+	req = middleware.WithPathParams(req, map[string]string{"id": "42"})
+
+	// Test cases
+	tests := []struct {
+		status int
+		want   http.Header
+	}{
+		{
+			status: http.StatusOK,
+			want: http.Header{
+				"X-New":       {"a", "b"},
+				"X-User":      {"42"},
+				"X-Served-By": {"upstream", "gateway"},
+			},
+		},
+		{
+			status: http.StatusBadGateway,
+			want: http.Header{
+				"X-New":         {"a", "b"},
+				"X-User":        {"42"},
+				"X-Served-By":   {"upstream", "gateway"},
+				"Cache-Control": {"no-store"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.status), func(t *testing.T) {
+			header := http.Header{
+				"X-Old":           {"a", "b"},
+				"Server":          {"nginx"},
+				"X-Internal-Node": {"10.0.0.1"},
+				"X-User":          {"spoofed"},
+				"X-Served-By":     {"upstream"},
+			}
+			applyHeaderRules(rules, header, req, tt.status)
+			if !reflect.DeepEqual(header, tt.want) {
+				t.Errorf("header = %v, want %v", header, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayHeaders(t *testing.T) {
+	// Create a test server echoing the request headers and failing on /fail
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Tenant", r.Header.Get("X-Tenant"))
+		w.Header().Set("X-Request-Client", r.Header.Get("X-Client"))
+		w.Header().Set("X-Request-Secret", r.Header.Get("X-Secret"))
+		w.Header().Set("X-Upstream-ID", r.Header.Get(RequestIDHeader))
+		w.Header().Set("Server", "upstream")
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	// Create a gateway transforming the headers
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{
+				"path": "/api",
+				"target": %q,
+				"methods": ["GET"],
+				"headers": {
+					"request": [
+						{"rename": {"X-Org": "X-Tenant"}, "remove": ["X-Secret"], "set": {"X-Client": "${client_ip}"}}
+					],
+					"response": [
+						{"remove": ["Server"], "set": {"X-Request-ID": "${request_id}"}},
+						{"status": ["5xx"], "set": {"Retry-After": "5"}}
+					]
+				}
+			}
+		]
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	// Make a request
+	req := httptest.NewRequest("GET", "/api/ok", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Org", "acme")
+	req.Header.Set("X-Secret", "hunter2")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	// Check the transformed headers
+	want := map[string]string{
+		"X-Request-Tenant": "acme",
+		"X-Request-Client": "192.0.2.1",
+		"X-Request-Secret": "",
+		"Server":           "",
+		"Retry-After":      "",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("header %s = %q, want %q", name, got, value)
+		}
+	}
+	if id := w.Header().Get(RequestIDHeader); id == "" || id != w.Header().Get("X-Upstream-ID") {
+		t.Errorf("request ID = %q, want the ID sent upstream %q", id, w.Header().Get("X-Upstream-ID"))
+	}
+
+	// Check that the request ID of the client is kept and status rules apply
+	req = httptest.NewRequest("GET", "/api/fail", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get(RequestIDHeader); got != "abc" {
+		t.Errorf("request ID = %q, want %q", got, "abc")
+	}
+	if got := w.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After = %q, want %q", got, "5")
+	}
+}
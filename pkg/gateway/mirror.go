@@ -0,0 +1,191 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/middleware"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+const (
+	// MirrorHeader is the header marking mirrored requests, set to the route name
+	MirrorHeader = "X-Gateway-Mirror"
+
+	// defaultMirrorBodySize is the default size above which requests are not mirrored
+	defaultMirrorBodySize = 64 << 10
+	// defaultMirrorTimeout is the default timeout of a mirrored request
+	defaultMirrorTimeout = 5 * time.Second
+	// maxMirrorsInFlight is the number of mirrored requests a route sends at once,
+	// requests beyond it are not mirrored
+	maxMirrorsInFlight = 100
+)
+
+// mirror represents a secondary target receiving copies of a route's requests.
+// Copies are sent in the background and their responses discarded, so the
+// mirror never affects the primary response.
+type mirror struct {
+	route          string
+	target         *url.URL
+	percentage     float64
+	maxBodySize    int64
+	timeout        time.Duration
+	client         *http.Client
+	slots          chan struct{}
+	requestHeaders []*headerRules
+	stats          *stats.Registry
+	log            *logger.Logger
+}
+
+// newMirror creates a mirror from its configuration
+func newMirror(route string, cfg *config.MirrorConfig, registry *stats.Registry, log *logger.Logger) (*mirror, error) {
+	target, err := url.Parse(cfg.Target)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid mirror target: %q", cfg.Target)
+	}
+	percentage := 100.0
+	if cfg.Percentage != nil {
+		percentage = *cfg.Percentage
+	}
+	if percentage < 0 || percentage > 100 {
+		return nil, fmt.Errorf("mirror percentage must be between 0 and 100")
+	}
+
+	m := &mirror{
+		route:       route,
+		target:      target,
+		percentage:  percentage,
+		maxBodySize: cfg.MaxBodySize,
+		timeout:     time.Duration(cfg.Timeout) * time.Millisecond,
+		client: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		slots: make(chan struct{}, maxMirrorsInFlight),
+		stats: registry,
+		log:   log,
+	}
+	if m.maxBodySize <= 0 {
+		m.maxBodySize = defaultMirrorBodySize
+	}
+	if m.timeout <= 0 {
+		m.timeout = defaultMirrorTimeout
+	}
+
+	return m, nil
+}
+
+// send mirrors a share of the requests. The body of a mirrored request is
+// buffered and r.Body replaced so that the primary request still reads all of it.
+func (m *mirror) send(r *http.Request) {
+	if rand.Float64()*100 >= m.percentage {
+		return
+	}
+
+	// Buffer the body
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > m.maxBodySize {
+			m.count("skipped")
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, m.maxBodySize+1))
+		if int64(len(data)) > m.maxBodySize || err != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(data), errorReader{err}, r.Body), r.Body}
+			m.count("skipped")
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		body = data
+	}
+
+	// Create the copy while the request is still being served
+	req, err := http.NewRequest(r.Method, m.url(r), bytes.NewReader(body))
+	if err != nil {
+		m.count("error")
+		return
+	}
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	applyHeaderRules(m.requestHeaders, req.Header, r, 0)
+	req.Header.Set(MirrorHeader, m.route)
+	req.Header.Set(middleware.XForwardedForHeader, middleware.ClientIP(r))
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.count("dropped")
+		return
+	}
+	go func() {
+		defer func() { <-m.slots }()
+		m.do(req)
+	}()
+}
+
+// do sends a mirrored request and discards the response
+func (m *mirror) do(req *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		m.log.Debug("Mirror request to %s failed: %v", m.target, err)
+		m.count("error")
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		m.count("error")
+		return
+	}
+	m.count("ok")
+}
+
+// url returns the URL of a request's copy
+func (m *mirror) url(r *http.Request) string {
+	u := *m.target
+	u.Path = strings.TrimSuffix(m.target.Path, "/") + r.URL.Path
+	u.RawPath = ""
+	if m.target.RawPath != "" || r.URL.RawPath != "" {
+		u.RawPath = strings.TrimSuffix(m.target.EscapedPath(), "/") + r.URL.EscapedPath()
+	}
+	u.RawQuery = r.URL.RawQuery
+	return u.String()
+}
+
+// count counts a request by the outcome of its mirroring
+func (m *mirror) count(result string) {
+	m.stats.Counter("mirror_requests_total", "route", m.route, "result", result).Inc()
+}
+
+// errorReader represents a reader failing with an error, or ending if there is none
+type errorReader struct {
+	err error
+}
+
+// Read implements io.Reader
+func (r errorReader) Read([]byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+// percentage returns a pointer to a mirror percentage
+func percentage(p float64) *float64 {
+	return &p
+}
+
+func TestNewMirrorErrors(t *testing.T) {
+	for _, cfg := range []*config.MirrorConfig{
+		{},
+		{Target: "shadow"},
+		{Target: "http://shadow", Percentage: percentage(101)},
+		{Target: "http://shadow", Percentage: percentage(-1)},
+	} {
+		if _, err := newMirror("/api", cfg, stats.NewRegistry(), logger.New(logger.INFO)); err == nil {
+			t.Errorf("newMirror(%+v) error = nil, want error", cfg)
+		}
+	}
+}
+
+func TestNewMirrorPercentage(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		name       string
+		percentage *float64
+		want       float64
+	}{
+		{name: "default", percentage: nil, want: 100},
+		{name: "disabled", percentage: percentage(0), want: 0},
+		{name: "share", percentage: percentage(10), want: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newMirror("/api", &config.MirrorConfig{Target: "http://shadow", Percentage: tt.percentage}, stats.NewRegistry(), logger.New(logger.INFO))
+			if err != nil {
+				t.Fatalf("newMirror() error = %v", err)
+			}
+			if m.percentage != tt.want {
+				t.Errorf("percentage = %v, want %v", m.percentage, tt.want)
+			}
+		})
+	}
+}
+
+// mirroredRequest represents a request received by a mirror
+type mirroredRequest struct {
+	path   string
+	body   string
+	header http.Header
+}
+
+func TestGatewayMirror(t *testing.T) {
+	// Create a primary server echoing the body and a slow, failing mirror
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("primary " + r.URL.RequestURI() + " " + string(body)))
+	}))
+	defer primary.Close()
+	received := make(chan mirroredRequest, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- mirroredRequest{path: r.URL.RequestURI(), body: string(body), header: r.Header}
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	// Create a gateway mirroring all requests with small bodies
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{
+				"path": "/api",
+				"target": %q,
+				"methods": ["POST"],
+				"mirror": {"target": %q, "maxBodySize": 16}
+			}
+		]
+	}`, primary.URL, shadow.URL+"/shadow"))
+	handler := gw.Handler()
+
+	send := func(body string) (*httptest.ResponseRecorder, time.Duration) {
+		req := httptest.NewRequest("POST", "/api/users?id=1", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(w, req)
+		return w, time.Since(start)
+	}
+
+	// The primary response is not affected by the slow, failing mirror
+	w, elapsed := send(`{"name":"Ada"}`)
+	if w.Code != http.StatusOK || w.Body.String() != `primary /users?id=1 {"name":"Ada"}` {
+		t.Errorf("primary response = %d %q", w.Code, w.Body.String())
+	}
+	if elapsed >= 200*time.Millisecond {
+		t.Errorf("primary response took %s, waited for the mirror", elapsed)
+	}
+
+	// The mirror receives a tagged copy
+	select {
+	case got := <-received:
+		if got.path != "/shadow/users?id=1" || got.body != `{"name":"Ada"}` {
+			t.Errorf("mirrored request = %s %q", got.path, got.body)
+		}
+		if got.header.Get(MirrorHeader) != "/api" || got.header.Get("X-Forwarded-For") != "192.0.2.1" {
+			t.Errorf("mirrored headers = %v", got.header)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not mirrored")
+	}
+
+	// Requests with large bodies are proxied in full but not mirrored
+	large := strings.Repeat("a", 100)
+	if w, _ := send(large); w.Body.String() != "primary /users?id=1 "+large {
+		t.Errorf("primary response = %q", w.Body.String())
+	}
+	select {
+	case got := <-received:
+		t.Errorf("large request mirrored: %s", got.path)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The outcomes are counted
+	want := map[string]float64{"error": 1, "skipped": 1}
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := make(map[string]float64)
+		for _, metric := range gw.stats.Snapshot() {
+			if metric.Name == "mirror_requests_total" {
+				got[metric.Labels["result"]] = metric.Value
+			}
+		}
+		if got["error"] == want["error"] && got["skipped"] == want["skipped"] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mirror_requests_total = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,183 @@
+package gateway
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Segment kinds, in order of decreasing specificity
+const (
+	literalSegment = iota
+	regexSegment
+	paramSegment
+)
+
+// patternSegment represents one segment of a path pattern
+type patternSegment struct {
+	kind    int
+	literal string
+	param   string
+	re      *regexp.Regexp
+}
+
+// pathPattern represents a route path such as "/users/{id}", "/users/{id:[0-9]+}"
+// or "/files/{path...}". A pattern without a wildcard tail matches its path and
+// everything below it.
+type pathPattern struct {
+	segments []patternSegment
+	tail     string // name of the wildcard tail parameter, "*" if unnamed
+	hasTail  bool
+}
+
+// parsePathPattern parses a route path into a pattern
+func parsePathPattern(path string) (*pathPattern, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path must start with /: %s", path)
+	}
+
+	p := &pathPattern{}
+	parts := splitPath(path)
+	seen := make(map[string]bool)
+	for i, part := range parts {
+		last := i == len(parts)-1
+
+		// Wildcard tails
+		if part == "*" || strings.HasPrefix(part, "{") && strings.HasSuffix(part, "...}") {
+			if !last {
+				return nil, fmt.Errorf("wildcard must be the last segment: %s", path)
+			}
+			p.hasTail = true
+			p.tail = "*"
+			if part != "*" {
+				p.tail = part[1 : len(part)-4]
+			}
+			if seen[p.tail] {
+				return nil, fmt.Errorf("duplicate parameter %s: %s", p.tail, path)
+			}
+			break
+		}
+
+		// Literals
+		if !strings.HasPrefix(part, "{") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("parameters must span a whole segment: %s", path)
+			}
+			p.segments = append(p.segments, patternSegment{kind: literalSegment, literal: part})
+			continue
+		}
+
+		// Parameters with optional regex constraints
+		if !strings.HasSuffix(part, "}") {
+			return nil, fmt.Errorf("unterminated parameter: %s", path)
+		}
+		name, expr, constrained := strings.Cut(part[1:len(part)-1], ":")
+		if name == "" {
+			return nil, fmt.Errorf("parameter without name: %s", path)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate parameter %s: %s", name, path)
+		}
+		seen[name] = true
+
+		segment := patternSegment{kind: paramSegment, param: name}
+		if constrained {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid constraint of parameter %s: %w", name, err)
+			}
+			segment.kind = regexSegment
+			segment.re = re
+		}
+		p.segments = append(p.segments, segment)
+	}
+
+	return p, nil
+}
+
+// match matches an escaped request path against the pattern, so encoded
+// slashes never split a segment. It returns the escaped prefix of the path
+// matched by the segments before any wildcard tail, and the captured
+// parameters, unescaped.
+func (p *pathPattern) match(path string) (string, map[string]string, bool) {
+	parts := splitPath(path)
+	if len(parts) < len(p.segments) {
+		return "", nil, false
+	}
+
+	var params map[string]string
+	capture := func(name, value string) {
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = value
+	}
+
+	prefixLen := 0
+	for i, segment := range p.segments {
+		prefixLen += 1 + len(parts[i])
+		part, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return "", nil, false
+		}
+		switch segment.kind {
+		case literalSegment:
+			if part != segment.literal {
+				return "", nil, false
+			}
+		case regexSegment:
+			if !segment.re.MatchString(part) {
+				return "", nil, false
+			}
+			capture(segment.param, part)
+		default:
+			if part == "" {
+				return "", nil, false
+			}
+			capture(segment.param, part)
+		}
+	}
+
+	prefixLen = min(prefixLen, len(path))
+	if p.hasTail && p.tail != "*" {
+		tail, err := url.PathUnescape(strings.TrimPrefix(path[prefixLen:], "/"))
+		if err != nil {
+			return "", nil, false
+		}
+		capture(p.tail, tail)
+	}
+	return path[:prefixLen], params, true
+}
+
+// specificity compares the specificity of two patterns. It returns a positive
+// number if p is more specific than other, a negative one if it is less
+// specific and zero if they are equally specific.
+func (p *pathPattern) specificity(other *pathPattern) int {
+	for i := 0; i < len(p.segments) && i < len(other.segments); i++ {
+		if p.segments[i].kind != other.segments[i].kind {
+			return other.segments[i].kind - p.segments[i].kind
+		}
+	}
+	if len(p.segments) != len(other.segments) {
+		return len(p.segments) - len(other.segments)
+	}
+	if p.hasTail != other.hasTail {
+		// A tail wildcard matches the same paths as no tail, but captures them
+		if p.hasTail {
+			return 1
+		}
+		return -1
+	}
+	return 0
+}
+
+// splitPath splits a path into its segments, ignoring the leading and trailing slash
+func splitPath(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	path = strings.TrimSuffix(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
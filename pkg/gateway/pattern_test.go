@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePathPatternErrors(t *testing.T) {
+	for _, path := range []string{
+		"api",
+		"/files/{path...}/meta",
+		"/users/{}",
+		"/users/{id}/{id}",
+		"/users/{id",
+		"/users/id-{id}",
+		"/users/{id:[0-9}",
+	} {
+		if _, err := parsePathPattern(path); err == nil {
+			t.Errorf("parsePathPattern(%q) error = nil, want error", path)
+		}
+	}
+}
+
+func TestPathPatternMatch(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		pattern    string
+		path       string
+		wantOK     bool
+		wantPrefix string
+		wantParams map[string]string
+	}{
+		{pattern: "/api/users", path: "/api/users", wantOK: true, wantPrefix: "/api/users"},
+		{pattern: "/api/users", path: "/api/users/42", wantOK: true, wantPrefix: "/api/users"},
+		{pattern: "/api/users", path: "/api/usersettings", wantOK: false},
+		{pattern: "/api/users/", path: "/api/users/42", wantOK: true, wantPrefix: "/api/users"},
+		{pattern: "/", path: "/anything", wantOK: true, wantPrefix: ""},
+		{
+			pattern:    "/users/{id}",
+			path:       "/users/42/orders",
+			wantOK:     true,
+			wantPrefix: "/users/42",
+			wantParams: map[string]string{"id": "42"},
+		},
+		{pattern: "/users/{id}", path: "/users/", wantOK: false},
+		{
+			pattern:    "/users/{id:[0-9]+}",
+			path:       "/users/42",
+			wantOK:     true,
+			wantPrefix: "/users/42",
+			wantParams: map[string]string{"id": "42"},
+		},
+		{pattern: "/users/{id:[0-9]+}", path: "/users/me", wantOK: false},
+		{pattern: "/users/{id:[0-9]+}", path: "/users/42abc", wantOK: false},
+		{
+			pattern:    "/files/{path...}",
+			path:       "/files/a/b.txt",
+			wantOK:     true,
+			wantPrefix: "/files",
+			wantParams: map[string]string{"path": "a/b.txt"},
+		},
+		{pattern: "/static/*", path: "/static/css/site.css", wantOK: true, wantPrefix: "/static"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			pattern, err := parsePathPattern(tt.pattern)
+			if err != nil {
+				t.Fatalf("parsePathPattern() error = %v", err)
+			}
+			prefix, params, ok := pattern.match(tt.path)
+			if ok != tt.wantOK {
+				t.Fatalf("match() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if prefix != tt.wantPrefix {
+				t.Errorf("match() prefix = %q, want %q", prefix, tt.wantPrefix)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("match() params = %v, want %v", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestPathPatternSpecificity(t *testing.T) {
+	// Patterns from most to least specific
+	paths := []string{"/users/me/orders", "/users/me", "/users/{id:[0-9]+}", "/users/{id}", "/users", "/"}
+	patterns := make([]*pathPattern, len(paths))
+	for i, path := range paths {
+		pattern, err := parsePathPattern(path)
+		if err != nil {
+			t.Fatalf("parsePathPattern(%q) error = %v", path, err)
+		}
+		patterns[i] = pattern
+	}
+
+	for i := 0; i+1 < len(patterns); i++ {
+		if got := patterns[i].specificity(patterns[i+1]); got <= 0 {
+			t.Errorf("%s.specificity(%s) = %v, want positive", paths[i], paths[i+1], got)
+		}
+	}
+}
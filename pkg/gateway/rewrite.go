@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mstgnz/goteway/pkg/config"
+)
+
+// pathRewriter represents how a route rewrites the paths and queries it forwards
+type pathRewriter struct {
+	keepPrefix    bool
+	replacePrefix string
+	re            *regexp.Regexp
+	replacement   string
+	template      *valueTemplate
+	tail          string // wildcard tail parameter of the route, keeping its slashes
+	query         map[string]*valueTemplate
+}
+
+// newPathRewriter creates a path rewriter from its configuration, given the
+// wildcard tail parameter of the route. Without configuration the matched
+// route prefix is stripped.
+func newPathRewriter(cfg *config.RewriteConfig, tail string) (*pathRewriter, error) {
+	rw := &pathRewriter{tail: tail}
+	if cfg == nil {
+		return rw, nil
+	}
+
+	modes := 0
+	if cfg.KeepPrefix {
+		rw.keepPrefix = true
+		modes++
+	}
+	if cfg.ReplacePrefix != "" {
+		rw.replacePrefix = strings.TrimSuffix(cfg.ReplacePrefix, "/")
+		modes++
+	}
+	if cfg.Regex != "" {
+		re, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite regex: %w", err)
+		}
+		rw.re = re
+		rw.replacement = cfg.Replacement
+		modes++
+	}
+	if cfg.Template != "" {
+		if strings.Contains(cfg.Template, "?") {
+			return nil, fmt.Errorf("rewrite template must not contain a query, use query instead")
+		}
+		template, err := parseTemplate(cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		rw.template = template
+		modes++
+	}
+	if modes > 1 {
+		return nil, fmt.Errorf("only one of keepPrefix, replacePrefix, regex and template can be set")
+	}
+
+	if len(cfg.Query) > 0 {
+		rw.query = make(map[string]*valueTemplate, len(cfg.Query))
+		for name, value := range cfg.Query {
+			template, err := parseTemplate(value)
+			if err != nil {
+				return nil, err
+			}
+			rw.query[name] = template
+		}
+	}
+
+	return rw, nil
+}
+
+// stripsPrefix reports whether the rewriter only strips the matched route
+// prefix, so that upstreams can be told about it in X-Forwarded-Prefix
+func (rw *pathRewriter) stripsPrefix() bool {
+	return !rw.keepPrefix && rw.replacePrefix == "" && rw.re == nil && rw.template == nil
+}
+
+// rewritePath returns the escaped path to forward a request with, given the
+// escaped prefix its route matched. It fails if a template variable would add
+// dot segments to the path.
+func (rw *pathRewriter) rewritePath(r *http.Request, prefix string) (string, error) {
+	path := r.URL.EscapedPath()
+	rest := strings.TrimPrefix(path, prefix)
+
+	switch {
+	case rw.keepPrefix:
+	case rw.replacePrefix != "":
+		path = rw.replacePrefix + rest
+	case rw.re != nil:
+		path = rw.re.ReplaceAllString(path, rw.replacement)
+	case rw.template != nil:
+		var err error
+		if path, _, err = rw.template.executePath(r, rw.tail); err != nil {
+			return "", err
+		}
+	default:
+		path = rest
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path, nil
+}
+
+// rewriteQuery sets the query of an outgoing request. Parameters of the target
+// URL are defaults that the request overrides, and the configured parameters
+// override both. The query is left untouched if there is nothing to merge.
+func (rw *pathRewriter) rewriteQuery(out *url.URL, target *url.URL, in *http.Request) {
+	if target.RawQuery == "" && len(rw.query) == 0 {
+		out.RawQuery = in.URL.RawQuery
+		return
+	}
+
+	query := target.Query()
+	for name, values := range in.URL.Query() {
+		query[name] = values
+	}
+	for name, template := range rw.query {
+		query.Set(name, template.execute(in, nil))
+	}
+	out.RawQuery = query.Encode()
+}
+
+// setEscapedPath sets the path of a URL from its escaped form
+func setEscapedPath(u *url.URL, escaped string) {
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		path = escaped
+	}
+	u.Path = path
+	u.RawPath = escaped
+	if u.EscapedPath() != escaped {
+		// Fall back to the default encoding of the path
+		u.RawPath = ""
+	}
+}
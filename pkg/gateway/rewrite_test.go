@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/middleware"
+)
+
+func TestNewPathRewriterErrors(t *testing.T) {
+	for _, cfg := range []*config.RewriteConfig{
+		{KeepPrefix: true, ReplacePrefix: "/v2"},
+		{Regex: "^/api/(.*"},
+		{Template: "/users/${param}"},
+		{Template: "/users/${unknown.id}"},
+		{Template: "/users?id=${param.id}"},
+		{Query: map[string]string{"id": "${param.id"}},
+	} {
+		if _, err := newPathRewriter(cfg, ""); err == nil {
+			t.Errorf("newPathRewriter(%+v) error = nil, want error", cfg)
+		}
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		name    string
+		rewrite *config.RewriteConfig
+		path    string
+		prefix  string
+		params  map[string]string
+		tail    string
+		want    string
+		wantErr bool
+	}{
+		{name: "strip prefix", path: "/api/users/42", prefix: "/api", want: "/users/42"},
+		{name: "strip whole path", path: "/api", prefix: "/api", want: "/"},
+		{
+			name:    "keep prefix",
+			rewrite: &config.RewriteConfig{KeepPrefix: true},
+			path:    "/api/users/42",
+			prefix:  "/api",
+			want:    "/api/users/42",
+		},
+		{
+			name:    "replace prefix",
+			rewrite: &config.RewriteConfig{ReplacePrefix: "/v2/"},
+			path:    "/api/users/42",
+			prefix:  "/api",
+			want:    "/v2/users/42",
+		},
+		{
+			name:    "regex with capture groups",
+			rewrite: &config.RewriteConfig{Regex: `^/api/(?P<resource>\w+)/(\d+)$`, Replacement: "/${resource}/by-id/$2"},
+			path:    "/api/users/42",
+			prefix:  "/api",
+			want:    "/users/by-id/42",
+		},
+		{
+			name:    "regex without match",
+			rewrite: &config.RewriteConfig{Regex: `^/v1/(.*)$`, Replacement: "/$1"},
+			path:    "/api/users/42",
+			prefix:  "/api",
+			want:    "/api/users/42",
+		},
+		{
+			name:    "template",
+			rewrite: &config.RewriteConfig{Template: "/accounts/${param.id}/profile"},
+			path:    "/users/a%2Fb",
+			prefix:  "/users/a%2Fb",
+			params:  map[string]string{"id": "a/b c"},
+			want:    "/accounts/a%2Fb%20c/profile",
+		},
+		{
+			name:    "template with wildcard tail",
+			rewrite: &config.RewriteConfig{Template: "/storage/${param.path}"},
+			path:    "/files/a/b%20c",
+			prefix:  "/files",
+			params:  map[string]string{"path": "a/b c"},
+			tail:    "path",
+			want:    "/storage/a/b%20c",
+		},
+		{
+			name:    "template with dot segment",
+			rewrite: &config.RewriteConfig{Template: "/v2/users/${param.id}/profile"},
+			path:    "/users/..",
+			prefix:  "/users/..",
+			params:  map[string]string{"id": ".."},
+			wantErr: true,
+		},
+		{
+			name:    "template with dot segment in wildcard tail",
+			rewrite: &config.RewriteConfig{Template: "/storage/${param.path}"},
+			path:    "/files/a/..%2F..%2Fadmin",
+			prefix:  "/files",
+			params:  map[string]string{"path": "a/../../admin"},
+			tail:    "path",
+			wantErr: true,
+		},
+		{
+			name:   "encoded path",
+			path:   "/files/a%2Fb/c%20d",
+			prefix: "/files",
+			want:   "/a%2Fb/c%20d",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rewriter, err := newPathRewriter(tt.rewrite, tt.tail)
+			if err != nil {
+				t.Fatalf("newPathRewriter() error = %v", err)
+			}
+
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.params != nil {
+				req = middleware.WithPathParams(req, tt.params)
+			}
+			got, err := rewriter.rewritePath(req, tt.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rewritePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("rewritePath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayRewrite(t *testing.T) {
+	// Create a test server echoing the forwarded path and query
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.EscapedPath() + "?" + r.URL.RawQuery))
+	}))
+	defer ts.Close()
+
+	// Create a gateway with rewriting routes
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/strip", "target": %[1]q, "methods": ["GET"]},
+			{"path": "/keep", "target": %[1]q, "methods": ["GET"], "rewrite": {"keepPrefix": true}},
+			{"path": "/old", "target": %[1]q, "methods": ["GET"], "rewrite": {"replacePrefix": "/new"}},
+			{"path": "/users/{id}", "target": %[1]q, "methods": ["GET"],
+				"rewrite": {"template": "/profiles/${param.id}", "query": {"source": "gateway", "user": "${param.id}"}}},
+			{"path": "/defaults", "target": %[2]q, "methods": ["GET"]},
+			{"path": "/accounts/{id}", "target": %[1]q, "methods": ["GET"], "rewrite": {"template": "/v2/users/${param.id}/profile"}}
+		]
+	}`, ts.URL, ts.URL+"/base?format=json&limit=10"))
+	handler := gw.Handler()
+
+	// Test cases
+	tests := []struct {
+		path     string
+		wantCode int
+		want     string
+	}{
+		{path: "/strip/a%2Fb?x=1", want: "/a%2Fb?x=1"},
+		{path: "/keep/a%2Fb", want: "/keep/a%2Fb?"},
+		{path: "/old/items/1", want: "/new/items/1?"},
+		{path: "/users/j%20doe?source=client&page=2", want: "/profiles/j%20doe?page=2&source=gateway&user=j+doe"},
+		{path: "/defaults/list?limit=50", want: "/base/list?format=json&limit=50"},
+		{path: "/accounts/x%2F..%2F..%2Fadmin%2Fsecret", want: "/v2/users/x%2F..%2F..%2Fadmin%2Fsecret/profile?"},
+		{path: "/accounts/%2E%2E", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			wantCode := tt.wantCode
+			if wantCode == 0 {
+				wantCode = http.StatusOK
+			}
+			if w.Code != wantCode {
+				t.Fatalf("status code = %v, want %v", w.Code, wantCode)
+			}
+			if tt.want != "" && w.Body.String() != tt.want {
+				t.Errorf("forwarded = %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/mstgnz/goteway/pkg/middleware"
+)
+
+// router dispatches requests to the most specific matching route
+type router struct {
+	routes    []*Route // in order of precedence
+	adminPath string
+	admin     http.Handler
+}
+
+// newRouter creates a router over the given routes. When several routes match a
+// request, the one with the most specific path wins, comparing literal segments
+// over constrained parameters over parameters from the left and then the
+// number of segments, then the one with the most specific host, then the one
+// with the most header and query conditions, and finally the one configured
+// first.
+func newRouter(routes []*Route) *router {
+	sorted := make([]*Route, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if specificity := a.pattern.specificity(b.pattern); specificity != 0 {
+			return specificity > 0
+		}
+		if a.hostSpecificity() != b.hostSpecificity() {
+			return a.hostSpecificity() > b.hostSpecificity()
+		}
+		return len(a.Headers)+len(a.Query) > len(b.Headers)+len(b.Query)
+	})
+
+	return &router{routes: sorted}
+}
+
+// ServeHTTP dispatches a request. Like http.ServeMux, requests for a path with
+// dot segments or repeated slashes are redirected to its clean form, so they
+// cannot reach a route other than the one the path resolves to. Requests
+// matched by a route except for their method are answered with 405, even if
+// the route allows no methods at all, and all other unmatched requests with 404.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		escaped := r.URL.EscapedPath()
+		if hasEncodedDotSegment(escaped) {
+			middleware.WriteError(w, http.StatusBadRequest, "bad_request", "Invalid path")
+			return
+		}
+		if clean := cleanPath(escaped); clean != escaped {
+			if r.URL.RawQuery != "" {
+				clean += "?" + r.URL.RawQuery
+			}
+			w.Header().Set("Location", clean)
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+	}
+
+	if rt.admin != nil && (r.URL.Path == rt.adminPath || strings.HasPrefix(r.URL.Path, rt.adminPath+"/")) {
+		rt.admin.ServeHTTP(w, r)
+		return
+	}
+
+	var matched bool
+	var allowed []string
+	for _, route := range rt.routes {
+		params, ok := route.matches(r)
+		if !ok {
+			continue
+		}
+		if route.Methods[r.Method] {
+			route.Handler.ServeHTTP(w, middleware.WithPathParams(r, params))
+			return
+		}
+		matched = true
+		for method := range route.Methods {
+			allowed = append(allowed, method)
+		}
+	}
+
+	if matched {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(dedupe(allowed), ", "))
+		middleware.WriteError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+	middleware.WriteError(w, http.StatusNotFound, "not_found", "No route matches the request")
+}
+
+// cleanPath returns the canonical form of an escaped path, eliminating . and ..
+// segments and repeated slashes while keeping a trailing slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// hasEncodedDotSegment reports whether an escaped path has a segment that is
+// "." or ".." once unescaped, such as "%2E%2E"
+func hasEncodedDotSegment(escaped string) bool {
+	for _, segment := range strings.Split(escaped, "/") {
+		if !strings.Contains(segment, "%") {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(segment); err == nil && (unescaped == "." || unescaped == "..") {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether a request meets all conditions of the route except
+// its methods, and returns the parameters captured from its path
+func (route *Route) matches(r *http.Request) (map[string]string, bool) {
+	_, params, ok := route.pattern.match(r.URL.EscapedPath())
+	if !ok {
+		return nil, false
+	}
+
+	if len(route.Hosts) > 0 {
+		host := requestHost(r)
+		matched := false
+		for _, pattern := range route.Hosts {
+			if matchHost(pattern, host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, false
+		}
+	}
+
+	for name, want := range route.Headers {
+		if !matchValue(want, r.Header.Values(name)) {
+			return nil, false
+		}
+	}
+	if len(route.Query) > 0 {
+		query := r.URL.Query()
+		for name, want := range route.Query {
+			if !matchValue(want, query[name]) {
+				return nil, false
+			}
+		}
+	}
+
+	return params, true
+}
+
+// hostSpecificity ranks routes for exact hosts above wildcard hosts above any host
+func (route *Route) hostSpecificity() int {
+	if len(route.Hosts) == 0 {
+		return 0
+	}
+	for _, host := range route.Hosts {
+		if strings.HasPrefix(host, "*.") {
+			return 1
+		}
+	}
+	return 2
+}
+
+// requestHost returns the host of a request without port, in lower case
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// matchHost reports whether a host matches a pattern, which is either a host
+// name or a wildcard such as "*.example.com" matching any subdomain
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return pattern == host
+}
+
+// matchValue reports whether one of the values matches the wanted value. "*"
+// matches any value as long as there is one.
+func matchValue(want string, values []string) bool {
+	for _, value := range values {
+		if want == "*" || value == want {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupe removes adjacent duplicates from a sorted slice
+func dedupe(values []string) []string {
+	result := values[:0]
+	for i, value := range values {
+		if i == 0 || value != values[i-1] {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// matchedPrefixKey is the context key for the path prefix matched by a route
+type matchedPrefixKey struct{}
+
+// withMatchedPrefix returns a copy of the request carrying the path prefix matched by its route
+func withMatchedPrefix(r *http.Request, prefix string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), matchedPrefixKey{}, prefix))
+}
+
+// matchedPrefix returns the path prefix matched by the route of a request
+func matchedPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(matchedPrefixKey{}).(string)
+	return prefix
+}
+
+// targetKey is the context key for the target chosen for a request
+type targetKey struct{}
+
+// withTarget returns a copy of the request carrying the target it is sent to
+func withTarget(r *http.Request, target *url.URL) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), targetKey{}, target))
+}
+
+// requestTarget returns the target a request is sent to, given the target of
+// its route
+func requestTarget(r *http.Request, target *url.URL) *url.URL {
+	if chosen, ok := r.Context().Value(targetKey{}).(*url.URL); ok {
+		return chosen
+	}
+	return target
+}
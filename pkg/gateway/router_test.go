@@ -0,0 +1,354 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+func TestMatchHost(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "api.example.com", host: "api.example.com", want: true},
+		{pattern: "API.example.com", host: "api.example.com", want: true},
+		{pattern: "api.example.com", host: "admin.example.com", want: false},
+		{pattern: "*.example.com", host: "api.example.com", want: true},
+		{pattern: "*.example.com", host: "a.b.example.com", want: true},
+		{pattern: "*.example.com", host: "example.com", want: false},
+		{pattern: "*.example.com", host: "badexample.com", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.host, func(t *testing.T) {
+			if got := matchHost(tt.pattern, tt.host); got != tt.want {
+				t.Errorf("matchHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouter(t *testing.T) {
+	// Create a test server echoing the route it was reached through
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Route")))
+	}))
+	defer ts.Close()
+
+	// Create a gateway with overlapping routes
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"name": "default", "path": "/", "target": %[1]q, "methods": ["GET"]},
+			{"name": "api", "path": "/api", "target": %[1]q, "methods": ["GET", "POST"]},
+			{"name": "api-host", "path": "/api", "target": %[1]q, "methods": ["GET"],
+				"match": {"hosts": ["api.example.com"]}},
+			{"name": "api-wildcard", "path": "/api", "target": %[1]q, "methods": ["GET"],
+				"match": {"hosts": ["*.example.com"]}},
+			{"name": "api-v2", "path": "/api", "target": %[1]q, "methods": ["GET"],
+				"match": {"hosts": ["api.example.com"], "headers": {"X-Version": "2"}}},
+			{"name": "api-beta", "path": "/api", "target": %[1]q, "methods": ["GET"],
+				"match": {"query": {"beta": "*"}}},
+			{"name": "users", "path": "/api/users", "target": %[1]q, "methods": ["DELETE"]}
+		]
+	}`, ts.URL))
+
+	// Tag the requests with the route serving them
+	for name, route := range gw.routes {
+		name, next := name, route.Handler
+		route.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("X-Route", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+	handler := gw.Handler()
+
+	// Test cases
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		header    http.Header
+		wantCode  int
+		wantRoute string
+		wantAllow string
+	}{
+		{name: "root", method: "GET", url: "http://example.org/home", wantCode: http.StatusOK, wantRoute: "default"},
+		{name: "prefix", method: "GET", url: "http://example.org/api/orders", wantCode: http.StatusOK, wantRoute: "api"},
+		{name: "no partial segment match", method: "GET", url: "http://example.org/apix", wantCode: http.StatusOK, wantRoute: "default"},
+		{name: "exact host", method: "GET", url: "http://api.example.com:8080/api", wantCode: http.StatusOK, wantRoute: "api-host"},
+		{name: "wildcard host", method: "GET", url: "http://admin.example.com/api", wantCode: http.StatusOK, wantRoute: "api-wildcard"},
+		{
+			name:      "host and header",
+			method:    "GET",
+			url:       "http://api.example.com/api",
+			header:    http.Header{"X-Version": {"2"}},
+			wantCode:  http.StatusOK,
+			wantRoute: "api-v2",
+		},
+		{name: "query", method: "GET", url: "http://example.org/api?beta=1", wantCode: http.StatusOK, wantRoute: "api-beta"},
+		{name: "method of less specific route", method: "POST", url: "http://api.example.com/api", wantCode: http.StatusOK, wantRoute: "api"},
+		{name: "method not allowed", method: "PUT", url: "http://example.org/api/users", wantCode: http.StatusMethodNotAllowed, wantAllow: "DELETE, GET, POST"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if tt.wantRoute != "" && w.Body.String() != tt.wantRoute {
+				t.Errorf("route = %q, want %q", w.Body.String(), tt.wantRoute)
+			}
+			if tt.wantAllow != "" && w.Header().Get("Allow") != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", w.Header().Get("Allow"), tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	// Create a gateway without a catch-all route
+	gw := newTestGateway(t, `{
+		"routes": [
+			{"path": "/api", "target": "http://localhost:3000", "methods": ["GET"], "match": {"hosts": ["api.example.com"]}}
+		]
+	}`)
+	handler := gw.Handler()
+
+	// Requests not matching the path or host are not found
+	for _, url := range []string{"http://api.example.com/other", "http://admin.example.com/api"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s status code = %v, want %v", url, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestRouterNoMethods(t *testing.T) {
+	// Create a gateway with a route allowing no methods
+	gw := newTestGateway(t, `{
+		"routes": [
+			{"path": "/api", "target": "http://localhost:3000"}
+		]
+	}`)
+	handler := gw.Handler()
+
+	// Requests matching the route are not allowed rather than not found
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/users", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status code = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+	if allow, ok := w.Header()["Allow"]; !ok || len(allow) != 1 || allow[0] != "" {
+		t.Errorf("Allow = %q, want an empty value", allow)
+	}
+}
+
+func TestGatewayDuplicateRoutes(t *testing.T) {
+	// Create a config with two routes of the same name
+	tmpfile := writeTestConfig(t, `{
+		"routes": [
+			{"path": "/api", "target": "http://localhost:3000", "methods": ["GET"]},
+			{"path": "/api", "target": "http://localhost:3001", "methods": ["GET"]}
+		]
+	}`)
+
+	if _, err := New(tmpfile, logger.INFO); err == nil {
+		t.Error("New() with duplicate routes succeeded")
+	}
+}
+
+func TestGatewayPathParameters(t *testing.T) {
+	// Create a test server echoing the forwarded path and prefix
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(XForwardedPrefixHeader) + " " + r.URL.Path))
+	}))
+	defer ts.Close()
+
+	// Create a gateway with parameterized routes, limited per user
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/api/users", "target": %[1]q, "methods": ["GET"]},
+			{"path": "/api/users/{id:[0-9]+}", "target": %[1]q, "methods": ["GET"],
+				"middlewares": ["ratelimit"], "rateLimit": {"limit": 1, "window": 60, "key": "param:id"}},
+			{"path": "/files/{path...}", "target": %[1]q, "methods": ["GET"]}
+		]
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	send := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// Test cases
+	tests := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{path: "/api/users/42/orders", wantCode: http.StatusOK, wantBody: "/api/users/42 /orders"},
+		{path: "/api/users/me", wantCode: http.StatusOK, wantBody: "/api/users /me"},
+		{path: "/api/usersettings", wantCode: http.StatusNotFound},
+		{path: "/files/a/b.txt", wantCode: http.StatusOK, wantBody: "/files /a/b.txt"},
+		{path: "/api/users/42", wantCode: http.StatusTooManyRequests},
+		{path: "/api/users/43", wantCode: http.StatusOK, wantBody: "/api/users/43 /"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := send(tt.path)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRouterCleanPath(t *testing.T) {
+	// Create a test server that must only be reached through clean paths
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.EscapedPath()))
+	}))
+	defer ts.Close()
+
+	// Create a gateway with a protected route next to a public one
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/admin", "target": %[1]q, "methods": ["GET"],
+				"middlewares": ["ipfilter"], "ipFilter": {"allow": ["10.0.0.0/8"]}},
+			{"path": "/public/", "target": %[1]q, "methods": ["GET"]}
+		]
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	// Test cases
+	tests := []struct {
+		path         string
+		wantCode     int
+		wantLocation string
+	}{
+		{path: "/public/../admin/secret", wantCode: http.StatusMovedPermanently, wantLocation: "/admin/secret"},
+		{path: "/public/./docs/?page=2", wantCode: http.StatusMovedPermanently, wantLocation: "/public/docs/?page=2"},
+		{path: "//public//docs", wantCode: http.StatusMovedPermanently, wantLocation: "/public/docs"},
+		{path: "/public/%2E%2E/admin/secret", wantCode: http.StatusBadRequest},
+		{path: "/public/%2e/docs", wantCode: http.StatusBadRequest},
+		{path: "/admin/secret", wantCode: http.StatusForbidden},
+		{path: "/public/docs/", wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+			req.RemoteAddr = "203.0.113.1:1234"
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestGatewayRateLimitsPerRouteName(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	// Create routes sharing a path, each limited to one request
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"name": "api", "path": "/", "target": %[1]q, "methods": ["GET"], "match": {"hosts": ["api.example.com"]},
+				"middlewares": ["ratelimit"], "rateLimit": {"limit": 1, "window": 60, "key": "route"}},
+			{"name": "admin", "path": "/", "target": %[1]q, "methods": ["GET"], "match": {"hosts": ["admin.example.com"]},
+				"middlewares": ["ratelimit"], "rateLimit": {"limit": 1, "window": 60, "key": "route"}}
+		]
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	// Each route has its own limit
+	var codes []int
+	for _, url := range []string{"http://api.example.com/", "http://admin.example.com/", "http://api.example.com/"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		codes = append(codes, w.Code)
+	}
+	if want := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}; fmt.Sprint(codes) != fmt.Sprint(want) {
+		t.Errorf("status codes = %v, want %v", codes, want)
+	}
+}
+
+func TestGatewayRateLimitsByPrincipal(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	// The last middleware listed runs first, so auth sets the principal before the limit
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/api", "target": %q, "methods": ["GET"], "middlewares": ["ratelimit", "auth"],
+				"auth": {"type": "basic", "config": {"username": "alice", "password": "secret"}},
+				"rateLimit": {"limit": 1, "window": 60, "key": "principal", "fallback": "deny"}}
+		]
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	// The principal gets its one request
+	var codes []int
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/api", nil)
+		req.SetBasicAuth("alice", "secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	if want := []int{http.StatusOK, http.StatusTooManyRequests}; fmt.Sprint(codes) != fmt.Sprint(want) {
+		t.Errorf("status codes = %v, want %v", codes, want)
+	}
+}
+
+func TestGatewayQuotasByPrincipal(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	// The quota runs after auth, so it is counted by principal
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/api", "target": %q, "methods": ["GET"], "middlewares": ["quota", "auth"],
+				"auth": {"type": "basic", "config": {"username": "alice", "password": "secret"}},
+				"quotas": [{"limit": 1, "period": "daily", "key": "principal", "fallback": "deny"}]}
+		]
+	}`, ts.URL))
+	defer gw.Stop()
+	handler := gw.Handler()
+
+	var codes []int
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/api", nil)
+		req.SetBasicAuth("alice", "secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	if want := []int{http.StatusOK, http.StatusTooManyRequests}; fmt.Sprint(codes) != fmt.Sprint(want) {
+		t.Errorf("status codes = %v, want %v", codes, want)
+	}
+}
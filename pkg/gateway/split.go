@@ -0,0 +1,256 @@
+package gateway
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/middleware"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+const (
+	// StickyCookie is the sticky key keeping a client on one target group by cookie
+	StickyCookie = "cookie"
+
+	// defaultSplitCookie is the default name of the sticky cookie
+	defaultSplitCookie = "goteway_group"
+)
+
+// targetGroup represents a target receiving a share of a route's traffic
+type targetGroup struct {
+	name   string
+	target *url.URL
+}
+
+// trafficSplit represents the weighted distribution of a route's requests over
+// target groups. Weights can be changed while requests are served.
+type trafficSplit struct {
+	route       string
+	groups      []*targetGroup
+	weights     atomic.Pointer[[]int]
+	cookie      string             // sticky cookie name, no cookie if empty
+	key         middleware.KeyFunc // sticky key, random distribution if nil
+	forceHeader string
+	canary      *canaryAnalysis // progressive promotion of a canary group, if configured
+	stats       *stats.Registry
+}
+
+// newTrafficSplit creates a traffic split from its configuration
+func newTrafficSplit(route string, cfg *config.SplitConfig, registry *stats.Registry, log *logger.Logger) (*trafficSplit, error) {
+	if len(cfg.Groups) == 0 {
+		return nil, fmt.Errorf("no target groups")
+	}
+
+	s := &trafficSplit{route: route, forceHeader: cfg.ForceHeader, stats: registry}
+	weights := make(map[string]int, len(cfg.Groups))
+	for _, groupConfig := range cfg.Groups {
+		if groupConfig.Name == "" {
+			return nil, fmt.Errorf("target group without a name")
+		}
+		if _, ok := weights[groupConfig.Name]; ok {
+			return nil, fmt.Errorf("duplicate target group: %s", groupConfig.Name)
+		}
+		target, err := url.Parse(groupConfig.Target)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid target of group %s: %q", groupConfig.Name, groupConfig.Target)
+		}
+		s.groups = append(s.groups, &targetGroup{name: groupConfig.Name, target: target})
+		weights[groupConfig.Name] = groupConfig.Weight
+	}
+	if err := s.setWeights(weights); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Sticky {
+	case "":
+	case StickyCookie:
+		s.cookie = cfg.Cookie
+		if s.cookie == "" {
+			s.cookie = defaultSplitCookie
+		}
+	default:
+		key, err := middleware.ParseKey(cfg.Sticky, route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sticky key: %w", err)
+		}
+		s.key = key
+	}
+
+	if cfg.Canary != nil {
+		canary, err := newCanaryAnalysis(s, cfg.Canary, log)
+		if err != nil {
+			return nil, err
+		}
+		s.canary = canary
+	}
+
+	return s, nil
+}
+
+// setWeights replaces the weights of the target groups. Groups not listed get
+// a weight of 0.
+func (s *trafficSplit) setWeights(weights map[string]int) error {
+	list, err := s.checkWeights(weights)
+	if err != nil {
+		return err
+	}
+	s.weights.Store(&list)
+	return nil
+}
+
+// checkWeights validates weights by group name and returns them in group order
+func (s *trafficSplit) checkWeights(weights map[string]int) ([]int, error) {
+	total := 0
+	for name, weight := range weights {
+		if s.group(name) == nil {
+			return nil, fmt.Errorf("unknown target group: %s", name)
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("negative weight of target group %s", name)
+		}
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("target group weights add up to 0")
+	}
+
+	list := make([]int, len(s.groups))
+	for i, group := range s.groups {
+		list[i] = weights[group.name]
+	}
+	return list, nil
+}
+
+// currentWeights returns the weights of the target groups by name
+func (s *trafficSplit) currentWeights() map[string]int {
+	weights := make(map[string]int, len(s.groups))
+	for i, weight := range *s.weights.Load() {
+		weights[s.groups[i].name] = weight
+	}
+	return weights
+}
+
+// pick selects the target group of a request. A group forced by header wins,
+// then the group of the sticky cookie, then the group the sticky key hashes
+// to, then a random one. It reports whether the sticky cookie has to be set.
+func (s *trafficSplit) pick(r *http.Request) (*targetGroup, bool) {
+	weights := *s.weights.Load()
+
+	if s.forceHeader != "" {
+		if group := s.group(r.Header.Get(s.forceHeader)); group != nil {
+			return group, false
+		}
+	}
+
+	if s.cookie != "" {
+		if cookie, err := r.Cookie(s.cookie); err == nil {
+			for i, group := range s.groups {
+				if group.name == cookie.Value && weights[i] > 0 {
+					return group, false
+				}
+			}
+		}
+		return s.groupAt(weights, rand.Uint64()), true
+	}
+
+	if s.key != nil {
+		if key, ok := s.key(r); ok {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			return s.groupAt(weights, h.Sum64()), false
+		}
+	}
+
+	return s.groupAt(weights, rand.Uint64()), false
+}
+
+// groupAt returns the group a number falls into when spread over the weights
+func (s *trafficSplit) groupAt(weights []int, n uint64) *targetGroup {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+
+	bucket := int(n % uint64(total))
+	for i, weight := range weights {
+		if bucket < weight {
+			return s.groups[i]
+		}
+		bucket -= weight
+	}
+	return s.groups[len(s.groups)-1]
+}
+
+// group returns the target group with the given name, nil if there is none
+func (s *trafficSplit) group(name string) *targetGroup {
+	for _, group := range s.groups {
+		if group.name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// serve sends a request to its target group through next and counts the
+// group's responses
+func (s *trafficSplit) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if s.canary != nil {
+		s.canary.tick()
+	}
+
+	group, setCookie := s.pick(r)
+	if setCookie {
+		http.SetCookie(w, &http.Cookie{
+			Name:     s.cookie,
+			Value:    group.name,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	s.stats.Counter("split_requests_total", "route", s.route, "group", group.name).Inc()
+
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+	next.ServeHTTP(sw, withTarget(r, group.target))
+	s.responses(group, sw.status >= http.StatusInternalServerError).Inc()
+	s.responseTime(group).Add(time.Since(start).Microseconds())
+}
+
+// responses returns the counter of a group's failed or successful responses
+func (s *trafficSplit) responses(group *targetGroup, failed bool) *stats.Counter {
+	result := "ok"
+	if failed {
+		result = "error"
+	}
+	return s.stats.Counter("split_responses_total", "route", s.route, "group", group.name, "result", result)
+}
+
+// responseTime returns the counter of a group's total response time
+func (s *trafficSplit) responseTime(group *targetGroup) *stats.Counter {
+	return s.stats.Counter("split_response_microseconds_total", "route", s.route, "group", group.name)
+}
+
+// statusWriter represents a response writer recording the status code
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the underlying response writer, so http.ResponseController can reach it
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,196 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mstgnz/goteway/pkg/config"
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/middleware"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+func TestNewTrafficSplitErrors(t *testing.T) {
+	for _, cfg := range []*config.SplitConfig{
+		{},
+		{Groups: []config.TargetGroupConfig{{Target: "http://v1", Weight: 1}}},
+		{Groups: []config.TargetGroupConfig{{Name: "v1", Target: "http://v1", Weight: 1}, {Name: "v1", Target: "http://v2"}}},
+		{Groups: []config.TargetGroupConfig{{Name: "v1", Target: "v1", Weight: 1}}},
+		{Groups: []config.TargetGroupConfig{{Name: "v1", Target: "http://v1"}}},
+		{Groups: []config.TargetGroupConfig{{Name: "v1", Target: "http://v1", Weight: -1}, {Name: "v2", Target: "http://v2", Weight: 2}}},
+		{Groups: []config.TargetGroupConfig{{Name: "v1", Target: "http://v1", Weight: 1}}, Sticky: "session"},
+	} {
+		if _, err := newTrafficSplit("/api", cfg, stats.NewRegistry(), logger.New(logger.INFO)); err == nil {
+			t.Errorf("newTrafficSplit(%+v) error = nil, want error", cfg)
+		}
+	}
+}
+
+func TestTrafficSplitPick(t *testing.T) {
+	newSplit := func(sticky string) *trafficSplit {
+		split, err := newTrafficSplit("/api", &config.SplitConfig{
+			Groups: []config.TargetGroupConfig{
+				{Name: "stable", Target: "http://stable", Weight: 95},
+				{Name: "canary", Target: "http://canary", Weight: 5},
+			},
+			Sticky:      sticky,
+			ForceHeader: "X-Canary",
+		}, stats.NewRegistry(), logger.New(logger.INFO))
+		if err != nil {
+			t.Fatalf("newTrafficSplit() error = %v", err)
+		}
+		return split
+	}
+
+	t.Run("weights", func(t *testing.T) {
+		split := newSplit("")
+		counts := make(map[string]int)
+		for i := 0; i < 10000; i++ {
+			group, _ := split.pick(httptest.NewRequest("GET", "/api", nil))
+			counts[group.name]++
+		}
+		if counts["canary"] < 350 || counts["canary"] > 650 {
+			t.Errorf("canary requests = %d of 10000, want about 500", counts["canary"])
+		}
+	})
+
+	t.Run("forced group", func(t *testing.T) {
+		split := newSplit("")
+		req := httptest.NewRequest("GET", "/api", nil)
+		req.Header.Set("X-Canary", "canary")
+		for i := 0; i < 100; i++ {
+			if group, _ := split.pick(req); group.name != "canary" {
+				t.Fatalf("group = %s, want canary", group.name)
+			}
+		}
+	})
+
+	t.Run("sticky key", func(t *testing.T) {
+		split := newSplit("consumer")
+		counts := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			req := middleware.WithConsumer(httptest.NewRequest("GET", "/api", nil), &middleware.Consumer{ID: fmt.Sprint(i)})
+			first, _ := split.pick(req)
+			for j := 0; j < 5; j++ {
+				if group, _ := split.pick(req); group != first {
+					t.Fatalf("consumer %d moved from %s to %s", i, first.name, group.name)
+				}
+			}
+			counts[first.name]++
+		}
+		if counts["canary"] == 0 || counts["canary"] > 150 {
+			t.Errorf("canary consumers = %d of 1000, want about 50", counts["canary"])
+		}
+	})
+
+	t.Run("sticky cookie", func(t *testing.T) {
+		split := newSplit(StickyCookie)
+		req := httptest.NewRequest("GET", "/api", nil)
+		if _, setCookie := split.pick(req); !setCookie {
+			t.Error("sticky cookie not set for a new client")
+		}
+
+		req.AddCookie(&http.Cookie{Name: defaultSplitCookie, Value: "canary"})
+		for i := 0; i < 100; i++ {
+			if group, setCookie := split.pick(req); group.name != "canary" || setCookie {
+				t.Fatalf("group = %s, set cookie = %v, want canary from the cookie", group.name, setCookie)
+			}
+		}
+
+		// A group without traffic is not kept
+		split.setWeights(map[string]int{"stable": 100})
+		if group, setCookie := split.pick(req); group.name != "stable" || !setCookie {
+			t.Errorf("group = %s, set cookie = %v, want stable with a new cookie", group.name, setCookie)
+		}
+	})
+}
+
+func TestGatewaySplit(t *testing.T) {
+	// Create a stable and a canary version
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stable " + r.URL.Path))
+	}))
+	defer stable.Close()
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("canary " + r.URL.Path))
+	}))
+	defer canary.Close()
+
+	// Create a gateway sending all traffic to the stable version
+	configContent := `{
+		"routes": [
+			{
+				"path": "/api/users",
+				"methods": ["GET"],
+				"split": {
+					"groups": [
+						{"name": "stable", "target": %q, "weight": %d},
+						{"name": "canary", "target": %q, "weight": %d}
+					],
+					"sticky": "cookie",
+					"forceHeader": "X-Canary"
+				}
+			}
+		],
+		"admin": {"apiKey": "admin-secret"}
+	}`
+	configPath := writeTestConfig(t, fmt.Sprintf(configContent, stable.URL, 100, canary.URL, 0))
+	gw, err := New(configPath, logger.INFO)
+	if err != nil {
+		t.Fatalf("Failed to create gateway: %v", err)
+	}
+	handler := gw.Handler()
+
+	send := func(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// All requests go to the stable version unless forced
+	w := send("GET", "/api/users/1", "", nil)
+	if w.Body.String() != "stable /1" {
+		t.Errorf("body = %q, want %q", w.Body.String(), "stable /1")
+	}
+	if cookie := w.Header().Get("Set-Cookie"); !strings.HasPrefix(cookie, defaultSplitCookie+"=stable") {
+		t.Errorf("Set-Cookie = %q, want the stable group", cookie)
+	}
+	if w := send("GET", "/api/users/1", "", http.Header{"X-Canary": {"canary"}}); w.Body.String() != "canary /1" {
+		t.Errorf("forced body = %q, want %q", w.Body.String(), "canary /1")
+	}
+
+	// Shift all traffic through the admin API
+	w = send("PUT", "/_admin/weights?route=/api/users", `{"weights": {"canary": 100}}`, http.Header{AdminKeyHeader: {"admin-secret"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin status code = %v, want %v: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if w := send("GET", "/api/users/1", "", nil); w.Body.String() != "canary /1" {
+		t.Errorf("body = %q, want %q", w.Body.String(), "canary /1")
+	}
+	if w := send("PUT", "/_admin/weights?route=/api/users", `{"weights": {"beta": 100}}`, http.Header{AdminKeyHeader: {"admin-secret"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown group status code = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	// Shift it back by reloading the configuration
+	if err := os.WriteFile(configPath, []byte(fmt.Sprintf(configContent, stable.URL, 100, canary.URL, 0)), 0o644); err != nil {
+		t.Fatalf("Failed to write configuration: %v", err)
+	}
+	if err := gw.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if w := send("GET", "/api/users/1", "", nil); w.Body.String() != "stable /1" {
+		t.Errorf("body = %q, want %q", w.Body.String(), "stable /1")
+	}
+	w = send("GET", "/_admin/weights", "", http.Header{AdminKeyHeader: {"admin-secret"}})
+	if want := `{"routes":{"/api/users":{"canary":0,"stable":100}}}`; strings.TrimSpace(w.Body.String()) != want {
+		t.Errorf("weights = %s, want %s", w.Body.String(), want)
+	}
+}
@@ -0,0 +1,189 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mstgnz/goteway/pkg/middleware"
+)
+
+// templatePart represents a literal or a variable of a template
+type templatePart struct {
+	literal string
+	kind    string // variable kind, empty for literals
+	name    string // variable name, for kinds taking one
+}
+
+// valueTemplate represents a string with ${...} variables filled in from a
+// request. Variables are:
+//
+//	${param.<name>}   parameter captured from the route path
+//	${query.<name>}   query parameter
+//	${header.<name>}  request header
+//	${env.<name>}     environment variable
+//	${client_ip}      resolved client IP
+//	${principal}      authenticated principal
+//	${consumer}       resolved consumer ID
+//	${request_id}     ID from the X-Request-ID header
+//	${method}, ${host}, ${path}
+type valueTemplate struct {
+	parts []templatePart
+}
+
+// templateKinds are the variable kinds and whether they take a name
+var templateKinds = map[string]bool{
+	"param":      true,
+	"query":      true,
+	"header":     true,
+	"env":        true,
+	"client_ip":  false,
+	"principal":  false,
+	"consumer":   false,
+	"request_id": false,
+	"method":     false,
+	"host":       false,
+	"path":       false,
+}
+
+// parseTemplate parses a template
+func parseTemplate(text string) (*valueTemplate, error) {
+	t := &valueTemplate{}
+	for text != "" {
+		start := strings.Index(text, "${")
+		if start < 0 {
+			t.parts = append(t.parts, templatePart{literal: text})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{literal: text[:start]})
+		}
+
+		end := strings.IndexByte(text[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated template variable in %q", text)
+		}
+		variable := text[start+2 : start+end]
+		text = text[start+end+1:]
+
+		kind, name, _ := strings.Cut(variable, ".")
+		needsName, ok := templateKinds[kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown template variable: %s", variable)
+		}
+		if needsName != (name != "") {
+			return nil, fmt.Errorf("invalid template variable: %s", variable)
+		}
+		t.parts = append(t.parts, templatePart{kind: kind, name: name})
+	}
+
+	return t, nil
+}
+
+// execute fills in the template from a request. Variable values are passed
+// through escape, if given.
+func (t *valueTemplate) execute(r *http.Request, escape func(string) string) string {
+	var b strings.Builder
+	for _, part := range t.parts {
+		if part.kind == "" {
+			b.WriteString(part.literal)
+			continue
+		}
+
+		value := templateValue(r, part.kind, part.name)
+		if escape != nil {
+			value = escape(value)
+		}
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
+// executePath fills in a path template from a request and returns its escaped
+// path and raw query, which starts after the first "?" of the template. Values
+// in the path are escaped as single path segments, except for the wildcard
+// tail parameter named tail and ${path}, which keep their slashes. Values
+// holding "." or ".." segments are rejected, so they cannot leave the
+// template's path. Values in the query are escaped as query components, so
+// they cannot add parameters.
+func (t *valueTemplate) executePath(r *http.Request, tail string) (string, string, error) {
+	var b, query strings.Builder
+	inQuery := false
+	for _, part := range t.parts {
+		if part.kind == "" {
+			literal := part.literal
+			if !inQuery {
+				before, after, found := strings.Cut(literal, "?")
+				b.WriteString(before)
+				if !found {
+					continue
+				}
+				inQuery = true
+				literal = after
+			}
+			query.WriteString(literal)
+			continue
+		}
+
+		value := templateValue(r, part.kind, part.name)
+		if inQuery {
+			query.WriteString(url.QueryEscape(value))
+			continue
+		}
+		segments := []string{value}
+		if part.kind == "path" || part.kind == "param" && part.name == tail {
+			segments = strings.Split(value, "/")
+		}
+		for i, segment := range segments {
+			if segment == "." || segment == ".." {
+				return "", "", fmt.Errorf("dot segment in path variable %s", part.kind+"."+part.name)
+			}
+			segments[i] = url.PathEscape(segment)
+		}
+		b.WriteString(strings.Join(segments, "/"))
+	}
+	return b.String(), query.String(), nil
+}
+
+// uses reports whether the template has a variable of the given kind
+func (t *valueTemplate) uses(kind string) bool {
+	for _, part := range t.parts {
+		if part.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// templateValue returns the value of a template variable
+func templateValue(r *http.Request, kind, name string) string {
+	switch kind {
+	case "param":
+		return middleware.PathParam(r, name)
+	case "query":
+		return r.URL.Query().Get(name)
+	case "header":
+		return r.Header.Get(name)
+	case "env":
+		return os.Getenv(name)
+	case "client_ip":
+		return middleware.ClientIP(r)
+	case "principal":
+		return middleware.Principal(r)
+	case "consumer":
+		if consumer := middleware.ConsumerFrom(r); consumer != nil {
+			return consumer.ID
+		}
+	case "request_id":
+		return r.Header.Get(RequestIDHeader)
+	case "method":
+		return r.Method
+	case "host":
+		return r.Host
+	case "path":
+		return r.URL.Path
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mstgnz/goteway/pkg/middleware"
+)
+
+func TestParseTemplateErrors(t *testing.T) {
+	for _, text := range []string{"${param", "${param}", "${method.name}", "${cookie.session}"} {
+		if _, err := parseTemplate(text); err == nil {
+			t.Errorf("parseTemplate(%q) error = nil, want error", text)
+		}
+	}
+}
+
+func TestTemplateExecute(t *testing.T) {
+	t.Setenv("GOTEWAY_TEST_REGION", "eu")
+
+	// Create a request
+	req := httptest.NewRequest("POST", "http://example.com/users/42?page=2", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set(RequestIDHeader, "req-1")
+	req = middleware.WithPathParams(req, map[string]string{"id": "42"})
+	req = middleware.WithConsumer(req, &middleware.Consumer{ID: "globex"})
+
+	// Test cases
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "plain", want: "plain"},
+		{text: "/users/${param.id}/page/${query.page}", want: "/users/42/page/2"},
+		{text: "${header.X-Tenant}-${env.GOTEWAY_TEST_REGION}", want: "acme-eu"},
+		{text: "${method} ${host}${path}", want: "POST example.com/users/42"},
+		{text: "id=${request_id}", want: "id=req-1"},
+		{text: "${consumer}:${principal}:${param.missing}", want: "globex::"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			template, err := parseTemplate(tt.text)
+			if err != nil {
+				t.Fatalf("parseTemplate() error = %v", err)
+			}
+			if got := template.execute(req, nil); got != tt.want {
+				t.Errorf("execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
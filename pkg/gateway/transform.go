@@ -0,0 +1,431 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mstgnz/goteway/pkg/config"
+)
+
+// defaultMaxTransformSize is the default size above which bodies are not transformed
+const defaultMaxTransformSize = 1 << 20
+
+// fieldPath represents a dot-separated path into a JSON document. A "*"
+// segment stands for every element of an array or object.
+type fieldPath []string
+
+// fieldMove represents a field moved or renamed to another path
+type fieldMove struct {
+	from, to fieldPath
+}
+
+// fieldValue represents a value set at a path
+type fieldValue struct {
+	path  fieldPath
+	value json.RawMessage // decoded for every document so that documents share nothing
+}
+
+// arrayFilter represents a filter keeping the elements of arrays whose fields
+// have the given values
+type arrayFilter struct {
+	path  fieldPath
+	where []fieldCondition
+}
+
+// fieldCondition represents a field value an element has to have
+type fieldCondition struct {
+	path  fieldPath
+	value any
+}
+
+// bodyTransform represents the transformations of a JSON body, applied in the
+// order unwrap, remove, rename, move, set, filter and wrap
+type bodyTransform struct {
+	maxSize int64
+	unwrap  fieldPath
+	remove  []fieldPath
+	rename  []fieldMove
+	move    []fieldMove
+	set     []fieldValue
+	filter  []arrayFilter
+	wrap    string
+}
+
+// newBodyTransform creates a body transform from its configuration
+func newBodyTransform(cfg *config.BodyTransformConfig, maxSize int64) (*bodyTransform, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxTransformSize
+	}
+
+	var err error
+	t := &bodyTransform{maxSize: maxSize, wrap: cfg.Wrap}
+	if cfg.Unwrap != "" {
+		if t.unwrap, err = parseFieldPath(cfg.Unwrap); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range cfg.Remove {
+		p, err := parseFieldPath(path)
+		if err != nil {
+			return nil, err
+		}
+		t.remove = append(t.remove, p)
+	}
+
+	for _, from := range slices.Sorted(maps.Keys(cfg.Rename)) {
+		p, err := parseFieldPath(from)
+		if err != nil {
+			return nil, err
+		}
+		to := cfg.Rename[from]
+		if to == "" || strings.Contains(to, ".") {
+			return nil, fmt.Errorf("invalid new name of field %s: %q", from, to)
+		}
+		t.rename = append(t.rename, fieldMove{from: p, to: fieldPath{to}})
+	}
+
+	for _, from := range slices.Sorted(maps.Keys(cfg.Move)) {
+		p, err := parseFieldPath(from)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseFieldPath(cfg.Move[from])
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(p, "*") || slices.Contains(to, "*") {
+			return nil, fmt.Errorf("moved field paths cannot contain wildcards: %s", from)
+		}
+		t.move = append(t.move, fieldMove{from: p, to: to})
+	}
+
+	for _, path := range slices.Sorted(maps.Keys(cfg.Set)) {
+		p, err := parseFieldPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(cfg.Set[path]) {
+			return nil, fmt.Errorf("invalid value of field %s", path)
+		}
+		t.set = append(t.set, fieldValue{path: p, value: cfg.Set[path]})
+	}
+
+	for _, filterConfig := range cfg.Filter {
+		filter := arrayFilter{}
+		if filterConfig.Path != "" {
+			if filter.path, err = parseFieldPath(filterConfig.Path); err != nil {
+				return nil, err
+			}
+		}
+		for _, field := range slices.Sorted(maps.Keys(filterConfig.Where)) {
+			p, err := parseFieldPath(field)
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeJSON(filterConfig.Where[field])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of filter field %s: %w", field, err)
+			}
+			filter.where = append(filter.where, fieldCondition{path: p, value: value})
+		}
+		t.filter = append(t.filter, filter)
+	}
+
+	return t, nil
+}
+
+// transformRequest transforms the JSON body of a request
+func (t *bodyTransform) transformRequest(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody || !isJSON(r.Header) {
+		return nil
+	}
+
+	body, ok, err := t.transformBody(r.Body, r.ContentLength)
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	if ok {
+		r.ContentLength = int64(body.(*transformedBody).Len())
+		r.TransferEncoding = nil
+	}
+	return nil
+}
+
+// transformResponse transforms the JSON body of a response
+func (t *bodyTransform) transformResponse(resp *http.Response) error {
+	if resp.Body == nil || !isJSON(resp.Header) {
+		return nil
+	}
+
+	body, ok, err := t.transformBody(resp.Body, resp.ContentLength)
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	if ok {
+		resp.ContentLength = int64(body.(*transformedBody).Len())
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		resp.TransferEncoding = nil
+		// The upstream validator does not describe the new body
+		resp.Header.Del("Etag")
+	}
+	return nil
+}
+
+// transformedBody represents a transformed body held in memory
+type transformedBody struct {
+	*bytes.Reader
+}
+
+// Close implements io.Closer
+func (b *transformedBody) Close() error {
+	return nil
+}
+
+// transformBody reads and transforms a body. Bodies larger than the size cap
+// or not holding valid JSON are returned untouched, streaming the part not
+// read yet, and the result reports false.
+func (t *bodyTransform) transformBody(body io.ReadCloser, contentLength int64) (io.ReadCloser, bool, error) {
+	if contentLength > t.maxSize {
+		return body, false, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, t.maxSize+1))
+	if err != nil {
+		body.Close()
+		return nil, false, err
+	}
+	if int64(len(data)) > t.maxSize {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}, false, nil
+	}
+	body.Close()
+
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return &transformedBody{bytes.NewReader(data)}, false, nil
+	}
+	out, err := encodeJSON(t.apply(doc))
+	if err != nil {
+		return nil, false, err
+	}
+	return &transformedBody{bytes.NewReader(out)}, true, nil
+}
+
+// apply transforms a decoded JSON document and returns the result
+func (t *bodyTransform) apply(doc any) any {
+	if t.unwrap != nil {
+		if values := lookupFields(doc, t.unwrap); len(values) == 1 {
+			doc = values[0]
+		}
+	}
+
+	for _, path := range t.remove {
+		forEachParent(doc, path, false, func(parent map[string]any, name string) {
+			delete(parent, name)
+		})
+	}
+
+	for _, rename := range t.rename {
+		forEachParent(doc, rename.from, false, func(parent map[string]any, name string) {
+			if value, ok := parent[name]; ok {
+				delete(parent, name)
+				parent[rename.to[0]] = value
+			}
+		})
+	}
+
+	for _, move := range t.move {
+		values := lookupFields(doc, move.from)
+		if len(values) != 1 {
+			continue
+		}
+		forEachParent(doc, move.from, false, func(parent map[string]any, name string) {
+			delete(parent, name)
+		})
+		forEachParent(doc, move.to, true, func(parent map[string]any, name string) {
+			parent[name] = values[0]
+		})
+	}
+
+	for _, set := range t.set {
+		forEachParent(doc, set.path, true, func(parent map[string]any, name string) {
+			value, _ := decodeJSON(set.value)
+			parent[name] = value
+		})
+	}
+
+	for _, filter := range t.filter {
+		if len(filter.path) == 0 {
+			doc = filter.apply(doc)
+			continue
+		}
+		forEachParent(doc, filter.path, false, func(parent map[string]any, name string) {
+			if value, ok := parent[name]; ok {
+				parent[name] = filter.apply(value)
+			}
+		})
+	}
+
+	if t.wrap != "" {
+		doc = map[string]any{t.wrap: doc}
+	}
+	return doc
+}
+
+// apply returns the elements of an array matching the filter
+func (f *arrayFilter) apply(value any) any {
+	elements, ok := value.([]any)
+	if !ok {
+		return value
+	}
+
+	kept := make([]any, 0, len(elements))
+	for _, element := range elements {
+		if f.matches(element) {
+			kept = append(kept, element)
+		}
+	}
+	return kept
+}
+
+// matches reports whether an array element has all the filter's field values
+func (f *arrayFilter) matches(element any) bool {
+	for _, condition := range f.where {
+		values := lookupFields(element, condition.path)
+		if len(values) != 1 || !reflect.DeepEqual(values[0], condition.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFieldPath parses a dot-separated field path
+func parseFieldPath(path string) (fieldPath, error) {
+	segments := strings.Split(path, ".")
+	if slices.Contains(segments, "") {
+		return nil, fmt.Errorf("invalid field path: %q", path)
+	}
+	return segments, nil
+}
+
+// lookupFields returns the values found at a path
+func lookupFields(doc any, path fieldPath) []any {
+	nodes := []any{doc}
+	for _, segment := range path {
+		nodes = childNodes(nodes, segment, false)
+	}
+	return nodes
+}
+
+// forEachParent calls fn with every object holding a field at path and the
+// name of the field. Missing objects on the way are created if create is set.
+func forEachParent(doc any, path fieldPath, create bool, fn func(parent map[string]any, name string)) {
+	nodes := []any{doc}
+	for _, segment := range path[:len(path)-1] {
+		nodes = childNodes(nodes, segment, create)
+	}
+
+	name := path[len(path)-1]
+	for _, node := range nodes {
+		parent, ok := node.(map[string]any)
+		if !ok {
+			continue
+		}
+		if name != "*" {
+			fn(parent, name)
+			continue
+		}
+		for _, key := range slices.Collect(maps.Keys(parent)) {
+			fn(parent, key)
+		}
+	}
+}
+
+// childNodes returns the children of nodes selected by a path segment
+func childNodes(nodes []any, segment string, create bool) []any {
+	var children []any
+	for _, node := range nodes {
+		switch node := node.(type) {
+		case map[string]any:
+			if segment == "*" {
+				for _, child := range node {
+					children = append(children, child)
+				}
+				continue
+			}
+			child, ok := node[segment]
+			if !ok && create {
+				child = map[string]any{}
+				node[segment] = child
+				ok = true
+			}
+			if ok {
+				children = append(children, child)
+			}
+		case []any:
+			if segment == "*" {
+				children = append(children, node...)
+				continue
+			}
+			if i, err := strconv.Atoi(segment); err == nil && i >= 0 && i < len(node) {
+				children = append(children, node[i])
+			}
+		}
+	}
+	return children
+}
+
+// isJSON reports whether a header describes an unencoded JSON body
+func isJSON(header http.Header) bool {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// decodeJSON decodes a JSON document, keeping numbers as they are written
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON document")
+	}
+	return doc, nil
+}
+
+// encodeJSON encodes a JSON document without escaping HTML characters
+func encodeJSON(doc any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
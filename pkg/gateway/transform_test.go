@@ -0,0 +1,200 @@
+package gateway
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mstgnz/goteway/pkg/config"
+)
+
+func TestNewBodyTransformErrors(t *testing.T) {
+	for _, cfg := range []*config.BodyTransformConfig{
+		{Remove: []string{"a..b"}},
+		{Rename: map[string]string{"a": "b.c"}},
+		{Move: map[string]string{"items.*.id": "ids"}},
+		{Set: map[string]json.RawMessage{"a": json.RawMessage(`{`)}},
+		{Filter: []config.ArrayFilterConfig{{Path: "items", Where: map[string]json.RawMessage{"a": json.RawMessage(`x`)}}}},
+	} {
+		if _, err := newBodyTransform(cfg, 0); err == nil {
+			t.Errorf("newBodyTransform(%+v) error = nil, want error", cfg)
+		}
+	}
+}
+
+func TestBodyTransformApply(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		name string
+		cfg  config.BodyTransformConfig
+		body string
+		want string
+	}{
+		{
+			name: "remove nested and wildcard fields",
+			cfg:  config.BodyTransformConfig{Remove: []string{"internal", "items.*.secret"}},
+			body: `{"internal":1,"items":[{"id":1,"secret":"a"},{"id":2,"secret":"b"}]}`,
+			want: `{"items":[{"id":1},{"id":2}]}`,
+		},
+		{
+			name: "rename and move",
+			cfg: config.BodyTransformConfig{
+				Rename: map[string]string{"user.fname": "firstName"},
+				Move:   map[string]string{"user.id": "meta.userId"},
+			},
+			body: `{"user":{"fname":"Ada","id":12345678901234567890}}`,
+			want: `{"meta":{"userId":12345678901234567890},"user":{"firstName":"Ada"}}`,
+		},
+		{
+			name: "set values",
+			cfg:  config.BodyTransformConfig{Set: map[string]json.RawMessage{"meta.version": json.RawMessage(`2`), "tags": json.RawMessage(`["a"]`)}},
+			body: `{"name":"<x>"}`,
+			want: `{"meta":{"version":2},"name":"<x>","tags":["a"]}`,
+		},
+		{
+			name: "unwrap and wrap",
+			cfg:  config.BodyTransformConfig{Unwrap: "data.result", Wrap: "payload"},
+			body: `{"data":{"result":[1,2]},"status":"ok"}`,
+			want: `{"payload":[1,2]}`,
+		},
+		{
+			name: "filter arrays",
+			cfg: config.BodyTransformConfig{Filter: []config.ArrayFilterConfig{
+				{Path: "items", Where: map[string]json.RawMessage{"status": json.RawMessage(`"active"`), "owner.id": json.RawMessage(`1`)}},
+			}},
+			body: `{"items":[{"status":"active","owner":{"id":1}},{"status":"active","owner":{"id":2}},{"status":"deleted","owner":{"id":1}}]}`,
+			want: `{"items":[{"owner":{"id":1},"status":"active"}]}`,
+		},
+		{
+			name: "filter the body",
+			cfg:  config.BodyTransformConfig{Filter: []config.ArrayFilterConfig{{Where: map[string]json.RawMessage{"ok": json.RawMessage(`true`)}}}},
+			body: `[{"ok":true},{"ok":false},3]`,
+			want: `[{"ok":true}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transform, err := newBodyTransform(&tt.cfg, 0)
+			if err != nil {
+				t.Fatalf("newBodyTransform() error = %v", err)
+			}
+			doc, err := decodeJSON([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("decodeJSON() error = %v", err)
+			}
+			got, err := encodeJSON(transform.apply(doc))
+			if err != nil {
+				t.Fatalf("encodeJSON() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("apply() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayTransform(t *testing.T) {
+	// Create a test server echoing the request body and its length
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Received-Length", strconv.FormatInt(r.ContentLength, 10))
+		w.Header().Set("Etag", `"v1"`)
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	// Create a gateway transforming the bodies
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{
+				"path": "/api",
+				"target": %q,
+				"methods": ["POST"],
+				"transform": {
+					"request": {"rename": {"name": "full_name"}, "wrap": "data"},
+					"response": {"unwrap": "data", "remove": ["password"]},
+					"maxBodySize": 64
+				}
+			}
+		]
+	}`, ts.URL))
+	handler := gw.Handler()
+
+	send := func(body, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Check that both bodies are transformed with correct lengths
+	w := send(`{"name":"Ada","password":"x"}`, "application/json; charset=utf-8")
+	if got, want := w.Body.String(), `{"full_name":"Ada"}`; got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+	if got, want := w.Header().Get("X-Received-Length"), strconv.Itoa(len(`{"data":{"full_name":"Ada","password":"x"}}`)); got != want {
+		t.Errorf("upstream content length = %s, want %s", got, want)
+	}
+	if got, want := w.Header().Get("Content-Length"), strconv.Itoa(w.Body.Len()); got != want {
+		t.Errorf("Content-Length = %s, want %s", got, want)
+	}
+	if w.Header().Get("Etag") != "" {
+		t.Error("Etag of the transformed response is kept")
+	}
+
+	// Check that large and non-JSON bodies pass untouched
+	large := `{"name":"` + strings.Repeat("a", 100) + `"}`
+	for _, tt := range []struct{ body, contentType string }{
+		{body: large, contentType: "application/json"},
+		{body: `{"name":"Ada"}`, contentType: "text/plain"},
+		{body: `{"name":`, contentType: "application/json"},
+	} {
+		if w := send(tt.body, tt.contentType); w.Body.String() != tt.body {
+			t.Errorf("body = %s, want %s", w.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestGatewayTransformCompressed(t *testing.T) {
+	// Create a test server compressing its responses when the client accepts it
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		body := []byte(`{"name":"Ada","secret":"s3cret"}`)
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write(body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write(body)
+		gz.Close()
+	}))
+	defer ts.Close()
+
+	gw := newTestGateway(t, fmt.Sprintf(`{
+		"routes": [
+			{"path": "/api", "target": %q, "methods": ["GET"], "transform": {"response": {"remove": ["secret"]}}}
+		]
+	}`, ts.URL))
+
+	// A client accepting gzip still gets the transformed body
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(w, req)
+	if got, want := w.Body.String(), `{"name":"Ada"}`; got != want {
+		t.Errorf("body = %q, want %s", got, want)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q, want none", got)
+	}
+}
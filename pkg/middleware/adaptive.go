@@ -0,0 +1,256 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+const (
+	// AIMD grows the limit by one while latency is fine and cuts it by a ratio when it is not
+	AIMD = "aimd"
+	// Gradient scales the limit by the ratio of long-term to current latency
+	Gradient = "gradient"
+)
+
+// gradientSmoothing is the weight of a sample in the long-term latency average,
+// averaging over about the last 600 requests
+const gradientSmoothing = 2.0 / 601
+
+// AdaptiveLimiterConfig represents the settings of an adaptive concurrency limiter
+type AdaptiveLimiterConfig struct {
+	Algorithm        string        // AIMD (default) or Gradient
+	InitialLimit     int           // defaults to 20
+	MinLimit         int           // defaults to 1
+	MaxLimit         int           // defaults to 1000
+	LatencyThreshold time.Duration // AIMD: responses slower than this count as overload, defaults to 1s
+	BackoffRatio     float64       // AIMD: factor the limit is cut by on overload, defaults to 0.9
+	Tolerance        float64       // Gradient: latency increase tolerated before shrinking, defaults to 1.5
+}
+
+// AdaptiveLimiter represents a concurrency limit that adjusts itself to the
+// latency observed for the requests it admits, similar to Netflix's
+// concurrency-limits. It is safe for concurrent use.
+type AdaptiveLimiter struct {
+	config   AdaptiveLimiterConfig
+	limit    float64
+	inFlight int
+	longRTT  float64 // exponentially smoothed latency in seconds, for the gradient algorithm
+	mu       sync.Mutex
+}
+
+// NewAdaptiveLimiter creates a new adaptive concurrency limiter
+func NewAdaptiveLimiter(config AdaptiveLimiterConfig) (*AdaptiveLimiter, error) {
+	switch config.Algorithm {
+	case "":
+		config.Algorithm = AIMD
+	case AIMD, Gradient:
+	default:
+		return nil, fmt.Errorf("unknown adaptive concurrency algorithm: %s", config.Algorithm)
+	}
+	if config.MinLimit <= 0 {
+		config.MinLimit = 1
+	}
+	if config.MaxLimit <= 0 {
+		config.MaxLimit = 1000
+	}
+	if config.InitialLimit <= 0 {
+		config.InitialLimit = 20
+	}
+	if config.MinLimit > config.MaxLimit {
+		return nil, fmt.Errorf("minimum limit %d exceeds maximum limit %d", config.MinLimit, config.MaxLimit)
+	}
+	config.InitialLimit = min(max(config.InitialLimit, config.MinLimit), config.MaxLimit)
+	if config.LatencyThreshold <= 0 {
+		config.LatencyThreshold = time.Second
+	}
+	if config.BackoffRatio <= 0 || config.BackoffRatio >= 1 {
+		config.BackoffRatio = 0.9
+	}
+	if config.Tolerance < 1 {
+		config.Tolerance = 1.5
+	}
+
+	return &AdaptiveLimiter{
+		config: config,
+		limit:  float64(config.InitialLimit),
+	}, nil
+}
+
+// Limit returns the current concurrency limit
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// InFlight returns the number of admitted requests that have not finished
+func (l *AdaptiveLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// Acquire admits a request if the limit allows it. Admitted requests have to
+// be reported with Release.
+func (l *AdaptiveLimiter) Acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight >= int(l.limit) {
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+// Release reports the latency of an admitted request and whether the upstream
+// was overloaded, and adjusts the limit accordingly
+func (l *AdaptiveLimiter) Release(latency time.Duration, overloaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	inFlight := l.inFlight
+	l.inFlight--
+
+	switch l.config.Algorithm {
+	case Gradient:
+		l.gradient(latency.Seconds(), inFlight)
+	default:
+		l.aimd(latency, overloaded, inFlight)
+	}
+	l.limit = math.Min(math.Max(l.limit, float64(l.config.MinLimit)), float64(l.config.MaxLimit))
+}
+
+// aimd increases the limit additively and decreases it multiplicatively. The
+// limiter must be locked.
+func (l *AdaptiveLimiter) aimd(latency time.Duration, overloaded bool, inFlight int) {
+	if overloaded || latency > l.config.LatencyThreshold {
+		l.limit *= l.config.BackoffRatio
+		return
+	}
+
+	// Only grow while the limit is actually being used
+	if float64(inFlight)*2 >= l.limit {
+		l.limit++
+	}
+}
+
+// gradient scales the limit by how much the current latency deviates from the
+// long-term average, allowing a small queue of sqrt(limit) requests. The
+// limiter must be locked.
+func (l *AdaptiveLimiter) gradient(rtt float64, inFlight int) {
+	if rtt <= 0 {
+		return
+	}
+	if l.longRTT == 0 {
+		l.longRTT = rtt
+	}
+	l.longRTT += (rtt - l.longRTT) * gradientSmoothing
+
+	// Do not grow a limit that is not being used
+	if float64(inFlight)*2 < l.limit && rtt <= l.longRTT {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, l.config.Tolerance*l.longRTT/rtt))
+	newLimit := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = l.limit*0.8 + newLimit*0.2
+}
+
+// upstreamLatency records the longest time the upstreams of a request took to answer
+type upstreamLatency struct {
+	nanos atomic.Int64
+}
+
+// observe records the time an upstream took to answer
+func (u *upstreamLatency) observe(latency time.Duration) {
+	for {
+		current := u.nanos.Load()
+		if int64(latency) <= current || u.nanos.CompareAndSwap(current, int64(latency)) {
+			return
+		}
+	}
+}
+
+// upstreamTransport represents a transport recording the upstream latency of requests
+type upstreamTransport struct {
+	next http.RoundTripper
+}
+
+// UpstreamTransport wraps a transport, http.DefaultTransport if nil, to record
+// how long upstreams take to answer with their response headers, so the
+// adaptive concurrency middleware does not count the time spent writing the
+// response to slow clients.
+func UpstreamTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &upstreamTransport{next: next}
+}
+
+// RoundTrip sends the request and records the time until the response headers arrived
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	latency, ok := req.Context().Value(upstreamLatencyKey).(*upstreamLatency)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	latency.observe(time.Since(start))
+	return resp, err
+}
+
+// AdaptiveConcurrencyMiddleware creates a middleware that limits the requests
+// in flight to the adaptive limit. It measures the latency of the upstreams
+// reached through an UpstreamTransport, or of the wrapped handler if there are
+// none. Excess requests are rejected with 503. Responses with status 502, 503
+// or 504 count as overload. The current limit is published in the
+// adaptive_concurrency_limit gauge labeled with name.
+func AdaptiveConcurrencyMiddleware(limiter *AdaptiveLimiter, name string, registry *stats.Registry, log *logger.Logger) Middleware {
+	var gauge *stats.Gauge
+	if registry != nil {
+		gauge = registry.Gauge("adaptive_concurrency_limit", "route", name)
+		gauge.Set(float64(limiter.Limit()))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !limiter.Acquire() {
+				log.Warn("Adaptive concurrency limit of %s reached, rejecting %s %s", name, r.Method, r.URL.Path)
+				WriteError(w, http.StatusServiceUnavailable, "overloaded", "Too many requests in flight")
+				return
+			}
+
+			rw := &responseWriter{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
+			upstream := &upstreamLatency{}
+			r = r.WithContext(context.WithValue(r.Context(), upstreamLatencyKey, upstream))
+			start := time.Now()
+			defer func() {
+				latency := time.Duration(upstream.nanos.Load())
+				if latency == 0 {
+					latency = time.Since(start)
+				}
+				overloaded := rw.statusCode == http.StatusBadGateway ||
+					rw.statusCode == http.StatusServiceUnavailable ||
+					rw.statusCode == http.StatusGatewayTimeout
+				limiter.Release(latency, overloaded)
+				if gauge != nil {
+					gauge.Set(float64(limiter.Limit()))
+				}
+			}()
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
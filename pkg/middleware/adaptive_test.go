@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+func TestNewAdaptiveLimiterErrors(t *testing.T) {
+	if _, err := NewAdaptiveLimiter(AdaptiveLimiterConfig{Algorithm: "vegas"}); err == nil {
+		t.Error("NewAdaptiveLimiter() with an unknown algorithm succeeded")
+	}
+	if _, err := NewAdaptiveLimiter(AdaptiveLimiterConfig{MinLimit: 10, MaxLimit: 5}); err == nil {
+		t.Error("NewAdaptiveLimiter() with min above max succeeded")
+	}
+}
+
+func TestAdaptiveLimiterAIMD(t *testing.T) {
+	limiter, err := NewAdaptiveLimiter(AdaptiveLimiterConfig{
+		InitialLimit:     10,
+		MinLimit:         2,
+		MaxLimit:         12,
+		LatencyThreshold: 100 * time.Millisecond,
+		BackoffRatio:     0.5,
+	})
+	if err != nil {
+		t.Fatalf("NewAdaptiveLimiter() error = %v", err)
+	}
+
+	// The limit only grows while it is being used
+	limiter.Acquire()
+	limiter.Release(10*time.Millisecond, false)
+	if got := limiter.Limit(); got != 10 {
+		t.Errorf("Limit() after idle sample = %v, want %v", got, 10)
+	}
+
+	// Fast responses under load grow the limit up to the maximum
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 6; j++ {
+			limiter.Acquire()
+		}
+		for j := 0; j < 6; j++ {
+			limiter.Release(10*time.Millisecond, false)
+		}
+	}
+	if got := limiter.Limit(); got != 12 {
+		t.Errorf("Limit() after fast samples = %v, want %v", got, 12)
+	}
+
+	// Slow responses and overload shrink it down to the minimum
+	limiter.Acquire()
+	limiter.Release(time.Second, false)
+	if got := limiter.Limit(); got != 6 {
+		t.Errorf("Limit() after slow sample = %v, want %v", got, 6)
+	}
+	for i := 0; i < 5; i++ {
+		limiter.Acquire()
+		limiter.Release(time.Millisecond, true)
+	}
+	if got := limiter.Limit(); got != 2 {
+		t.Errorf("Limit() after overload = %v, want %v", got, 2)
+	}
+
+	// Requests beyond the limit are not admitted
+	if !limiter.Acquire() || !limiter.Acquire() {
+		t.Fatal("Acquire() within the limit failed")
+	}
+	if limiter.Acquire() {
+		t.Error("Acquire() beyond the limit succeeded")
+	}
+}
+
+func TestAdaptiveLimiterGradient(t *testing.T) {
+	limiter, err := NewAdaptiveLimiter(AdaptiveLimiterConfig{Algorithm: Gradient, InitialLimit: 20, MaxLimit: 100})
+	if err != nil {
+		t.Fatalf("NewAdaptiveLimiter() error = %v", err)
+	}
+
+	busy := func(latency time.Duration, samples int) {
+		for i := 0; i < samples; i++ {
+			for j := 0; j < limiter.Limit(); j++ {
+				limiter.Acquire()
+			}
+			for limiter.InFlight() > 0 {
+				limiter.Release(latency, false)
+			}
+		}
+	}
+
+	// Steady latency under load grows the limit
+	busy(10*time.Millisecond, 10)
+	grown := limiter.Limit()
+	if grown <= 20 {
+		t.Errorf("Limit() at steady latency = %v, want above %v", grown, 20)
+	}
+
+	// A sharp latency increase shrinks it
+	busy(200*time.Millisecond, 3)
+	if got := limiter.Limit(); got >= grown {
+		t.Errorf("Limit() after latency increase = %v, want below %v", got, grown)
+	}
+}
+
+func TestAdaptiveConcurrencyMiddleware(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a handler that reports overload
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	// Apply the adaptive concurrency middleware
+	limiter, _ := NewAdaptiveLimiter(AdaptiveLimiterConfig{InitialLimit: 4, BackoffRatio: 0.5})
+	registry := stats.NewRegistry()
+	wrappedHandler := AdaptiveConcurrencyMiddleware(limiter, "/api", registry, log)(handler)
+
+	wrappedHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/api", nil))
+
+	// The limit shrinks and is published
+	if got := registry.Gauge("adaptive_concurrency_limit", "route", "/api").Value(); got != 2 {
+		t.Errorf("adaptive_concurrency_limit = %v, want %v", got, 2)
+	}
+	if limiter.InFlight() != 0 {
+		t.Errorf("InFlight() = %v, want %v", limiter.InFlight(), 0)
+	}
+}
+
+func TestAdaptiveConcurrencyUpstreamLatency(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a fast upstream
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	client := &http.Client{Transport: UpstreamTransport(nil)}
+
+	// Test cases
+	tests := []struct {
+		name      string
+		upstream  bool
+		wantLimit int
+	}{
+		{name: "slow client of a fast upstream", upstream: true, wantLimit: 4},
+		{name: "slow handler without upstream", upstream: false, wantLimit: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a handler that takes long after the upstream answered
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.upstream {
+					req, _ := http.NewRequestWithContext(r.Context(), "GET", upstream.URL, nil)
+					resp, err := client.Do(req)
+					if err != nil {
+						t.Errorf("upstream request error = %v", err)
+						return
+					}
+					resp.Body.Close()
+				}
+				time.Sleep(50 * time.Millisecond)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// Only the upstream latency counts against the threshold
+			limiter, _ := NewAdaptiveLimiter(AdaptiveLimiterConfig{InitialLimit: 4, LatencyThreshold: 20 * time.Millisecond, BackoffRatio: 0.5})
+			AdaptiveConcurrencyMiddleware(limiter, "/api", nil, log)(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/api", nil))
+			if got := limiter.Limit(); got != tt.wantLimit {
+				t.Errorf("Limit() = %v, want %v", got, tt.wantLimit)
+			}
+		})
+	}
+}
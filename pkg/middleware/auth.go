@@ -1,9 +1,13 @@
 package middleware
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/mstgnz/goteway/pkg/logger"
 )
@@ -25,6 +29,19 @@ type Authenticator interface {
 	Authenticate(r *http.Request) bool
 }
 
+// Identity represents the authenticated caller of a request
+type Identity struct {
+	Principal string         // user name or token subject
+	Claims    map[string]any // token claims, if any
+}
+
+// IdentityAuthenticator represents an authenticator that can tell who the caller is
+type IdentityAuthenticator interface {
+	Authenticator
+	// Identify authenticates a request and returns the identity of the caller
+	Identify(r *http.Request) (*Identity, bool)
+}
+
 // BasicAuthenticator represents a basic authenticator
 type BasicAuthenticator struct {
 	username string
@@ -43,28 +60,37 @@ func NewBasicAuthenticator(username, password string, log *logger.Logger) *Basic
 
 // Authenticate authenticates a request using basic authentication
 func (a *BasicAuthenticator) Authenticate(r *http.Request) bool {
+	_, ok := a.Identify(r)
+	return ok
+}
+
+// Identify authenticates a request using basic authentication and returns the user
+func (a *BasicAuthenticator) Identify(r *http.Request) (*Identity, bool) {
 	auth := r.Header.Get("Authorization")
 	if auth == "" {
-		return false
+		return nil, false
 	}
 
 	const prefix = "Basic "
 	if !strings.HasPrefix(auth, prefix) {
-		return false
+		return nil, false
 	}
 
 	payload, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
 	if err != nil {
 		a.log.Error("Failed to decode basic auth: %v", err)
-		return false
+		return nil, false
 	}
 
 	pair := strings.SplitN(string(payload), ":", 2)
 	if len(pair) != 2 {
-		return false
+		return nil, false
 	}
 
-	return pair[0] == a.username && pair[1] == a.password
+	if pair[0] != a.username || pair[1] != a.password {
+		return nil, false
+	}
+	return &Identity{Principal: pair[0]}, true
 }
 
 // APIKeyAuthenticator represents an API key authenticator
@@ -89,12 +115,104 @@ func (a *APIKeyAuthenticator) Authenticate(r *http.Request) bool {
 	return key == a.key
 }
 
-// AuthMiddleware creates a middleware that authenticates requests
+// JWTAuthenticator represents a JWT bearer token authenticator for HS256 signed tokens
+type JWTAuthenticator struct {
+	secret []byte
+	log    *logger.Logger
+}
+
+// NewJWTAuthenticator creates a new JWT authenticator
+func NewJWTAuthenticator(secret string, log *logger.Logger) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		secret: []byte(secret),
+		log:    log,
+	}
+}
+
+// Authenticate authenticates a request using a JWT bearer token
+func (a *JWTAuthenticator) Authenticate(r *http.Request) bool {
+	_, ok := a.Identify(r)
+	return ok
+}
+
+// Identify authenticates a request using a JWT bearer token and returns its subject and claims
+func (a *JWTAuthenticator) Identify(r *http.Request) (*Identity, bool) {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return nil, false
+	}
+
+	parts := strings.Split(auth[len(prefix):], ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	// Check the algorithm before trusting anything else in the token
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		a.log.Debug("Rejected JWT with unsupported header")
+		return nil, false
+	}
+
+	// Verify the signature
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, false
+	}
+
+	// Check the validity period
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, false
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return nil, false
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, false
+	}
+
+	subject, _ := claims["sub"].(string)
+	return &Identity{Principal: subject, Claims: claims}, true
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a JWT
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// AuthMiddleware creates a middleware that authenticates requests. The identity
+// of the caller is stored in the request context when the authenticator provides it.
 func AuthMiddleware(authenticator Authenticator, log *logger.Logger) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if identifier, ok := authenticator.(IdentityAuthenticator); ok {
+				identity, ok := identifier.Identify(r)
+				if !ok {
+					log.Warn("Authentication failed for %s", ClientIP(r))
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+
+				next.ServeHTTP(w, WithIdentity(r, identity))
+				return
+			}
+
 			if !authenticator.Authenticate(r) {
-				log.Warn("Authentication failed for %s", r.RemoteAddr)
+				log.Warn("Authentication failed for %s", ClientIP(r))
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
@@ -1,9 +1,14 @@
 package middleware
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/mstgnz/goteway/pkg/logger"
 )
@@ -203,3 +208,119 @@ func TestAuthMiddleware(t *testing.T) {
 		})
 	}
 }
+
+// signJWT creates an HS256 signed token with the given claims
+func signJWT(t *testing.T, secret string, claims map[string]any) string {
+	t.Helper()
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("Failed to marshal claims: %v", err)
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create an authenticator
+	auth := NewJWTAuthenticator("secret", log)
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	// Test cases
+	tests := []struct {
+		name          string
+		authorization string
+		wantSuccess   bool
+		wantPrincipal string
+	}{
+		{
+			name:          "valid token",
+			authorization: "Bearer " + signJWT(t, "secret", map[string]any{"sub": "alice", "exp": future}),
+			wantSuccess:   true,
+			wantPrincipal: "alice",
+		},
+		{
+			name:          "wrong secret",
+			authorization: "Bearer " + signJWT(t, "other", map[string]any{"sub": "alice"}),
+			wantSuccess:   false,
+		},
+		{
+			name:          "expired",
+			authorization: "Bearer " + signJWT(t, "secret", map[string]any{"sub": "alice", "exp": past}),
+			wantSuccess:   false,
+		},
+		{
+			name:          "not yet valid",
+			authorization: "Bearer " + signJWT(t, "secret", map[string]any{"sub": "alice", "nbf": future}),
+			wantSuccess:   false,
+		},
+		{
+			name:          "unsigned token",
+			authorization: "Bearer " + base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice"}`)) + ".",
+			wantSuccess:   false,
+		},
+		{
+			name:          "malformed",
+			authorization: "Bearer abc",
+			wantSuccess:   false,
+		},
+		{
+			name:          "no token",
+			authorization: "",
+			wantSuccess:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a request
+			req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			// Authenticate
+			identity, success := auth.Identify(req)
+			if success != tt.wantSuccess {
+				t.Fatalf("Identify() success = %v, want %v", success, tt.wantSuccess)
+			}
+			if success && identity.Principal != tt.wantPrincipal {
+				t.Errorf("Principal = %q, want %q", identity.Principal, tt.wantPrincipal)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareIdentity(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a handler that records the principal
+	var principal string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = Principal(r)
+	})
+
+	// Apply the auth middleware
+	wrappedHandler := AuthMiddleware(NewBasicAuthenticator("admin", "password", log), log)(handler)
+
+	// Create a request
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	req.SetBasicAuth("admin", "password")
+
+	// Call the handler
+	wrappedHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check the principal
+	if principal != "admin" {
+		t.Errorf("Principal() = %q, want %q", principal, "admin")
+	}
+}
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+// Bulkhead represents a limit on the number of requests in flight, with an
+// optional bounded queue of requests waiting for a slot
+type Bulkhead struct {
+	Name         string
+	slots        chan struct{}
+	queue        chan struct{}
+	queueTimeout time.Duration
+}
+
+// NewBulkhead creates a new bulkhead admitting maxInFlight requests at a time.
+// Up to maxQueue further requests wait at most queueTimeout for a slot.
+func NewBulkhead(name string, maxInFlight, maxQueue int, queueTimeout time.Duration) (*Bulkhead, error) {
+	if maxInFlight <= 0 {
+		return nil, fmt.Errorf("maximum in-flight requests must be positive")
+	}
+	if maxQueue < 0 {
+		return nil, fmt.Errorf("queue size must not be negative")
+	}
+	if maxQueue > 0 && queueTimeout <= 0 {
+		queueTimeout = time.Second
+	}
+
+	return &Bulkhead{
+		Name:         name,
+		slots:        make(chan struct{}, maxInFlight),
+		queue:        make(chan struct{}, maxQueue),
+		queueTimeout: queueTimeout,
+	}, nil
+}
+
+// Acquire takes a slot, waiting in the queue if there is room. It reports
+// whether a slot was taken; if so, Release has to be called when done.
+func (b *Bulkhead) Acquire(ctx context.Context) bool {
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	// Wait in the queue if it is not full
+	select {
+	case b.queue <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-b.queue }()
+
+	timer := time.NewTimer(b.queueTimeout)
+	defer timer.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release gives back a slot taken by Acquire
+func (b *Bulkhead) Release() {
+	<-b.slots
+}
+
+// InFlight returns the number of requests holding a slot
+func (b *Bulkhead) InFlight() int {
+	return len(b.slots)
+}
+
+// Queued returns the number of requests waiting for a slot
+func (b *Bulkhead) Queued() int {
+	return len(b.queue)
+}
+
+// BulkheadMiddleware creates a middleware that admits a request only if it
+// gets a slot in every bulkhead. Saturated bulkheads reject requests with 503
+// and count them in the bulkhead_rejected_total metric.
+func BulkheadMiddleware(registry *stats.Registry, log *logger.Logger, bulkheads ...*Bulkhead) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i, bulkhead := range bulkheads {
+				if !bulkhead.Acquire(r.Context()) {
+					for _, acquired := range bulkheads[:i] {
+						acquired.Release()
+					}
+
+					log.Warn("Bulkhead %s saturated, rejecting %s %s", bulkhead.Name, r.Method, r.URL.Path)
+					if registry != nil {
+						registry.Counter("bulkhead_rejected_total", "bulkhead", bulkhead.Name).Inc()
+					}
+					WriteError(w, http.StatusServiceUnavailable, "overloaded", "Too many requests in flight")
+					return
+				}
+			}
+			defer func() {
+				for _, bulkhead := range bulkheads {
+					bulkhead.Release()
+				}
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+func TestNewBulkheadErrors(t *testing.T) {
+	if _, err := NewBulkhead("b", 0, 0, 0); err == nil {
+		t.Error("NewBulkhead() without slots succeeded")
+	}
+	if _, err := NewBulkhead("b", 1, -1, 0); err == nil {
+		t.Error("NewBulkhead() with a negative queue succeeded")
+	}
+}
+
+func TestBulkhead(t *testing.T) {
+	// Create a bulkhead with one slot and one queue place
+	bulkhead, err := NewBulkhead("b", 1, 1, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewBulkhead() error = %v", err)
+	}
+	ctx := context.Background()
+
+	if !bulkhead.Acquire(ctx) {
+		t.Fatal("first Acquire() failed")
+	}
+
+	// A queued request gets the slot once it is released
+	acquired := make(chan bool)
+	go func() { acquired <- bulkhead.Acquire(ctx) }()
+	for bulkhead.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full
+	if bulkhead.Acquire(ctx) {
+		t.Error("Acquire() with a full queue succeeded")
+	}
+
+	bulkhead.Release()
+	if !<-acquired {
+		t.Error("queued Acquire() failed after release")
+	}
+
+	// Queued requests time out
+	start := time.Now()
+	if bulkhead.Acquire(ctx) {
+		t.Error("Acquire() succeeded while the slot is taken")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Acquire() gave up after %v, want at least the queue timeout", elapsed)
+	}
+	if bulkhead.InFlight() != 1 || bulkhead.Queued() != 0 {
+		t.Errorf("InFlight() = %v, Queued() = %v, want 1, 0", bulkhead.InFlight(), bulkhead.Queued())
+	}
+}
+
+func TestBulkheadMiddleware(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a handler that blocks until released
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Apply the bulkhead middleware with a route and a shared upstream bulkhead
+	route, _ := NewBulkhead("route", 2, 0, 0)
+	upstream, _ := NewBulkhead("upstream", 1, 0, 0)
+	registry := stats.NewRegistry()
+	wrappedHandler := BulkheadMiddleware(registry, log, route, upstream)(handler)
+
+	// Occupy the upstream
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		wrappedHandler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api", nil))
+		done <- w.Code
+	}()
+	<-entered
+
+	// The next request is rejected and gives back its route slot
+	w := httptest.NewRecorder()
+	wrappedHandler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+	if route.InFlight() != 1 {
+		t.Errorf("route InFlight() = %v, want %v", route.InFlight(), 1)
+	}
+	if got := registry.Counter("bulkhead_rejected_total", "bulkhead", "upstream").Value(); got != 1 {
+		t.Errorf("rejected = %v, want %v", got, 1)
+	}
+
+	// Slots are released when the request finishes
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("first status code = %v, want %v", code, http.StatusOK)
+	}
+	if route.InFlight() != 0 || upstream.InFlight() != 0 {
+		t.Errorf("InFlight() = %v, %v after completion, want 0, 0", route.InFlight(), upstream.InFlight())
+	}
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	// ForwardedHeader is the RFC 7239 Forwarded header
+	ForwardedHeader = "Forwarded"
+	// XForwardedForHeader is the de facto X-Forwarded-For header
+	XForwardedForHeader = "X-Forwarded-For"
+	// XRealIPHeader is the X-Real-IP header set by some proxies
+	XRealIPHeader = "X-Real-IP"
+)
+
+// DefaultClientIPHeaders are the headers consulted, in order, when none are
+// configured. Forwarded and X-Real-IP must be opted into, since a proxy that
+// only appends X-Forwarded-For passes a client supplied value through.
+var DefaultClientIPHeaders = []string{XForwardedForHeader}
+
+// ClientIPResolver determines the IP address of the client behind trusted proxies.
+// Forwarding headers are only believed when the connected peer, and every hop
+// read from the header after it, is within a trusted CIDR.
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+	headers []string
+}
+
+// NewClientIPResolver creates a new client IP resolver. trustedProxies holds
+// CIDRs or addresses of proxies allowed to set forwarding headers, headers the
+// forwarding headers to consult in order (DefaultClientIPHeaders if empty).
+func NewClientIPResolver(trustedProxies, headers []string) (*ClientIPResolver, error) {
+	trusted, err := parsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(headers) == 0 {
+		headers = DefaultClientIPHeaders
+	}
+	normalized := make([]string, 0, len(headers))
+	for _, header := range headers {
+		switch {
+		case strings.EqualFold(header, ForwardedHeader):
+			normalized = append(normalized, ForwardedHeader)
+		case strings.EqualFold(header, XForwardedForHeader):
+			normalized = append(normalized, XForwardedForHeader)
+		case strings.EqualFold(header, XRealIPHeader):
+			normalized = append(normalized, XRealIPHeader)
+		default:
+			return nil, fmt.Errorf("unsupported client IP header: %s", header)
+		}
+	}
+
+	return &ClientIPResolver{
+		trusted: trusted,
+		headers: normalized,
+	}, nil
+}
+
+// Resolve returns the client IP of a request
+func (c *ClientIPResolver) Resolve(r *http.Request) string {
+	peer, ok := parseIP(r.RemoteAddr)
+	if !ok {
+		return remoteIP(r)
+	}
+	if !c.isTrusted(peer) {
+		return peer.String()
+	}
+
+	for _, header := range c.headers {
+		var hops []string
+		switch header {
+		case ForwardedHeader:
+			hops = forwardedFor(r.Header.Values(ForwardedHeader))
+		case XForwardedForHeader:
+			hops = splitList(r.Header.Values(XForwardedForHeader))
+		case XRealIPHeader:
+			hops = splitList(r.Header.Values(XRealIPHeader))
+		}
+		if len(hops) == 0 {
+			continue
+		}
+
+		// Walk from the nearest hop outwards until an untrusted address is found
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, ok := parseIP(hops[i])
+			if !ok {
+				break
+			}
+			client = addr
+			if !c.isTrusted(addr) {
+				break
+			}
+		}
+		return client.String()
+	}
+
+	return peer.String()
+}
+
+// TrustedPeer reports whether the connected peer of a request is a trusted proxy
+func (c *ClientIPResolver) TrustedPeer(r *http.Request) bool {
+	peer, ok := parseIP(r.RemoteAddr)
+	return ok && c.isTrusted(peer)
+}
+
+// isTrusted reports whether the address belongs to a trusted proxy
+func (c *ClientIPResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIPMiddleware creates a middleware that resolves the client IP and stores it in the request context
+func ClientIPMiddleware(resolver *ClientIPResolver) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, WithClientIP(r, resolver.Resolve(r)))
+		})
+	}
+}
+
+// parseIP parses an address that may carry a port, brackets or quotes
+func parseIP(value string) (netip.Addr, bool) {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// splitList splits comma separated header values into their elements
+func splitList(values []string) []string {
+	var elements []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return elements
+}
+
+// forwardedFor extracts the for= parameters of RFC 7239 Forwarded header values
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				hops = append(hops, value)
+			}
+		}
+	}
+	return hops
+}
+
+// remoteIP returns the IP address of the connected peer without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
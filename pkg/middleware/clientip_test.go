@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		name       string
+		trusted    []string
+		headers    []string
+		remoteAddr string
+		setHeaders map[string]string
+		want       string
+	}{
+		{
+			name:       "strips port",
+			remoteAddr: "192.168.1.1:12345",
+			want:       "192.168.1.1",
+		},
+		{
+			name:       "ignores headers from untrusted peer",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "203.0.113.9:12345",
+			setHeaders: map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			want:       "203.0.113.9",
+		},
+		{
+			name:       "x-forwarded-for from trusted peer",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.2:12345",
+			setHeaders: map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "skips trusted hops",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.2:12345",
+			setHeaders: map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.3"},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "all hops trusted",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.2:12345",
+			setHeaders: map[string]string{"X-Forwarded-For": "10.0.0.4, 10.0.0.3"},
+			want:       "10.0.0.4",
+		},
+		{
+			name:       "x-real-ip",
+			trusted:    []string{"10.0.0.0/8"},
+			headers:    []string{"X-Real-IP"},
+			remoteAddr: "10.0.0.2:12345",
+			setHeaders: map[string]string{"X-Real-IP": "1.2.3.4"},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "forwarded ipv6 with port",
+			trusted:    []string{"10.0.0.0/8"},
+			headers:    []string{"Forwarded"},
+			remoteAddr: "10.0.0.2:12345",
+			setHeaders: map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https`},
+			want:       "2001:db8:cafe::17",
+		},
+		{
+			name:       "ignores forwarded by default",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.2:12345",
+			setHeaders: map[string]string{
+				"Forwarded":       "for=5.5.5.5",
+				"X-Forwarded-For": "1.2.3.4",
+			},
+			want: "1.2.3.4",
+		},
+		{
+			name:       "ignores x-real-ip by default",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.2:12345",
+			setHeaders: map[string]string{"X-Real-IP": "1.2.3.4"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "forwarded preferred over x-forwarded-for",
+			trusted:    []string{"10.0.0.0/8"},
+			headers:    []string{"Forwarded", "X-Forwarded-For"},
+			remoteAddr: "10.0.0.2:12345",
+			setHeaders: map[string]string{
+				"Forwarded":       "for=5.5.5.5",
+				"X-Forwarded-For": "1.2.3.4",
+			},
+			want: "5.5.5.5",
+		},
+		{
+			name:       "configured header only",
+			trusted:    []string{"10.0.0.0/8"},
+			headers:    []string{"X-Real-IP"},
+			remoteAddr: "10.0.0.2:12345",
+			setHeaders: map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "obfuscated identifier stops at proxy",
+			trusted:    []string{"10.0.0.0/8"},
+			headers:    []string{"Forwarded"},
+			remoteAddr: "10.0.0.2:12345",
+			setHeaders: map[string]string{"Forwarded": "for=_hidden"},
+			want:       "10.0.0.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a resolver
+			resolver, err := NewClientIPResolver(tt.trusted, tt.headers)
+			if err != nil {
+				t.Fatalf("NewClientIPResolver() error = %v", err)
+			}
+
+			// Create a request
+			req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.setHeaders {
+				req.Header.Set(key, value)
+			}
+
+			// Check the result
+			if got := resolver.Resolve(req); got != tt.want {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPResolverUnsupportedHeader(t *testing.T) {
+	if _, err := NewClientIPResolver(nil, []string{"X-Client"}); err == nil {
+		t.Error("NewClientIPResolver() error = nil, want error")
+	}
+}
+
+func TestClientIPMiddleware(t *testing.T) {
+	// Create a resolver
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatalf("NewClientIPResolver() error = %v", err)
+	}
+
+	// Create a handler that records the client IP
+	var got string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = ClientIP(r)
+	})
+
+	// Create a request
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	req.RemoteAddr = "10.0.0.2:12345"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	// Call the handler
+	ClientIPMiddleware(resolver)(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check the result
+	if got != "1.2.3.4" {
+		t.Errorf("ClientIP() = %v, want %v", got, "1.2.3.4")
+	}
+}
+
+func TestClientIPResolverTrustedPeer(t *testing.T) {
+	// Create a resolver
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatalf("NewClientIPResolver() error = %v", err)
+	}
+
+	// Test cases
+	tests := []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{remoteAddr: "10.0.0.2:12345", want: true},
+		{remoteAddr: "192.168.1.1:12345", want: false},
+		{remoteAddr: "invalid", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if got := resolver.TrustedPeer(req); got != tt.want {
+				t.Errorf("TrustedPeer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+// Consumer represents a known caller of the gateway, such as a customer or an application
+type Consumer struct {
+	ID   string
+	Plan string // name of the plan the consumer is subscribed to, if any
+}
+
+// ConsumerCredentials represents the credentials a consumer is recognized by
+type ConsumerCredentials struct {
+	APIKeys     []string          // keys sent in the X-API-Key header
+	BasicUsers  map[string]string // basic auth user names and passwords
+	JWTSubjects []string          // subjects of tokens verified by the auth middleware
+}
+
+// Plan represents the limits and permissions shared by the consumers of a plan
+type Plan struct {
+	Name       string
+	Routes     []string // route paths the plan allows, all routes if empty
+	RateLimits []RateLimitPolicy
+	Quotas     []QuotaPolicy
+}
+
+// AllowsRoute reports whether the plan allows a route
+func (p *Plan) AllowsRoute(route string) bool {
+	if len(p.Routes) == 0 {
+		return true
+	}
+	for _, allowed := range p.Routes {
+		if allowed == route {
+			return true
+		}
+	}
+	return false
+}
+
+// basicUser represents the basic auth credentials of a consumer
+type basicUser struct {
+	password string
+	consumer *Consumer
+}
+
+// ConsumerRegistry represents the consumers known to the gateway
+type ConsumerRegistry struct {
+	consumers map[string]*Consumer
+	apiKeys   map[string]*Consumer // by hashed key
+	basic     map[string]basicUser
+	subjects  map[string]*Consumer
+}
+
+// NewConsumerRegistry creates a new, empty consumer registry
+func NewConsumerRegistry() *ConsumerRegistry {
+	return &ConsumerRegistry{
+		consumers: make(map[string]*Consumer),
+		apiKeys:   make(map[string]*Consumer),
+		basic:     make(map[string]basicUser),
+		subjects:  make(map[string]*Consumer),
+	}
+}
+
+// Add registers a consumer with its credentials. Consumer IDs and credentials
+// have to be unique.
+func (c *ConsumerRegistry) Add(consumer *Consumer, credentials ConsumerCredentials) error {
+	if consumer.ID == "" {
+		return fmt.Errorf("consumer ID is required")
+	}
+	if _, ok := c.consumers[consumer.ID]; ok {
+		return fmt.Errorf("duplicate consumer: %s", consumer.ID)
+	}
+
+	for _, key := range credentials.APIKeys {
+		hashed := HashAPIKey(key)
+		if _, ok := c.apiKeys[hashed]; ok {
+			return fmt.Errorf("API key of consumer %s is already in use", consumer.ID)
+		}
+		c.apiKeys[hashed] = consumer
+	}
+	for username, password := range credentials.BasicUsers {
+		if _, ok := c.basic[username]; ok {
+			return fmt.Errorf("basic auth user %s of consumer %s is already in use", username, consumer.ID)
+		}
+		c.basic[username] = basicUser{password: password, consumer: consumer}
+	}
+	for _, subject := range credentials.JWTSubjects {
+		if _, ok := c.subjects[subject]; ok {
+			return fmt.Errorf("JWT subject %s of consumer %s is already in use", subject, consumer.ID)
+		}
+		c.subjects[subject] = consumer
+	}
+
+	c.consumers[consumer.ID] = consumer
+	return nil
+}
+
+// Get returns a consumer by ID
+func (c *ConsumerRegistry) Get(id string) (*Consumer, bool) {
+	consumer, ok := c.consumers[id]
+	return consumer, ok
+}
+
+// Identify returns the consumer a request belongs to. The subject of a token
+// verified by the auth middleware takes precedence over an API key, which
+// takes precedence over basic auth credentials.
+func (c *ConsumerRegistry) Identify(r *http.Request) (*Consumer, bool) {
+	if principal := Principal(r); principal != "" {
+		if consumer, ok := c.subjects[principal]; ok {
+			return consumer, true
+		}
+	}
+
+	if key := r.Header.Get(DefaultAPIKeyHeader); key != "" {
+		if consumer, ok := c.apiKeys[HashAPIKey(key)]; ok {
+			return consumer, true
+		}
+	}
+
+	const prefix = "Basic "
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, prefix) {
+		payload, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+		if err != nil {
+			return nil, false
+		}
+		username, password, ok := strings.Cut(string(payload), ":")
+		if !ok {
+			return nil, false
+		}
+		user, ok := c.basic[username]
+		if ok && subtle.ConstantTimeCompare([]byte(password), []byte(user.password)) == 1 {
+			return user.consumer, true
+		}
+	}
+
+	return nil, false
+}
+
+// ConsumerMiddleware creates a middleware that identifies the consumer of a
+// request and applies its plan. Requests from unknown consumers are rejected
+// with 401, requests to a route outside the plan with 403. The consumer is
+// stored in the request context for the middlewares and handlers that follow.
+func ConsumerMiddleware(registry *ConsumerRegistry, plans map[string]*Plan, route string, headers string, quotaStore *QuotaStore, log *logger.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		// Chain the limits of every plan once
+		planHandlers := make(map[string]http.Handler, len(plans))
+		for name, plan := range plans {
+			handler := next
+			if len(plan.Quotas) > 0 {
+				handler = QuotaMiddleware(quotaStore, log, plan.Quotas...)(handler)
+			}
+			if len(plan.RateLimits) > 0 {
+				handler = RateLimitPoliciesMiddleware(headers, plan.RateLimits...)(handler)
+			}
+			planHandlers[name] = handler
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			consumer, ok := registry.Identify(r)
+			if !ok {
+				log.Warn("Unknown consumer from %s", ClientIP(r))
+				WriteError(w, http.StatusUnauthorized, "unauthorized", "Unknown consumer")
+				return
+			}
+			r = WithConsumer(r, consumer)
+
+			plan, ok := plans[consumer.Plan]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !plan.AllowsRoute(route) {
+				log.Warn("Route %s not allowed for consumer %s on plan %s", route, consumer.ID, plan.Name)
+				WriteError(w, http.StatusForbidden, "forbidden", "Route not included in plan")
+				return
+			}
+			planHandlers[plan.Name].ServeHTTP(w, r)
+		})
+	}
+}
+
+// consumerIDKey keys requests by the ID of their consumer
+func consumerIDKey(r *http.Request) (string, bool) {
+	if consumer := ConsumerFrom(r); consumer != nil {
+		return consumer.ID, true
+	}
+	return "", false
+}
@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+func TestConsumerRegistry(t *testing.T) {
+	// Create a registry
+	registry := NewConsumerRegistry()
+	acme := &Consumer{ID: "acme", Plan: "gold"}
+	err := registry.Add(acme, ConsumerCredentials{
+		APIKeys:     []string{"acme-key"},
+		BasicUsers:  map[string]string{"acme": "secret"},
+		JWTSubjects: []string{"acme-service"},
+	})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// Credentials have to be unique
+	if err := registry.Add(&Consumer{ID: "other"}, ConsumerCredentials{APIKeys: []string{"acme-key"}}); err == nil {
+		t.Error("Add() with a duplicate API key succeeded")
+	}
+	if err := registry.Add(&Consumer{ID: "acme"}, ConsumerCredentials{}); err == nil {
+		t.Error("Add() with a duplicate ID succeeded")
+	}
+
+	// Test cases
+	tests := []struct {
+		name    string
+		setup   func(r *http.Request) *http.Request
+		wantID  string
+		wantHit bool
+	}{
+		{
+			name: "API key",
+			setup: func(r *http.Request) *http.Request {
+				r.Header.Set("X-API-Key", "acme-key")
+				return r
+			},
+			wantID:  "acme",
+			wantHit: true,
+		},
+		{
+			name: "basic auth",
+			setup: func(r *http.Request) *http.Request {
+				r.SetBasicAuth("acme", "secret")
+				return r
+			},
+			wantID:  "acme",
+			wantHit: true,
+		},
+		{
+			name: "wrong basic auth password",
+			setup: func(r *http.Request) *http.Request {
+				r.SetBasicAuth("acme", "wrong")
+				return r
+			},
+		},
+		{
+			name: "JWT subject",
+			setup: func(r *http.Request) *http.Request {
+				return WithIdentity(r, &Identity{Principal: "acme-service"})
+			},
+			wantID:  "acme",
+			wantHit: true,
+		},
+		{
+			name: "unknown API key",
+			setup: func(r *http.Request) *http.Request {
+				r.Header.Set("X-API-Key", "other-key")
+				return r
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.setup(httptest.NewRequest("GET", "http://example.com/api", nil))
+			consumer, ok := registry.Identify(req)
+			if ok != tt.wantHit {
+				t.Fatalf("Identify() ok = %v, want %v", ok, tt.wantHit)
+			}
+			if ok && consumer.ID != tt.wantID {
+				t.Errorf("Identify() = %v, want %v", consumer.ID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestConsumerMiddleware(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create consumers on a plan allowing two requests per minute on /api
+	registry := NewConsumerRegistry()
+	registry.Add(&Consumer{ID: "acme", Plan: "free"}, ConsumerCredentials{APIKeys: []string{"acme-key"}})
+	registry.Add(&Consumer{ID: "globex", Plan: "free"}, ConsumerCredentials{APIKeys: []string{"globex-key"}})
+	limiter, _ := NewLimiter(TokenBucket, 2, time.Minute, 0, log)
+	consumerKey, _ := ParseKey("consumer", "/api")
+	plans := map[string]*Plan{
+		"free": {
+			Name:       "free",
+			Routes:     []string{"/api"},
+			RateLimits: []RateLimitPolicy{{Name: "consumer", Limiter: limiter, Key: consumerKey}},
+		},
+	}
+
+	// Create a handler reporting the consumer
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if consumer := ConsumerFrom(r); consumer != nil {
+			w.Header().Set("X-Consumer", consumer.ID)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	store, _ := NewQuotaStore("", 0, log)
+	api := ConsumerMiddleware(registry, plans, "/api", HeadersXRateLimit, store, log)(handler)
+	admin := ConsumerMiddleware(registry, plans, "/admin", HeadersXRateLimit, store, log)(handler)
+
+	send := func(h http.Handler, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// Unknown consumers are rejected
+	if w := send(api, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous status code = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+
+	// Routes outside the plan are forbidden
+	if w := send(admin, "acme-key"); w.Code != http.StatusForbidden {
+		t.Errorf("route outside plan status code = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	// The plan limits every consumer separately
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if w := send(api, "acme-key"); w.Code != want {
+			t.Errorf("acme request %d status code = %v, want %v", i, w.Code, want)
+		}
+	}
+	w := send(api, "globex-key")
+	if w.Code != http.StatusOK {
+		t.Errorf("globex status code = %v, want %v", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("X-Consumer"); got != "globex" {
+		t.Errorf("consumer = %q, want %q", got, "globex")
+	}
+}
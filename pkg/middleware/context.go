@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// contextKey represents a key for values stored in the request context
+type contextKey int
+
+const (
+	// clientIPKey is the context key for the resolved client IP
+	clientIPKey contextKey = iota
+	// identityKey is the context key for the authenticated identity
+	identityKey
+	// consumerKey is the context key for the resolved consumer
+	consumerKey
+	// consumerSlotKey is the context key for the consumer slot of server-wide middlewares
+	consumerSlotKey
+	// arrivalKey is the context key for the time a request arrived
+	arrivalKey
+	// pathParamsKey is the context key for the parameters captured from the path
+	pathParamsKey
+	// upstreamLatencyKey is the context key for the recorder of the upstream latency
+	upstreamLatencyKey
+)
+
+// consumerSlot records the consumer resolved by a route middleware, so that
+// server-wide middlewares wrapping the route see it after the request is served
+type consumerSlot struct {
+	consumer atomic.Pointer[Consumer]
+}
+
+// WithClientIP returns a copy of the request carrying the resolved client IP
+func WithClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey, ip))
+}
+
+// ClientIP returns the resolved client IP of a request. Without a resolved
+// value it falls back to the address of the connected peer.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// WithIdentity returns a copy of the request carrying the authenticated identity
+func WithIdentity(r *http.Request, identity *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey, identity))
+}
+
+// IdentityFrom returns the authenticated identity of a request, or nil
+func IdentityFrom(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityKey).(*Identity)
+	return identity
+}
+
+// Principal returns the authenticated principal of a request, or an empty string
+func Principal(r *http.Request) string {
+	if identity := IdentityFrom(r); identity != nil {
+		return identity.Principal
+	}
+	return ""
+}
+
+// WithConsumer returns a copy of the request carrying the resolved consumer
+func WithConsumer(r *http.Request, consumer *Consumer) *http.Request {
+	if slot, ok := r.Context().Value(consumerSlotKey).(*consumerSlot); ok {
+		slot.consumer.Store(consumer)
+	}
+	return r.WithContext(context.WithValue(r.Context(), consumerKey, consumer))
+}
+
+// ConsumerFrom returns the resolved consumer of a request, or nil. Server-wide
+// middlewares see consumers resolved further down the chain once the request is served.
+func ConsumerFrom(r *http.Request) *Consumer {
+	if consumer, ok := r.Context().Value(consumerKey).(*Consumer); ok {
+		return consumer
+	}
+	if slot, ok := r.Context().Value(consumerSlotKey).(*consumerSlot); ok {
+		return slot.consumer.Load()
+	}
+	return nil
+}
+
+// withConsumerSlot returns a copy of the request that records consumers resolved while serving it
+func withConsumerSlot(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(consumerSlotKey).(*consumerSlot); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), consumerSlotKey, &consumerSlot{}))
+}
+
+// WithArrival returns a copy of the request carrying the time it arrived at the gateway
+func WithArrival(r *http.Request, arrival time.Time) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), arrivalKey, arrival))
+}
+
+// Arrival returns the time a request arrived at the gateway, if it was recorded
+func Arrival(r *http.Request) (time.Time, bool) {
+	arrival, ok := r.Context().Value(arrivalKey).(time.Time)
+	return arrival, ok
+}
+
+// WithPathParams returns a copy of the request carrying the parameters captured from its path
+func WithPathParams(r *http.Request, params map[string]string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pathParamsKey, params))
+}
+
+// PathParams returns the parameters captured from the path of a request, or nil
+func PathParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(pathParamsKey).(map[string]string)
+	return params
+}
+
+// PathParam returns a parameter captured from the path of a request, or an empty string
+func PathParam(r *http.Request, name string) string {
+	return PathParams(r)[name]
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package middleware
+
+import "time"
+
+// processCPUTime reports that the CPU time of the process is not available,
+// so the CPU utilization is not checked
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
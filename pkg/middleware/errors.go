@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorResponse represents the JSON body of an error generated by the gateway
+type ErrorResponse struct {
+	Status  int    `json:"status"`
+	Error   string `json:"error"` // machine readable error code
+	Message string `json:"message"`
+}
+
+// WriteError writes a JSON error response
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Status:  status,
+		Error:   code,
+		Message: message,
+	})
+}
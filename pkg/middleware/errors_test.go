@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	// Write an error
+	w := httptest.NewRecorder()
+	WriteError(w, http.StatusTooManyRequests, "rate_limited", "Rate limit exceeded")
+
+	// Check the response
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status code = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want %q", got, "application/json")
+	}
+
+	// Check the body
+	var body ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+	want := ErrorResponse{Status: http.StatusTooManyRequests, Error: "rate_limited", Message: "Rate limit exceeded"}
+	if body != want {
+		t.Errorf("Body = %+v, want %+v", body, want)
+	}
+}
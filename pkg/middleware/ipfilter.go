@@ -0,0 +1,247 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+// ipRules represents a compiled set of allow and deny prefixes
+type ipRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// fileState records the modification state of a list file
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// IPFilter allows or denies requests by client IP using IPv4/IPv6 CIDR lists.
+// A matching deny entry always wins. If the allow list is not empty, only
+// addresses that match it are let through.
+type IPFilter struct {
+	allow          []string
+	deny           []string
+	allowFile      string
+	denyFile       string
+	reloadInterval time.Duration
+	rules          atomic.Pointer[ipRules]
+	nextCheck      atomic.Int64
+	files          map[string]fileState
+	mu             sync.Mutex
+	log            *logger.Logger
+}
+
+// NewIPFilter creates a new IP filter. Entries are CIDRs or single addresses.
+// The optional files hold one entry per line and are re-read when they change,
+// checked at most once per reloadInterval (10 seconds if not set).
+func NewIPFilter(allow, deny []string, allowFile, denyFile string, reloadInterval time.Duration, log *logger.Logger) (*IPFilter, error) {
+	if reloadInterval <= 0 {
+		reloadInterval = 10 * time.Second
+	}
+
+	f := &IPFilter{
+		allow:          allow,
+		deny:           deny,
+		allowFile:      allowFile,
+		denyFile:       denyFile,
+		reloadInterval: reloadInterval,
+		files:          make(map[string]fileState),
+		log:            log,
+	}
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.nextCheck.Store(time.Now().Add(reloadInterval).UnixNano())
+
+	return f, nil
+}
+
+// Allowed reports whether the given client IP passes the filter
+func (f *IPFilter) Allowed(ip string) bool {
+	f.reloadIfChanged()
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	rules := f.rules.Load()
+	for _, prefix := range rules.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	if len(rules.allow) == 0 {
+		return true
+	}
+	for _, prefix := range rules.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// load compiles the inline entries and list files into a new rule set
+func (f *IPFilter) load() error {
+	allow, err := parsePrefixes(f.allow)
+	if err != nil {
+		return err
+	}
+	deny, err := parsePrefixes(f.deny)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]fileState)
+	for _, list := range []struct {
+		path     string
+		prefixes *[]netip.Prefix
+	}{
+		{f.allowFile, &allow},
+		{f.denyFile, &deny},
+	} {
+		if list.path == "" {
+			continue
+		}
+
+		entries, state, err := readListFile(list.path)
+		if err != nil {
+			return err
+		}
+		prefixes, err := parsePrefixes(entries)
+		if err != nil {
+			return fmt.Errorf("%s: %w", list.path, err)
+		}
+		*list.prefixes = append(*list.prefixes, prefixes...)
+		files[list.path] = state
+	}
+
+	f.rules.Store(&ipRules{allow: allow, deny: deny})
+	f.files = files
+	return nil
+}
+
+// reloadIfChanged reloads the list files if they changed since the last load
+func (f *IPFilter) reloadIfChanged() {
+	if f.allowFile == "" && f.denyFile == "" {
+		return
+	}
+
+	now := time.Now()
+	if now.UnixNano() < f.nextCheck.Load() || !f.mu.TryLock() {
+		return
+	}
+	defer f.mu.Unlock()
+	f.nextCheck.Store(now.Add(f.reloadInterval).UnixNano())
+
+	changed := false
+	for _, path := range []string{f.allowFile, f.denyFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || f.files[path] != (fileState{modTime: info.ModTime(), size: info.Size()}) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+
+	// Keep the previous rules if the new lists are broken
+	if err := f.load(); err != nil {
+		f.log.Error("Failed to reload IP filter lists: %v", err)
+		return
+	}
+	f.log.Info("Reloaded IP filter lists")
+}
+
+// readListFile reads the entries of a list file, ignoring blank lines and # comments
+func readListFile(path string) ([]string, fileState, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fileState{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fileState{}, err
+	}
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fileState{}, err
+	}
+
+	return entries, fileState{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// parsePrefixes parses CIDRs and single addresses into prefixes
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+			}
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q: %w", entry, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// IPFilterMiddleware creates a middleware that rejects requests from filtered client IPs
+func IPFilterMiddleware(filter *IPFilter, log *logger.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP := ClientIP(r)
+			if !filter.Allowed(clientIP) {
+				log.Warn("IP filter rejected %s %s %s", clientIP, r.Method, r.URL.Path)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+func TestIPFilter(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Test cases
+	tests := []struct {
+		name        string
+		allow       []string
+		deny        []string
+		ip          string
+		wantAllowed bool
+	}{
+		{
+			name:        "no rules",
+			ip:          "203.0.113.7",
+			wantAllowed: true,
+		},
+		{
+			name:        "allowed cidr",
+			allow:       []string{"10.0.0.0/8"},
+			ip:          "10.1.2.3",
+			wantAllowed: true,
+		},
+		{
+			name:        "outside allow list",
+			allow:       []string{"10.0.0.0/8"},
+			ip:          "192.168.1.1",
+			wantAllowed: false,
+		},
+		{
+			name:        "deny wins over allow",
+			allow:       []string{"10.0.0.0/8"},
+			deny:        []string{"10.0.0.5"},
+			ip:          "10.0.0.5",
+			wantAllowed: false,
+		},
+		{
+			name:        "denied only",
+			deny:        []string{"192.168.0.0/16"},
+			ip:          "192.168.4.4",
+			wantAllowed: false,
+		},
+		{
+			name:        "ipv6 cidr",
+			allow:       []string{"2001:db8::/32"},
+			ip:          "2001:db8::1",
+			wantAllowed: true,
+		},
+		{
+			name:        "ipv4 mapped ipv6",
+			allow:       []string{"10.0.0.0/8"},
+			ip:          "::ffff:10.0.0.1",
+			wantAllowed: true,
+		},
+		{
+			name:        "invalid ip",
+			ip:          "not-an-ip",
+			wantAllowed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a filter
+			filter, err := NewIPFilter(tt.allow, tt.deny, "", "", 0, log)
+			if err != nil {
+				t.Fatalf("NewIPFilter() error = %v", err)
+			}
+
+			// Check the result
+			if got := filter.Allowed(tt.ip); got != tt.wantAllowed {
+				t.Errorf("Allowed(%q) = %v, want %v", tt.ip, got, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestIPFilterInvalidEntry(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a filter with an invalid entry
+	if _, err := NewIPFilter([]string{"10.0.0.0/33"}, nil, "", "", 0, log); err == nil {
+		t.Error("NewIPFilter() error = nil, want error")
+	}
+}
+
+func TestIPFilterFileReload(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a deny list file
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte("# blocked\n192.168.1.1\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write deny list: %v", err)
+	}
+
+	// Create a filter
+	filter, err := NewIPFilter(nil, nil, "", path, time.Millisecond, log)
+	if err != nil {
+		t.Fatalf("NewIPFilter() error = %v", err)
+	}
+	if filter.Allowed("192.168.1.1") {
+		t.Error("Allowed(192.168.1.1) = true before reload, want false")
+	}
+
+	// Change the deny list
+	if err := os.WriteFile(path, []byte("192.168.2.0/24\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write deny list: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if !filter.Allowed("192.168.1.1") {
+		t.Error("Allowed(192.168.1.1) = false after reload, want true")
+	}
+	if filter.Allowed("192.168.2.9") {
+		t.Error("Allowed(192.168.2.9) = true after reload, want false")
+	}
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Apply the IP filter middleware
+	filter, err := NewIPFilter([]string{"10.0.0.0/8"}, nil, "", "", 0, log)
+	if err != nil {
+		t.Fatalf("NewIPFilter() error = %v", err)
+	}
+	wrappedHandler := IPFilterMiddleware(filter, log)(handler)
+
+	// Test cases
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		wantStatusCode int
+	}{
+		{
+			name:           "allowed",
+			remoteAddr:     "10.0.0.1:12345",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "forbidden",
+			remoteAddr:     "192.168.1.1:12345",
+			wantStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a request
+			req := httptest.NewRequest("GET", "http://example.com/admin", nil)
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+
+			// Call the handler
+			wrappedHandler.ServeHTTP(w, req)
+
+			// Check the response
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Errorf("Status code = %v, want %v", resp.StatusCode, tt.wantStatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+// Priority represents the priority class of a request. Lower values are more important.
+type Priority int
+
+const (
+	// PriorityCritical requests, such as health checks, are never shed
+	PriorityCritical Priority = iota
+	// PriorityHigh requests are shed last
+	PriorityHigh
+	// PriorityNormal is the priority of requests without one
+	PriorityNormal
+	// PriorityLow requests are shed first
+	PriorityLow
+)
+
+// priorityNames are the names of the priority classes
+var priorityNames = map[Priority]string{
+	PriorityCritical: "critical",
+	PriorityHigh:     "high",
+	PriorityNormal:   "normal",
+	PriorityLow:      "low",
+}
+
+// priorityCapacity is the load, relative to the configured limits, up to
+// which requests of a priority class are admitted
+var priorityCapacity = map[Priority]float64{
+	PriorityCritical: math.Inf(1),
+	PriorityHigh:     1.0,
+	PriorityNormal:   0.85,
+	PriorityLow:      0.7,
+}
+
+// String returns the name of the priority
+func (p Priority) String() string {
+	return priorityNames[p]
+}
+
+// ParsePriority parses the name of a priority class. An empty name is PriorityNormal.
+func ParsePriority(name string) (Priority, error) {
+	if name == "" {
+		return PriorityNormal, nil
+	}
+	for priority, priorityName := range priorityNames {
+		if priorityName == name {
+			return priority, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority: %s", name)
+}
+
+// LoadShedderConfig represents the settings of a load shedder. Limits that
+// are zero are not checked.
+type LoadShedderConfig struct {
+	MaxInFlight     int           // requests being proxied at once
+	MaxQueueLatency time.Duration // time requests spend in the middlewares before the shedder, or goroutines wait to be scheduled
+	MaxCPU          float64       // fraction of the CPU available to the process, between 0 and 1
+	PriorityHeader  string        // header carrying the priority of a request, if any
+	TrustHeader     func(r *http.Request) bool
+	PlanPriorities  map[string]Priority
+	RetryAfter      time.Duration // defaults to 1s
+}
+
+// LoadShedder represents a global overload detector that sheds the least
+// important requests first. It is safe for concurrent use.
+type LoadShedder struct {
+	config       LoadShedderConfig
+	inFlight     atomic.Int64
+	queueLatency float64 // exponentially smoothed, in seconds
+	cpu          float64
+	schedLatency float64 // 99th percentile since the previous sample, in seconds
+	lastSample   time.Time
+	samples      []metrics.Sample
+	prevCPU      time.Duration
+	prevSched    []uint64
+	mu           sync.Mutex
+	now          func() time.Time
+	cpuTime      func() (time.Duration, bool) // CPU time used by the process so far
+	pressure     *stats.Gauge
+	registry     *stats.Registry
+}
+
+// sampleInterval is the minimum time between two reads of the runtime metrics
+const sampleInterval = 250 * time.Millisecond
+
+// NewLoadShedder creates a new load shedder publishing its state to registry, which may be nil
+func NewLoadShedder(config LoadShedderConfig, registry *stats.Registry) (*LoadShedder, error) {
+	if config.MaxInFlight < 0 || config.MaxQueueLatency < 0 {
+		return nil, fmt.Errorf("load shedding limits must not be negative")
+	}
+	if config.MaxCPU < 0 || config.MaxCPU > 1 {
+		return nil, fmt.Errorf("maximum CPU must be between 0 and 1")
+	}
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = time.Second
+	}
+
+	s := &LoadShedder{
+		config: config,
+		samples: []metrics.Sample{
+			{Name: "/sched/latencies:seconds"},
+		},
+		now:      time.Now,
+		cpuTime:  processCPUTime,
+		registry: registry,
+	}
+	if registry != nil {
+		s.pressure = registry.Gauge("load_shedding_pressure")
+	}
+	return s, nil
+}
+
+// Pressure returns the current load relative to the configured limits. A
+// pressure of 1 means a limit has been reached.
+func (s *LoadShedder) Pressure() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pressureLocked()
+}
+
+// pressureLocked returns the current load. The shedder must be locked.
+func (s *LoadShedder) pressureLocked() float64 {
+	if now := s.now(); now.Sub(s.lastSample) >= sampleInterval {
+		s.sampleRuntime(now)
+		s.lastSample = now
+	}
+
+	var pressure float64
+	if s.config.MaxInFlight > 0 {
+		pressure = math.Max(pressure, float64(s.inFlight.Load())/float64(s.config.MaxInFlight))
+	}
+	if s.config.MaxQueueLatency > 0 {
+		latency := math.Max(s.queueLatency, s.schedLatency)
+		pressure = math.Max(pressure, latency/s.config.MaxQueueLatency.Seconds())
+	}
+	if s.config.MaxCPU > 0 {
+		pressure = math.Max(pressure, s.cpu/s.config.MaxCPU)
+	}
+
+	if s.pressure != nil {
+		s.pressure.Set(pressure)
+	}
+	return pressure
+}
+
+// sampleRuntime reads the CPU utilization and scheduler latency of the process
+// since the previous sample. The CPU utilization is the CPU time the operating
+// system charged the process over the wall time, relative to GOMAXPROCS. The
+// shedder must be locked.
+func (s *LoadShedder) sampleRuntime(now time.Time) {
+	// CPU utilization
+	if s.config.MaxCPU > 0 {
+		if used, ok := s.cpuTime(); ok {
+			if elapsed := now.Sub(s.lastSample); !s.lastSample.IsZero() && elapsed > 0 {
+				s.cpu = (used - s.prevCPU).Seconds() / (elapsed.Seconds() * float64(runtime.GOMAXPROCS(0)))
+			}
+			s.prevCPU = used
+		}
+	}
+
+	if s.config.MaxQueueLatency == 0 {
+		return
+	}
+	metrics.Read(s.samples)
+
+	// 99th percentile of the scheduler latency
+	if s.samples[0].Value.Kind() == metrics.KindFloat64Histogram {
+		histogram := s.samples[0].Value.Float64Histogram()
+		if len(s.prevSched) == len(histogram.Counts) {
+			var total uint64
+			deltas := make([]uint64, len(histogram.Counts))
+			for i, count := range histogram.Counts {
+				deltas[i] = count - s.prevSched[i]
+				total += deltas[i]
+			}
+			s.schedLatency = 0
+			var seen uint64
+			for i, delta := range deltas {
+				seen += delta
+				if total > 0 && float64(seen) >= float64(total)*0.99 {
+					// Use the lower bound, the last bucket is unbounded
+					s.schedLatency = math.Max(histogram.Buckets[i], 0)
+					break
+				}
+			}
+		}
+		s.prevSched = append(s.prevSched[:0], histogram.Counts...)
+	}
+}
+
+// observeQueueLatency adds the waiting time of a request to the smoothed queue
+// latency. It is the time from the arrival of the request to the shedder, so it
+// covers the middlewares before the shedder but not the time spent in the
+// accept queue of the kernel or before the server read the request headers.
+func (s *LoadShedder) observeQueueLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queueLatency += (latency.Seconds() - s.queueLatency) * 0.1
+}
+
+// priority returns the priority of a request. A trusted priority header takes
+// precedence over the plan of the consumer, which takes precedence over the route.
+func (s *LoadShedder) priority(r *http.Request, route Priority) Priority {
+	if s.config.PriorityHeader != "" {
+		if value := r.Header.Get(s.config.PriorityHeader); value != "" {
+			if s.config.TrustHeader == nil || s.config.TrustHeader(r) {
+				if priority, err := ParsePriority(value); err == nil {
+					return priority
+				}
+			}
+		}
+	}
+	if consumer := ConsumerFrom(r); consumer != nil {
+		if priority, ok := s.config.PlanPriorities[consumer.Plan]; ok {
+			return priority
+		}
+	}
+	return route
+}
+
+// Middleware creates a middleware that sheds requests of a route with the given
+// default priority when the gateway is overloaded. Rejected requests get 503
+// with a Retry-After header and are counted in the load_shed_total metric.
+func (s *LoadShedder) Middleware(route Priority, log *logger.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if arrival, ok := Arrival(r); ok {
+				s.observeQueueLatency(s.now().Sub(arrival))
+			}
+
+			priority := s.priority(r, route)
+			if pressure := s.Pressure(); pressure >= priorityCapacity[priority] {
+				log.Warn("Shedding %s priority request %s %s at pressure %.2f", priority, r.Method, r.URL.Path, pressure)
+				if s.registry != nil {
+					s.registry.Counter("load_shed_total", "priority", priority.String()).Inc()
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(s.config.RetryAfter)))
+				WriteError(w, http.StatusServiceUnavailable, "overloaded", "Gateway overloaded")
+				return
+			}
+
+			s.inFlight.Add(1)
+			defer s.inFlight.Add(-1)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ArrivalMiddleware creates a middleware that records when requests arrive,
+// so the load shedder can tell how long they waited
+func ArrivalMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, WithArrival(r, time.Now()))
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+func TestParsePriority(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		name    string
+		want    Priority
+		wantErr bool
+	}{
+		{name: "", want: PriorityNormal},
+		{name: "critical", want: PriorityCritical},
+		{name: "high", want: PriorityHigh},
+		{name: "low", want: PriorityLow},
+		{name: "urgent", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePriority(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePriority() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParsePriority() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadShedderMiddleware(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a shedder allowing ten requests in flight
+	registry := stats.NewRegistry()
+	shedder, err := NewLoadShedder(LoadShedderConfig{
+		MaxInFlight:    10,
+		PriorityHeader: "X-Priority",
+		PlanPriorities: map[string]Priority{"gold": PriorityHigh},
+		RetryAfter:     2 * time.Second,
+	}, registry)
+	if err != nil {
+		t.Fatalf("NewLoadShedder() error = %v", err)
+	}
+
+	// Create a handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	normal := shedder.Middleware(PriorityNormal, log)(handler)
+	critical := shedder.Middleware(PriorityCritical, log)(handler)
+
+	// Simulate eight requests in flight
+	shedder.inFlight.Add(8)
+
+	send := func(h http.Handler, setup func(r *http.Request) *http.Request) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/api", nil)
+		if setup != nil {
+			req = setup(req)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// Test cases
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		setup    func(r *http.Request) *http.Request
+		wantCode int
+	}{
+		{name: "normal route", handler: normal, wantCode: http.StatusOK},
+		{
+			name:    "low priority header",
+			handler: normal,
+			setup: func(r *http.Request) *http.Request {
+				r.Header.Set("X-Priority", "low")
+				return r
+			},
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{name: "critical route", handler: critical, wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := send(tt.handler, tt.setup); w.Code != tt.wantCode {
+				t.Errorf("status code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+
+	// At nine requests in flight normal requests are shed, plans can raise the priority
+	shedder.inFlight.Add(1)
+	w := send(normal, nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("normal status code = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want %q", got, "2")
+	}
+	gold := func(r *http.Request) *http.Request {
+		return WithConsumer(r, &Consumer{ID: "acme", Plan: "gold"})
+	}
+	if w := send(normal, gold); w.Code != http.StatusOK {
+		t.Errorf("gold plan status code = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	// At the limit only critical requests are admitted
+	shedder.inFlight.Add(1)
+	if w := send(normal, gold); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("gold plan status code at limit = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+	if w := send(critical, nil); w.Code != http.StatusOK {
+		t.Errorf("critical status code at limit = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	// Shed requests are counted by priority
+	if got := registry.Counter("load_shed_total", "priority", "normal").Value(); got != 1 {
+		t.Errorf("shed normal requests = %v, want %v", got, 1)
+	}
+}
+
+func TestLoadShedderQueueLatency(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a shedder allowing 100ms of queue latency
+	shedder, err := NewLoadShedder(LoadShedderConfig{MaxQueueLatency: 100 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatalf("NewLoadShedder() error = %v", err)
+	}
+	handler := ArrivalMiddleware()(shedder.Middleware(PriorityLow, log)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	// Requests without delay are admitted
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status code = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	// Requests that waited long push the shedder into overload
+	for i := 0; i < 20; i++ {
+		req := WithArrival(httptest.NewRequest("GET", "http://example.com/api", nil), time.Now().Add(-time.Second))
+		shedder.Middleware(PriorityLow, log)(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if pressure := shedder.Pressure(); pressure < 1 {
+		t.Errorf("Pressure() = %v, want at least 1", pressure)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestLoadShedderCPU(t *testing.T) {
+	// Create a shedder allowing half of the CPU, with a fake clock and CPU time
+	shedder, err := NewLoadShedder(LoadShedderConfig{MaxCPU: 0.5}, nil)
+	if err != nil {
+		t.Fatalf("NewLoadShedder() error = %v", err)
+	}
+	now := time.Now()
+	var used time.Duration
+	shedder.now = func() time.Time { return now }
+	shedder.cpuTime = func() (time.Duration, bool) { return used, true }
+	procs := time.Duration(runtime.GOMAXPROCS(0))
+
+	// Test cases
+	tests := []struct {
+		name string
+		used time.Duration // CPU time used over one second
+		want float64
+	}{
+		{name: "idle", used: 0, want: 0},
+		{name: "a quarter", used: procs * 250 * time.Millisecond, want: 0.5},
+		{name: "busy", used: procs * 600 * time.Millisecond, want: 1.2},
+	}
+
+	shedder.Pressure()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(time.Second)
+			used += tt.used
+			if got := shedder.Pressure(); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Pressure() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The utilization is kept between samples
+	now = now.Add(sampleInterval / 2)
+	used += time.Hour
+	if got := shedder.Pressure(); math.Abs(got-1.2) > 1e-9 {
+		t.Errorf("Pressure() between samples = %v, want %v", got, 1.2)
+	}
+}
@@ -7,11 +7,13 @@ import (
 	"github.com/mstgnz/goteway/pkg/logger"
 )
 
-// LoggingMiddleware creates a middleware that logs requests
+// LoggingMiddleware creates a middleware that logs requests, including the
+// consumer resolved while serving them
 func LoggingMiddleware(log *logger.Logger) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
+			r = withConsumerSlot(r)
 
 			// Create a custom response writer to capture the status code
 			rw := &responseWriter{
@@ -24,7 +26,11 @@ func LoggingMiddleware(log *logger.Logger) Middleware {
 
 			// Log the request
 			duration := time.Since(start)
-			log.Info("%s %s %s %d %s", r.RemoteAddr, r.Method, r.URL.Path, rw.statusCode, duration)
+			if consumer := ConsumerFrom(r); consumer != nil {
+				log.Info("%s %s %s %d %s consumer=%s", ClientIP(r), r.Method, r.URL.Path, rw.statusCode, duration, consumer.ID)
+				return
+			}
+			log.Info("%s %s %s %d %s", ClientIP(r), r.Method, r.URL.Path, rw.statusCode, duration)
 		})
 	}
 }
@@ -40,3 +46,8 @@ func (rw *responseWriter) WriteHeader(statusCode int) {
 	rw.statusCode = statusCode
 	rw.ResponseWriter.WriteHeader(statusCode)
 }
+
+// Unwrap returns the underlying response writer, so http.ResponseController can reach it
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
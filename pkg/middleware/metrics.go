@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+// MetricsMiddleware creates a middleware that counts requests by consumer and
+// status code. Requests without a consumer are counted as "anonymous".
+func MetricsMiddleware(registry *stats.Registry) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = withConsumerSlot(r)
+			rw := &responseWriter{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
+
+			// Call the next handler
+			next.ServeHTTP(rw, r)
+
+			// Count the request
+			consumer := "anonymous"
+			if c := ConsumerFrom(r); c != nil {
+				consumer = c.ID
+			}
+			registry.Counter("requests_total", "consumer", consumer, "code", strconv.Itoa(rw.statusCode)).Inc()
+		})
+	}
+}
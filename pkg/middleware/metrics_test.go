@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mstgnz/goteway/pkg/stats"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	// Create a handler that resolves a consumer further down the chain
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "" {
+			WithConsumer(r, &Consumer{ID: "acme"})
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	// Apply the metrics middleware
+	registry := stats.NewRegistry()
+	wrappedHandler := MetricsMiddleware(registry)(handler)
+
+	// Make requests
+	for _, key := range []string{"k", "k", ""} {
+		req := httptest.NewRequest("GET", "http://example.com/api", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		wrappedHandler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Check the counters
+	if got := registry.Counter("requests_total", "consumer", "acme", "code", "202").Value(); got != 2 {
+		t.Errorf("acme requests = %v, want %v", got, 2)
+	}
+	if got := registry.Counter("requests_total", "consumer", "anonymous", "code", "202").Value(); got != 1 {
+		t.Errorf("anonymous requests = %v, want %v", got, 1)
+	}
+}
@@ -0,0 +1,354 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+const (
+	// Hourly quotas reset at the start of every hour (UTC)
+	Hourly = "hourly"
+	// Daily quotas reset at midnight (UTC)
+	Daily = "daily"
+	// Monthly quotas reset on the first day of every month (UTC)
+	Monthly = "monthly"
+)
+
+// QuotaPolicy represents a request quota over a calendar period
+type QuotaPolicy struct {
+	Name     string // policies with the same name share their counters
+	Limit    int64
+	Period   string
+	Key      KeyFunc
+	Fallback string // what to do with requests without a key, FallbackIP if empty
+}
+
+// QuotaUsage represents the usage of a quota by one key
+type QuotaUsage struct {
+	Policy string `json:"policy"`
+	Key    string `json:"key"`
+	Period string `json:"period"` // identifier of the calendar period the usage counts for
+	Used   int64  `json:"used"`
+}
+
+// quotaEntry represents the stored usage of a key
+type quotaEntry struct {
+	Period string `json:"period"`
+	Used   int64  `json:"used"`
+}
+
+// QuotaStore represents quota counters persisted to a local file. Counters are
+// kept in memory and written to the file periodically and when the store is
+// closed, so they survive restarts.
+type QuotaStore struct {
+	path    string
+	entries map[string]*quotaEntry
+	dirty   bool
+	mu      sync.Mutex
+	done    chan struct{}
+	wg      sync.WaitGroup
+	now     func() time.Time
+	log     *logger.Logger
+}
+
+// NewQuotaStore creates a new quota store persisted to path, loading any usage
+// saved there. Without a path the counters are only kept in memory. Counters of
+// past periods are dropped with every flush.
+func NewQuotaStore(path string, flushInterval time.Duration, log *logger.Logger) (*QuotaStore, error) {
+	s := &QuotaStore{
+		path:    path,
+		entries: make(map[string]*quotaEntry),
+		done:    make(chan struct{}),
+		now:     time.Now,
+		log:     log,
+	}
+
+	// Load the saved usage
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &s.entries); err != nil {
+				return nil, fmt.Errorf("failed to parse quota store %s: %w", path, err)
+			}
+		}
+	}
+
+	// Flush changes in the background
+	if flushInterval <= 0 {
+		flushInterval = 10 * time.Second
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Flush(); err != nil {
+					s.log.Error("Failed to save quota usage: %v", err)
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// Consume counts one request against the quota of a key if it has any left.
+// It returns the remaining requests and the time until the quota resets.
+func (s *QuotaStore) Consume(policy string, key string, limit int64, period string) (remaining int64, reset time.Duration, ok bool) {
+	now := s.now()
+	current, next := periodBounds(period, now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.entry(policy, key, current)
+	if entry.Used >= limit {
+		return 0, next.Sub(now), false
+	}
+	entry.Used++
+	s.dirty = true
+
+	return limit - entry.Used, next.Sub(now), true
+}
+
+// Refund gives back one request counted by Consume
+func (s *QuotaStore) Refund(policy string, key string, period string) {
+	current, _ := periodBounds(period, s.now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry := s.entry(policy, key, current); entry.Used > 0 {
+		entry.Used--
+		s.dirty = true
+	}
+}
+
+// entry returns the usage entry of a key in the current period, starting a
+// new count when the period has changed. The store must be locked.
+func (s *QuotaStore) entry(policy, key, current string) *quotaEntry {
+	id := policy + "|" + key
+	entry, ok := s.entries[id]
+	if !ok {
+		entry = &quotaEntry{Period: current}
+		s.entries[id] = entry
+	}
+	if entry.Period != current {
+		entry.Period = current
+		entry.Used = 0
+	}
+	return entry
+}
+
+// Usage returns the stored usage, optionally restricted to a policy and key
+func (s *QuotaStore) Usage(policy, key string) []QuotaUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := []QuotaUsage{}
+	for id, entry := range s.entries {
+		entryPolicy, entryKey, _ := strings.Cut(id, "|")
+		if (policy != "" && policy != entryPolicy) || (key != "" && key != entryKey) {
+			continue
+		}
+		usage = append(usage, QuotaUsage{Policy: entryPolicy, Key: entryKey, Period: entry.Period, Used: entry.Used})
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Policy != usage[j].Policy {
+			return usage[i].Policy < usage[j].Policy
+		}
+		return usage[i].Key < usage[j].Key
+	})
+
+	return usage
+}
+
+// Reset clears the usage of a policy, optionally restricted to a key, and
+// returns the number of cleared entries
+func (s *QuotaStore) Reset(policy, key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cleared := 0
+	for id := range s.entries {
+		entryPolicy, entryKey, _ := strings.Cut(id, "|")
+		if entryPolicy == policy && (key == "" || key == entryKey) {
+			delete(s.entries, id)
+			cleared++
+		}
+	}
+	if cleared > 0 {
+		s.dirty = true
+	}
+
+	return cleared
+}
+
+// Flush drops the usage of past periods and writes changed usage to the store file
+func (s *QuotaStore) Flush() error {
+	s.mu.Lock()
+	s.evictLocked()
+	if s.path == "" || !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.entries)
+	s.dirty = false
+	s.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		// Try again with the next flush
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// evictLocked drops the entries of periods that have passed. The store must be locked.
+func (s *QuotaStore) evictLocked() {
+	now := s.now()
+	current := make(map[string]bool, 3)
+	for _, period := range []string{Hourly, Daily, Monthly} {
+		id, _ := periodBounds(period, now)
+		current[id] = true
+	}
+	for id, entry := range s.entries {
+		if !current[entry.Period] {
+			delete(s.entries, id)
+			s.dirty = true
+		}
+	}
+}
+
+// writeFileAtomic replaces a file atomically so a crash never leaves it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Close stops the background flushing and saves the usage
+func (s *QuotaStore) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+		close(s.done)
+	}
+	s.wg.Wait()
+	return s.Flush()
+}
+
+// periodBounds returns the identifier of the period containing now and the start of the next one
+func periodBounds(period string, now time.Time) (string, time.Time) {
+	now = now.UTC()
+	switch period {
+	case Hourly:
+		start := now.Truncate(time.Hour)
+		return start.Format("2006-01-02T15"), start.Add(time.Hour)
+	case Monthly:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), start.AddDate(0, 1, 0)
+	default:
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+	}
+}
+
+// QuotaMiddleware creates a middleware that enforces quotas. Requests are
+// rejected with 429 and the "quota_exceeded" error code once any quota is used up.
+func QuotaMiddleware(store *QuotaStore, log *logger.Logger, policies ...QuotaPolicy) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			type consumed struct {
+				policy QuotaPolicy
+				key    string
+			}
+			var taken []consumed
+			tightest := struct {
+				limit, remaining int64
+				reset            time.Duration
+			}{remaining: -1}
+
+			for _, policy := range policies {
+				key, ok := resolveKey(r, policy.Key, policy.Fallback)
+				if !ok {
+					continue
+				}
+
+				remaining, reset, allowed := int64(0), time.Duration(0), false
+				if key != "" {
+					remaining, reset, allowed = store.Consume(policy.Name, key, policy.Limit, policy.Period)
+				}
+				if !allowed {
+					// Give back what the other policies counted for this request
+					for _, c := range taken {
+						store.Refund(c.policy.Name, c.key, c.policy.Period)
+					}
+
+					// Requests without the key cannot succeed by waiting
+					if key == "" {
+						log.Warn("Quota %s requires a key, rejecting %s %s", policy.Name, r.Method, r.URL.Path)
+						WriteError(w, http.StatusUnauthorized, "unauthorized", "Quota key missing")
+						return
+					}
+
+					log.Warn("Quota %s exceeded for %s", policy.Name, key)
+					setQuotaHeaders(w.Header(), policy.Limit, 0, reset)
+					w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(reset)))
+					WriteError(w, http.StatusTooManyRequests, "quota_exceeded", "Quota exceeded")
+					return
+				}
+
+				taken = append(taken, consumed{policy: policy, key: key})
+				if tightest.remaining < 0 || remaining < tightest.remaining {
+					tightest.limit, tightest.remaining, tightest.reset = policy.Limit, remaining, reset
+				}
+			}
+
+			if tightest.remaining >= 0 {
+				setQuotaHeaders(w.Header(), tightest.limit, tightest.remaining, tightest.reset)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setQuotaHeaders sets the quota headers
+func setQuotaHeaders(header http.Header, limit, remaining int64, reset time.Duration) {
+	header.Set("X-Quota-Limit", strconv.FormatInt(limit, 10))
+	header.Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+	header.Set("X-Quota-Reset", strconv.Itoa(ceilSeconds(reset)))
+}
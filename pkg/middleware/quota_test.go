@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+func TestPeriodBounds(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 34, 56, 0, time.UTC)
+
+	// Test cases
+	tests := []struct {
+		period   string
+		wantID   string
+		wantNext time.Time
+	}{
+		{period: Hourly, wantID: "2026-10-18T12", wantNext: time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC)},
+		{period: Daily, wantID: "2026-10-18", wantNext: time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{period: Monthly, wantID: "2026-10", wantNext: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.period, func(t *testing.T) {
+			id, next := periodBounds(tt.period, now)
+			if id != tt.wantID {
+				t.Errorf("id = %v, want %v", id, tt.wantID)
+			}
+			if !next.Equal(tt.wantNext) {
+				t.Errorf("next = %v, want %v", next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestQuotaStore(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a persisted store
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	store, err := NewQuotaStore(path, time.Hour, log)
+	if err != nil {
+		t.Fatalf("NewQuotaStore() error = %v", err)
+	}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	// Use up a quota of 2
+	for i := 0; i < 2; i++ {
+		if _, _, ok := store.Consume("monthly", "alice", 2, Monthly); !ok {
+			t.Fatalf("request %d not allowed", i)
+		}
+	}
+	remaining, reset, ok := store.Consume("monthly", "alice", 2, Monthly)
+	if ok || remaining != 0 {
+		t.Errorf("Consume() = %v, %v, want exhausted", remaining, ok)
+	}
+	if want := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC).Sub(now); reset != want {
+		t.Errorf("reset = %v, want %v", reset, want)
+	}
+
+	// The usage survives a restart
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	store, err = NewQuotaStore(path, time.Hour, log)
+	if err != nil {
+		t.Fatalf("NewQuotaStore() error = %v", err)
+	}
+	defer store.Close()
+	store.now = func() time.Time { return now }
+	if _, _, ok := store.Consume("monthly", "alice", 2, Monthly); ok {
+		t.Error("quota restored as unused after restart")
+	}
+
+	// A new period starts a new count
+	now = now.AddDate(0, 1, 0)
+	if _, _, ok := store.Consume("monthly", "alice", 2, Monthly); !ok {
+		t.Error("quota not renewed in the next period")
+	}
+
+	// Usage can be inspected and reset
+	usage := store.Usage("monthly", "")
+	if len(usage) != 1 || usage[0].Key != "alice" || usage[0].Used != 1 || usage[0].Period != "2026-11" {
+		t.Errorf("Usage() = %+v", usage)
+	}
+	if cleared := store.Reset("monthly", "alice"); cleared != 1 {
+		t.Errorf("Reset() = %v, want %v", cleared, 1)
+	}
+	if usage := store.Usage("", ""); len(usage) != 0 {
+		t.Errorf("Usage() after reset = %+v, want empty", usage)
+	}
+}
+
+func TestQuotaStoreEviction(t *testing.T) {
+	// Create an in-memory store
+	store, err := NewQuotaStore("", time.Hour, logger.New(logger.INFO))
+	if err != nil {
+		t.Fatalf("NewQuotaStore() error = %v", err)
+	}
+	defer store.Close()
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	store.Consume("hourly", "alice", 10, Hourly)
+	store.Consume("daily", "alice", 10, Daily)
+	store.Consume("monthly", "alice", 10, Monthly)
+
+	// Test cases
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  []string
+	}{
+		{name: "same hour", after: 30 * time.Minute, want: []string{"daily", "hourly", "monthly"}},
+		{name: "next hour", after: time.Hour, want: []string{"daily", "monthly"}},
+		{name: "next day", after: 24 * time.Hour, want: []string{"monthly"}},
+		{name: "next month", after: 31 * 24 * time.Hour, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.after)
+			if err := store.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+			var got []string
+			for _, usage := range store.Usage("", "") {
+				got = append(got, usage.Policy)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("policies after Flush() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaMiddleware(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Apply the quota middleware with a per-key and a shared quota
+	store, err := NewQuotaStore("", 0, log)
+	if err != nil {
+		t.Fatalf("NewQuotaStore() error = %v", err)
+	}
+	tenantKey, _ := ParseKey("header:X-Tenant", "/api")
+	routeKey, _ := ParseKey("route", "/api")
+	wrappedHandler := QuotaMiddleware(store, log,
+		QuotaPolicy{Name: "tenant", Limit: 2, Period: Daily, Key: tenantKey},
+		QuotaPolicy{Name: "route", Limit: 3, Period: Daily, Key: routeKey},
+	)(handler)
+
+	// Make requests
+	var responses []*httptest.ResponseRecorder
+	for _, tenant := range []string{"a", "a", "a", "b", "b"} {
+		req := httptest.NewRequest("GET", "http://example.com/api", nil)
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		wrappedHandler.ServeHTTP(w, req)
+		responses = append(responses, w)
+	}
+
+	// Check the status codes
+	wantCodes := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusOK, http.StatusTooManyRequests}
+	for i, w := range responses {
+		if w.Code != wantCodes[i] {
+			t.Errorf("request %d status code = %v, want %v", i, w.Code, wantCodes[i])
+		}
+	}
+
+	// Allowed responses show the tightest remaining quota
+	if got := responses[1].Header().Get("X-Quota-Remaining"); got != "0" {
+		t.Errorf("X-Quota-Remaining = %q, want %q", got, "0")
+	}
+
+	// Rejections are distinguishable from rate limiting
+	var body ErrorResponse
+	if err := json.NewDecoder(responses[2].Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+	if body.Error != "quota_exceeded" {
+		t.Errorf("error = %q, want %q", body.Error, "quota_exceeded")
+	}
+	if responses[2].Header().Get("Retry-After") == "" {
+		t.Error("Retry-After not set")
+	}
+
+	// The rejected request of tenant a did not count against the route quota
+	if usage := store.Usage("route", ""); len(usage) != 1 || usage[0].Used != 3 {
+		t.Errorf("route usage = %+v, want 3 used", usage)
+	}
+}
+
+func TestQuotaMiddlewareMissingKey(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Apply a quota denying requests without a tenant
+	store, err := NewQuotaStore("", 0, log)
+	if err != nil {
+		t.Fatalf("NewQuotaStore() error = %v", err)
+	}
+	defer store.Close()
+	tenantKey, _ := ParseKey("header:X-Tenant", "/api")
+	wrappedHandler := QuotaMiddleware(store, log,
+		QuotaPolicy{Name: "tenant", Limit: 2, Period: Daily, Key: tenantKey, Fallback: FallbackDeny},
+	)(http.NotFoundHandler())
+
+	// Requests without the key are unauthorized, not told to retry
+	w := httptest.NewRecorder()
+	wrappedHandler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status code = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+	if got := w.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Retry-After = %q, want none", got)
+	}
+}
@@ -1,63 +1,380 @@
 package middleware
 
 import (
+	"fmt"
+	"hash/fnv"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/mstgnz/goteway/pkg/logger"
 )
 
-// RateLimiter represents a rate limiter
+const (
+	// TokenBucket is the token bucket rate limiting algorithm
+	TokenBucket = "tokenbucket"
+	// GCRA is the generic cell rate rate limiting algorithm
+	GCRA = "gcra"
+
+	// HeadersNone emits no rate limit headers besides Retry-After
+	HeadersNone = "none"
+	// HeadersXRateLimit emits the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers
+	HeadersXRateLimit = "xratelimit"
+	// HeadersIETF emits the IETF RateLimit and RateLimit-Policy fields
+	HeadersIETF = "ietf"
+
+	// limiterShards is the number of independently locked key shards
+	limiterShards = 64
+	// minSweepInterval is the minimum time between idle key sweeps of a shard
+	minSweepInterval = time.Minute
+)
+
+// Result represents the outcome of a rate limit check
+type Result struct {
+	Allowed    bool
+	Limit      int           // requests allowed per window
+	Window     time.Duration // window the limit applies to
+	Remaining  int           // requests that may still be made right now
+	RetryAfter time.Duration // wait before the next request is allowed, zero if allowed
+	ResetAfter time.Duration // wait until the limiter is back to its full burst
+}
+
+// Limiter represents a rate limiting algorithm
+type Limiter interface {
+	// Allow consumes one request for the key and reports whether it is allowed
+	Allow(key string) Result
+	// Refund gives back a request consumed by Allow
+	Refund(key string)
+	// Window returns the period the limit applies to
+	Window() time.Duration
+}
+
+// limiterState represents the per-key state of a rate limiter
+type limiterState struct {
+	tokens float64   // token bucket: tokens available at last
+	last   time.Time // token bucket: time of the last update
+	tat    time.Time // gcra: theoretical arrival time
+}
+
+// limiterShard represents a locked subset of the rate limiter keys
+type limiterShard struct {
+	mu        sync.Mutex
+	states    map[string]*limiterState
+	lastSweep time.Time
+}
+
+// RateLimiter represents a rate limiter. It keeps constant-size state per key,
+// spread over shards with their own locks, and evicts keys that have been idle
+// long enough to be back at their full burst.
 type RateLimiter struct {
-	limit   int
-	window  time.Duration
-	clients map[string][]time.Time
-	mu      sync.Mutex
-	log     *logger.Logger
+	algorithm string
+	limit     int
+	window    time.Duration
+	burst     int
+	interval  time.Duration // time to earn one request
+	sweep     time.Duration
+	shards    [limiterShards]limiterShard
+	now       func() time.Time
+	log       *logger.Logger
 }
 
-// NewRateLimiter creates a new rate limiter
+// NewRateLimiter creates a new token bucket rate limiter allowing limit requests
+// per window with a burst of limit
 func NewRateLimiter(limit int, window time.Duration, log *logger.Logger) *RateLimiter {
-	return &RateLimiter{
-		limit:   limit,
-		window:  window,
-		clients: make(map[string][]time.Time),
-		log:     log,
+	limiter, _ := NewLimiter(TokenBucket, limit, window, limit, log)
+	return limiter
+}
+
+// NewLimiter creates a new rate limiter with the given algorithm allowing limit
+// requests per window. burst is the number of requests that may be made at once
+// and defaults to limit.
+func NewLimiter(algorithm string, limit int, window time.Duration, burst int, log *logger.Logger) (*RateLimiter, error) {
+	switch algorithm {
+	case "":
+		algorithm = TokenBucket
+	case TokenBucket, GCRA:
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm: %s", algorithm)
+	}
+	if limit <= 0 || window <= 0 {
+		return nil, fmt.Errorf("rate limit and window must be positive")
+	}
+	if burst <= 0 {
+		burst = limit
+	}
+
+	l := &RateLimiter{
+		algorithm: algorithm,
+		limit:     limit,
+		window:    window,
+		burst:     burst,
+		interval:  window / time.Duration(limit),
+		sweep:     max(window, minSweepInterval),
+		now:       time.Now,
+		log:       log,
+	}
+	for i := range l.shards {
+		l.shards[i].states = make(map[string]*limiterState)
+	}
+
+	return l, nil
+}
+
+// Allow consumes one request for the key and reports whether it is allowed
+func (l *RateLimiter) Allow(key string) Result {
+	now := l.now()
+	shard := l.shard(key)
+
+	shard.mu.Lock()
+	if now.Sub(shard.lastSweep) >= l.sweep {
+		l.evictIdle(shard, now)
+	}
+	state, ok := shard.states[key]
+	if !ok {
+		state = &limiterState{tokens: float64(l.burst), last: now, tat: now}
+		shard.states[key] = state
+	}
+
+	var result Result
+	if l.algorithm == GCRA {
+		result = l.allowGCRA(state, now)
+	} else {
+		result = l.allowTokenBucket(state, now)
+	}
+	shard.mu.Unlock()
+	result.Window = l.window
+
+	if !result.Allowed {
+		l.log.Warn("Rate limit exceeded for %s", key)
+	}
+	return result
+}
+
+// Refund gives back a request consumed by Allow
+func (l *RateLimiter) Refund(key string) {
+	shard := l.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	state, ok := shard.states[key]
+	if !ok {
+		return
+	}
+	if l.algorithm == GCRA {
+		state.tat = state.tat.Add(-l.interval)
+	} else {
+		state.tokens = math.Min(float64(l.burst), state.tokens+1)
+	}
+}
+
+// Window returns the period the limit applies to
+func (l *RateLimiter) Window() time.Duration {
+	return l.window
+}
+
+// allowTokenBucket applies the token bucket algorithm to a key state
+func (l *RateLimiter) allowTokenBucket(state *limiterState, now time.Time) Result {
+	// Refill the bucket for the time passed
+	elapsed := now.Sub(state.last)
+	if elapsed > 0 {
+		state.tokens = math.Min(float64(l.burst), state.tokens+float64(elapsed)/float64(l.interval))
+		state.last = now
+	}
+
+	result := Result{Limit: l.limit}
+	if state.tokens >= 1 {
+		state.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - state.tokens) * float64(l.interval))
+	}
+	result.Remaining = int(state.tokens)
+	result.ResetAfter = time.Duration((float64(l.burst) - state.tokens) * float64(l.interval))
+
+	return result
+}
+
+// allowGCRA applies the generic cell rate algorithm to a key state
+func (l *RateLimiter) allowGCRA(state *limiterState, now time.Time) Result {
+	return gcra(state.tat, now, l.interval, l.burst, l.limit, func(tat time.Time) {
+		state.tat = tat
+	})
+}
+
+// gcra computes a GCRA decision from the theoretical arrival time of a key and
+// calls update with the new arrival time if the request is allowed
+func gcra(tat, now time.Time, interval time.Duration, burst, limit int, update func(time.Time)) Result {
+	tolerance := interval * time.Duration(burst-1)
+	if tat.Before(now) {
+		tat = now
+	}
+
+	result := Result{Limit: limit}
+	if allowAt := tat.Add(-tolerance); now.Before(allowAt) {
+		result.RetryAfter = allowAt.Sub(now)
+		result.ResetAfter = tat.Sub(now)
+		return result
+	}
+
+	tat = tat.Add(interval)
+	update(tat)
+	result.Allowed = true
+	result.ResetAfter = tat.Sub(now)
+	result.Remaining = int((tolerance - result.ResetAfter + interval) / interval)
+
+	return result
+}
+
+// shard returns the shard responsible for a key
+func (l *RateLimiter) shard(key string) *limiterShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &l.shards[h.Sum32()%limiterShards]
+}
+
+// evictIdle removes keys of a locked shard that are back at their full burst
+func (l *RateLimiter) evictIdle(shard *limiterShard, now time.Time) {
+	full := l.interval * time.Duration(l.burst)
+	for key, state := range shard.states {
+		idle := now.Sub(state.last) >= full
+		if l.algorithm == GCRA {
+			idle = !state.tat.After(now)
+		}
+		if idle {
+			delete(shard.states, key)
+		}
 	}
+	shard.lastSweep = now
+}
+
+// RateLimitPolicy represents a rate limit applied to requests grouped by a key
+type RateLimitPolicy struct {
+	Name     string // policy name in the IETF headers
+	Limiter  Limiter
+	Key      KeyFunc
+	Fallback string // what to do with requests without a key, FallbackIP if empty
+}
+
+// policyResult represents the outcome of a rate limit policy for a request
+type policyResult struct {
+	name   string
+	result Result
 }
 
-// RateLimitMiddleware creates a middleware that limits the rate of requests
-func RateLimitMiddleware(limiter *RateLimiter) Middleware {
+// RateLimitMiddleware creates a middleware that limits the rate of requests per client IP
+func RateLimitMiddleware(limiter Limiter) Middleware {
+	return RateLimitPoliciesMiddleware(HeadersXRateLimit, RateLimitPolicy{Name: "ip", Limiter: limiter, Key: ClientIPKey})
+}
+
+// RateLimitPoliciesMiddleware creates a middleware that limits the rate of requests
+// by several policies. A request is rejected if any of the policies rejects it,
+// and then does not count against the policies that allowed it.
+// headers selects the rate limit headers set on allowed and rejected responses.
+func RateLimitPoliciesMiddleware(headers string, policies ...RateLimitPolicy) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			clientIP := r.RemoteAddr
-
-			limiter.mu.Lock()
+			// Resolve the keys first, so requests rejected for lacking one consume nothing
+			type keyedPolicy struct {
+				policy RateLimitPolicy
+				key    string
+			}
+			keyed := make([]keyedPolicy, 0, len(policies))
+			for _, policy := range policies {
+				key, ok := resolveKey(r, policy.Key, policy.Fallback)
+				if !ok {
+					continue
+				}
 
-			// Remove old requests
-			now := time.Now()
-			var requests []time.Time
-			for _, t := range limiter.clients[clientIP] {
-				if now.Sub(t) <= limiter.window {
-					requests = append(requests, t)
+				// Reject requests without a key if the policy says so
+				if key == "" {
+					w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(policy.Limiter.Window())))
+					WriteError(w, http.StatusTooManyRequests, "rate_limited", "Rate limit exceeded")
+					return
 				}
+				keyed = append(keyed, keyedPolicy{policy: policy, key: key})
 			}
 
-			// Check if the client has exceeded the limit
-			if len(requests) >= limiter.limit {
-				limiter.mu.Unlock()
-				limiter.log.Warn("Rate limit exceeded for %s", clientIP)
-				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-				return
+			results := make([]policyResult, 0, len(keyed))
+			for i, kp := range keyed {
+				// Check if the key has exceeded the limit
+				result := kp.policy.Limiter.Allow(kp.key)
+				results = append(results, policyResult{name: kp.policy.Name, result: result})
+				if !result.Allowed {
+					// Give back the requests consumed by the policies that allowed it
+					for _, prev := range keyed[:i] {
+						prev.policy.Limiter.Refund(prev.key)
+					}
+					setRateLimitHeaders(w.Header(), headers, results)
+					w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+					WriteError(w, http.StatusTooManyRequests, "rate_limited", "Rate limit exceeded")
+					return
+				}
 			}
 
-			// Add the current request
-			limiter.clients[clientIP] = append(requests, now)
-			limiter.mu.Unlock()
-
 			// Call the next handler
+			setRateLimitHeaders(w.Header(), headers, results)
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// setRateLimitHeaders sets the rate limit headers of the given style. The
+// X-RateLimit headers describe the most restrictive policy, the IETF fields
+// list every policy.
+func setRateLimitHeaders(header http.Header, style string, results []policyResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	switch style {
+	case HeadersIETF:
+		policies := make([]string, len(results))
+		limits := make([]string, len(results))
+		for i, pr := range results {
+			name := strconv.Quote(pr.name)
+			policies[i] = fmt.Sprintf("%s;q=%d;w=%d", name, pr.result.Limit, ceilSeconds(pr.result.Window))
+			limits[i] = fmt.Sprintf("%s;r=%d;t=%d", name, pr.result.Remaining, ceilSeconds(pr.result.ResetAfter))
+		}
+		header.Set("RateLimit-Policy", strings.Join(policies, ", "))
+		header.Set("RateLimit", strings.Join(limits, ", "))
+	case HeadersNone:
+	default:
+		tightest := results[0].result
+		for _, pr := range results[1:] {
+			if !pr.result.Allowed || pr.result.Remaining < tightest.Remaining {
+				tightest = pr.result
+			}
+		}
+		header.Set("X-RateLimit-Limit", strconv.Itoa(tightest.Limit))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+		header.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.ResetAfter)))
+	}
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// resolveKey returns the key of a request, applying the fallback for requests
+// without one. It returns false if the limit does not apply to the request and
+// an empty key if the request has to be rejected.
+func resolveKey(r *http.Request, keyFunc KeyFunc, fallback string) (string, bool) {
+	if key, ok := keyFunc(r); ok {
+		return key, true
+	}
+
+	switch fallback {
+	case FallbackShared:
+		return "fallback:shared", true
+	case FallbackSkip:
+		return "", false
+	case FallbackDeny:
+		return "", true
+	default:
+		return "fallback:" + ClientIP(r), true
+	}
+}
@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// FallbackIP limits requests without a key by client IP
+	FallbackIP = "ip"
+	// FallbackShared limits all requests without a key together
+	FallbackShared = "shared"
+	// FallbackSkip does not limit requests without a key
+	FallbackSkip = "skip"
+	// FallbackDeny rejects requests without a key
+	FallbackDeny = "deny"
+
+	// DefaultAPIKeyHeader is the header read by the apikey rate limit key
+	DefaultAPIKeyHeader = "X-API-Key"
+)
+
+// KeyFunc extracts the rate limit key of a request and reports whether the request has one
+type KeyFunc func(r *http.Request) (string, bool)
+
+// ClientIPKey keys requests by resolved client IP
+func ClientIPKey(r *http.Request) (string, bool) {
+	return ClientIP(r), true
+}
+
+// ParseKey parses a rate limit key specification into a key function. A
+// specification is one or more parts joined with "+", where a part is one of
+// "ip", "principal", "consumer", "apikey", "apikey:<header>", "header:<name>",
+// "claim:<name>", "param:<name>" or "route". A composite key is missing if any part is.
+func ParseKey(spec, route string) (KeyFunc, error) {
+	if spec == "" {
+		return ClientIPKey, nil
+	}
+
+	var parts []KeyFunc
+	for _, part := range strings.Split(spec, "+") {
+		kind, arg, _ := strings.Cut(strings.TrimSpace(part), ":")
+		switch kind {
+		case "ip":
+			parts = append(parts, ClientIPKey)
+		case "principal":
+			parts = append(parts, principalKey)
+		case "consumer":
+			parts = append(parts, consumerIDKey)
+		case "apikey":
+			if arg == "" {
+				arg = DefaultAPIKeyHeader
+			}
+			parts = append(parts, apiKeyKey(arg))
+		case "header":
+			if arg == "" {
+				return nil, fmt.Errorf("header rate limit key needs a header name")
+			}
+			parts = append(parts, headerKey(arg))
+		case "claim":
+			if arg == "" {
+				return nil, fmt.Errorf("claim rate limit key needs a claim name")
+			}
+			parts = append(parts, claimKey(arg))
+		case "param":
+			if arg == "" {
+				return nil, fmt.Errorf("param rate limit key needs a parameter name")
+			}
+			parts = append(parts, paramKey(arg))
+		case "route":
+			parts = append(parts, func(r *http.Request) (string, bool) {
+				return route, true
+			})
+		default:
+			return nil, fmt.Errorf("unknown rate limit key: %s", part)
+		}
+	}
+
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return func(r *http.Request) (string, bool) {
+		values := make([]string, len(parts))
+		for i, part := range parts {
+			value, ok := part(r)
+			if !ok {
+				return "", false
+			}
+			values[i] = value
+		}
+		return strings.Join(values, "|"), true
+	}, nil
+}
+
+// principalKey keys requests by authenticated principal
+func principalKey(r *http.Request) (string, bool) {
+	principal := Principal(r)
+	return principal, principal != ""
+}
+
+// apiKeyKey keys requests by a hash of their API key, so keys never end up in memory dumps or logs
+func apiKeyKey(header string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		key := r.Header.Get(header)
+		if key == "" {
+			return "", false
+		}
+		return HashAPIKey(key), true
+	}
+}
+
+// HashAPIKey returns the identifier an API key is counted under by the apikey key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "apikey:" + hex.EncodeToString(sum[:8])
+}
+
+// headerKey keys requests by the value of a header
+func headerKey(header string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		value := r.Header.Get(header)
+		return value, value != ""
+	}
+}
+
+// claimKey keys requests by a claim of the authenticated token
+func claimKey(claim string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		identity := IdentityFrom(r)
+		if identity == nil {
+			return "", false
+		}
+		value, ok := identity.Claims[claim]
+		if !ok || value == nil {
+			return "", false
+		}
+		return fmt.Sprint(value), true
+	}
+}
+
+// paramKey keys requests by a parameter captured from their path
+func paramKey(name string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		value := PathParam(r, name)
+		return value, value != ""
+	}
+}
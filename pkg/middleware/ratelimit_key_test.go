@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+func TestParseKey(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		name     string
+		spec     string
+		setup    func(*http.Request) *http.Request
+		wantKey  string
+		wantOK   bool
+		wantHash bool
+	}{
+		{
+			name:    "default client ip",
+			spec:    "",
+			setup:   func(r *http.Request) *http.Request { return r },
+			wantKey: "192.168.1.1",
+			wantOK:  true,
+		},
+		{
+			name: "principal",
+			spec: "principal",
+			setup: func(r *http.Request) *http.Request {
+				return WithIdentity(r, &Identity{Principal: "alice"})
+			},
+			wantKey: "alice",
+			wantOK:  true,
+		},
+		{
+			name:   "missing principal",
+			spec:   "principal",
+			setup:  func(r *http.Request) *http.Request { return r },
+			wantOK: false,
+		},
+		{
+			name: "api key is hashed",
+			spec: "apikey",
+			setup: func(r *http.Request) *http.Request {
+				r.Header.Set("X-API-Key", "secret-key")
+				return r
+			},
+			wantOK:   true,
+			wantHash: true,
+		},
+		{
+			name: "header",
+			spec: "header:X-Tenant",
+			setup: func(r *http.Request) *http.Request {
+				r.Header.Set("X-Tenant", "acme")
+				return r
+			},
+			wantKey: "acme",
+			wantOK:  true,
+		},
+		{
+			name: "claim",
+			spec: "claim:org",
+			setup: func(r *http.Request) *http.Request {
+				return WithIdentity(r, &Identity{Claims: map[string]any{"org": "acme"}})
+			},
+			wantKey: "acme",
+			wantOK:  true,
+		},
+		{
+			name: "path parameter",
+			spec: "param:tenant",
+			setup: func(r *http.Request) *http.Request {
+				return WithPathParams(r, map[string]string{"tenant": "acme"})
+			},
+			wantKey: "acme",
+			wantOK:  true,
+		},
+		{
+			name: "consumer",
+			spec: "consumer",
+			setup: func(r *http.Request) *http.Request {
+				return WithConsumer(r, &Consumer{ID: "globex"})
+			},
+			wantKey: "globex",
+			wantOK:  true,
+		},
+		{
+			name:    "route",
+			spec:    "route",
+			setup:   func(r *http.Request) *http.Request { return r },
+			wantKey: "/api/users",
+			wantOK:  true,
+		},
+		{
+			name: "composite",
+			spec: "principal+route",
+			setup: func(r *http.Request) *http.Request {
+				return WithIdentity(r, &Identity{Principal: "alice"})
+			},
+			wantKey: "alice|/api/users",
+			wantOK:  true,
+		},
+		{
+			name:   "composite with missing part",
+			spec:   "principal+route",
+			setup:  func(r *http.Request) *http.Request { return r },
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Parse the key
+			keyFunc, err := ParseKey(tt.spec, "/api/users")
+			if err != nil {
+				t.Fatalf("ParseKey() error = %v", err)
+			}
+
+			// Create a request
+			req := httptest.NewRequest("GET", "http://example.com/api/users", nil)
+			req.RemoteAddr = "192.168.1.1:12345"
+			req = tt.setup(req)
+
+			// Check the key
+			key, ok := keyFunc(req)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if tt.wantHash {
+				if !strings.HasPrefix(key, "apikey:") || strings.Contains(key, "secret-key") {
+					t.Errorf("key = %q, want hashed api key", key)
+				}
+				return
+			}
+			if key != tt.wantKey {
+				t.Errorf("key = %q, want %q", key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestParseKeyErrors(t *testing.T) {
+	for _, spec := range []string{"cookie", "header", "claim:", "param", "ip+unknown"} {
+		if _, err := ParseKey(spec, "/api"); err == nil {
+			t.Errorf("ParseKey(%q) error = nil, want error", spec)
+		}
+	}
+}
+
+func TestRateLimitPoliciesMiddleware(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// newPolicy creates a policy allowing limit requests per minute
+	newPolicy := func(limit int, spec, fallback string) RateLimitPolicy {
+		limiter, err := NewLimiter(TokenBucket, limit, time.Minute, 0, log)
+		if err != nil {
+			t.Fatalf("NewLimiter() error = %v", err)
+		}
+		key, err := ParseKey(spec, "/api")
+		if err != nil {
+			t.Fatalf("ParseKey() error = %v", err)
+		}
+		return RateLimitPolicy{Limiter: limiter, Key: key, Fallback: fallback}
+	}
+
+	// Test cases
+	tests := []struct {
+		name        string
+		policies    []RateLimitPolicy
+		tenants     []string
+		wantAllowed int
+	}{
+		{
+			name:        "per header value",
+			policies:    []RateLimitPolicy{newPolicy(2, "header:X-Tenant", "")},
+			tenants:     []string{"a", "a", "a", "b", "b"},
+			wantAllowed: 4,
+		},
+		{
+			name:        "route limit across keys",
+			policies:    []RateLimitPolicy{newPolicy(2, "header:X-Tenant", ""), newPolicy(3, "route", "")},
+			tenants:     []string{"a", "b", "c", "d"},
+			wantAllowed: 3,
+		},
+		{
+			name:        "fallback to client ip",
+			policies:    []RateLimitPolicy{newPolicy(2, "header:X-Tenant", FallbackIP)},
+			tenants:     []string{"", "", ""},
+			wantAllowed: 2,
+		},
+		{
+			name:        "fallback skip",
+			policies:    []RateLimitPolicy{newPolicy(1, "header:X-Tenant", FallbackSkip)},
+			tenants:     []string{"", "", ""},
+			wantAllowed: 3,
+		},
+		{
+			name:        "fallback deny",
+			policies:    []RateLimitPolicy{newPolicy(5, "header:X-Tenant", FallbackDeny)},
+			tenants:     []string{"", "a"},
+			wantAllowed: 1,
+		},
+		{
+			name:        "fallback deny after another policy",
+			policies:    []RateLimitPolicy{newPolicy(1, "route", ""), newPolicy(5, "header:X-Tenant", FallbackDeny)},
+			tenants:     []string{"", "a"},
+			wantAllowed: 1,
+		},
+		{
+			name:        "rejected requests are refunded",
+			policies:    []RateLimitPolicy{newPolicy(2, "route", ""), newPolicy(1, "header:X-Tenant", "")},
+			tenants:     []string{"a", "a", "b"},
+			wantAllowed: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Apply the rate limit middleware
+			wrappedHandler := RateLimitPoliciesMiddleware(HeadersNone, tt.policies...)(handler)
+
+			// Make requests
+			allowed := 0
+			for _, tenant := range tt.tenants {
+				req := httptest.NewRequest("GET", "http://example.com/api", nil)
+				req.RemoteAddr = "192.168.1.1:12345"
+				if tenant != "" {
+					req.Header.Set("X-Tenant", tenant)
+				}
+				w := httptest.NewRecorder()
+				wrappedHandler.ServeHTTP(w, req)
+				if w.Code == http.StatusOK {
+					allowed++
+				}
+			}
+
+			// Check results
+			if allowed != tt.wantAllowed {
+				t.Errorf("Allowed requests = %v, want %v", allowed, tt.wantAllowed)
+			}
+		})
+	}
+
+	// Requests denied for lacking a key are told when to retry
+	wrappedHandler := RateLimitPoliciesMiddleware(HeadersNone, newPolicy(5, "header:X-Tenant", FallbackDeny))(handler)
+	w := httptest.NewRecorder()
+	wrappedHandler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("denied response = %v with Retry-After %q, want %v with %q", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests, "60")
+	}
+}
@@ -0,0 +1,305 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// redisDialCooldown is the time after a failed connection attempt during which
+// no new connections are attempted, so requests fail fast while the server is down
+const redisDialCooldown = time.Second
+
+// errRedisCooldown is returned while connection attempts are paused
+var errRedisCooldown = errors.New("redis server unreachable, retrying later")
+
+// gcraScript applies the GCRA algorithm atomically on the Redis server. Times
+// are in microseconds and taken from the server clock, so replicas with
+// skewed clocks still agree. It returns {allowed, retry after, reset after}.
+const gcraScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local tolerance = interval * (burst - 1)
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then tat = now end
+local allow_at = tat - tolerance
+if now < allow_at then
+  return {0, allow_at - now, tat - now}
+end
+tat = tat + interval
+redis.call('SET', KEYS[1], tat, 'PX', math.ceil((tat - now) / 1000))
+return {1, 0, tat - now}
+`
+
+// refundScript gives back one interval of a key that has not expired yet.
+// DECRBY keeps the expiry of the key.
+const refundScript = `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+  redis.call('DECRBY', KEYS[1], ARGV[1])
+end
+return 0
+`
+
+// gcraScriptSHA and refundScriptSHA are the SHA1 digests Redis knows the scripts by
+var (
+	gcraScriptSHA   = scriptSHA(gcraScript)
+	refundScriptSHA = scriptSHA(refundScript)
+)
+
+// scriptSHA returns the SHA1 digest of a script
+func scriptSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// redisError represents an error reply from a Redis server
+type redisError string
+
+// Error returns the error message
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// RedisStore represents a rate limit store on a Redis protocol compatible server
+type RedisStore struct {
+	address  string
+	password string
+	db       int
+	prefix   string
+	timeout  time.Duration
+	pool     chan *redisConn
+	retryAt  atomic.Int64 // unix nanoseconds before which no connection is attempted
+}
+
+// NewRedisStore creates a new Redis rate limit store. Keys are prefixed with
+// prefix. Up to poolSize idle connections are kept open.
+func NewRedisStore(address, password string, db int, prefix string, timeout time.Duration, poolSize int) *RedisStore {
+	if timeout <= 0 {
+		timeout = 100 * time.Millisecond
+	}
+	if poolSize <= 0 {
+		poolSize = 10
+	}
+
+	return &RedisStore{
+		address:  address,
+		password: password,
+		db:       db,
+		prefix:   prefix,
+		timeout:  timeout,
+		pool:     make(chan *redisConn, poolSize),
+	}
+}
+
+// AllowGCRA consumes one request for the key
+func (s *RedisStore) AllowGCRA(key string, interval time.Duration, burst int) (Result, error) {
+	reply, err := s.eval(gcraScript, gcraScriptSHA, s.prefix+key, strconv.FormatInt(interval.Microseconds(), 10), strconv.Itoa(burst))
+	if err != nil {
+		return Result{}, err
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 3 {
+		return Result{}, fmt.Errorf("unexpected GCRA script reply: %v", reply)
+	}
+	numbers := make([]int64, len(values))
+	for i, value := range values {
+		if numbers[i], ok = value.(int64); !ok {
+			return Result{}, fmt.Errorf("unexpected GCRA script reply: %v", reply)
+		}
+	}
+
+	result := Result{
+		Allowed:    numbers[0] == 1,
+		RetryAfter: time.Duration(numbers[1]) * time.Microsecond,
+		ResetAfter: time.Duration(numbers[2]) * time.Microsecond,
+	}
+	if result.Allowed {
+		tolerance := interval * time.Duration(burst-1)
+		result.Remaining = int((tolerance - result.ResetAfter + interval) / interval)
+	}
+	return result, nil
+}
+
+// RefundGCRA gives back a request consumed by AllowGCRA
+func (s *RedisStore) RefundGCRA(key string, interval time.Duration) error {
+	_, err := s.eval(refundScript, refundScriptSHA, s.prefix+key, strconv.FormatInt(interval.Microseconds(), 10))
+	return err
+}
+
+// eval runs a script on one key by its digest, loading it on first use
+func (s *RedisStore) eval(script, sha, key string, args ...string) (any, error) {
+	args = append([]string{"1", key}, args...)
+	reply, err := s.do(append([]string{"EVALSHA", sha}, args...)...)
+	if rerr, ok := err.(redisError); ok && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		reply, err = s.do(append([]string{"EVAL", script}, args...)...)
+	}
+	return reply, err
+}
+
+// Close closes the idle connections of the store
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case conn := <-s.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do runs a command on a pooled connection
+func (s *RedisStore) do(args ...string) (any, error) {
+	conn, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(s.timeout, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// The connection state is unknown after I/O errors
+		conn.Close()
+		return nil, err
+	}
+
+	s.put(conn)
+	return reply, err
+}
+
+// get takes an idle connection from the pool or opens a new one
+func (s *RedisStore) get() (*redisConn, error) {
+	select {
+	case conn := <-s.pool:
+		return conn, nil
+	default:
+	}
+
+	if time.Now().UnixNano() < s.retryAt.Load() {
+		return nil, errRedisCooldown
+	}
+	netConn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err != nil {
+		s.retryAt.Store(time.Now().Add(redisDialCooldown).UnixNano())
+		return nil, err
+	}
+	conn := &redisConn{conn: netConn, rd: bufio.NewReader(netConn)}
+
+	if s.password != "" {
+		if _, err := conn.do(s.timeout, "AUTH", s.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis authentication failed: %w", err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := conn.do(s.timeout, "SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis database selection failed: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// put returns a connection to the pool, closing it if the pool is full
+func (s *RedisStore) put(conn *redisConn) {
+	select {
+	case s.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// redisConn represents a connection speaking the Redis serialization protocol
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// Close closes the connection
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, cmd.String()); err != nil {
+		return nil, err
+	}
+
+	return readRESP(c.rd)
+}
+
+// readRESP reads one reply in the Redis serialization protocol. Error replies
+// are returned as redisError.
+func readRESP(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("malformed RESP line")
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		values := make([]any, count)
+		for i := range values {
+			value, err := readRESP(rd)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unknown RESP type %q", kind)
+	}
+}
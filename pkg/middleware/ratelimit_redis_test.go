@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+// fakeRedis is a local Redis protocol stand-in that emulates the GCRA and refund scripts
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	mu       sync.Mutex
+	tats     map[string]int64
+	loaded   map[string]bool
+	evals    int
+}
+
+// newFakeRedis starts a Redis protocol stand-in on a local port
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	f := &fakeRedis{listener: listener, password: password, tats: make(map[string]int64), loaded: make(map[string]bool)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+// serve answers the commands of one connection
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authenticated := f.password == ""
+
+	for {
+		reply, err := readRESP(rd)
+		if err != nil {
+			return
+		}
+		values, _ := reply.([]any)
+		args := make([]string, len(values))
+		for i, value := range values {
+			args[i], _ = value.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		switch {
+		case args[0] == "AUTH":
+			if args[1] != f.password {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authenticated = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authenticated:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "SELECT":
+			fmt.Fprint(conn, "+OK\r\n")
+		case args[0] == "EVALSHA":
+			f.mu.Lock()
+			loaded := f.loaded[args[1]]
+			f.mu.Unlock()
+			if !loaded {
+				fmt.Fprint(conn, "-NOSCRIPT No matching script. Please use EVAL.\r\n")
+				continue
+			}
+			fmt.Fprint(conn, f.script(args[1], args[3:]))
+		case args[0] == "EVAL":
+			sha := scriptSHA(args[1])
+			f.mu.Lock()
+			f.loaded[sha] = true
+			f.evals++
+			f.mu.Unlock()
+			fmt.Fprint(conn, f.script(sha, args[3:]))
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+// script emulates the script with a digest and returns its encoded reply
+func (f *fakeRedis) script(sha string, args []string) string {
+	switch sha {
+	case gcraScriptSHA:
+		return f.gcra(args[0], args[1], args[2])
+	case refundScriptSHA:
+		interval, _ := strconv.ParseInt(args[1], 10, 64)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if tat, ok := f.tats[args[0]]; ok {
+			f.tats[args[0]] = tat - interval
+		}
+		return ":0\r\n"
+	default:
+		return "-ERR unknown script\r\n"
+	}
+}
+
+// gcra emulates the GCRA script and returns its encoded reply
+func (f *fakeRedis) gcra(key, intervalArg, burstArg string) string {
+	interval, _ := strconv.ParseInt(intervalArg, 10, 64)
+	burst, _ := strconv.ParseInt(burstArg, 10, 64)
+	now := time.Now().UnixMicro()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tolerance := interval * (burst - 1)
+	tat := max(f.tats[key], now)
+	if allowAt := tat - tolerance; now < allowAt {
+		return fmt.Sprintf("*3\r\n:0\r\n:%d\r\n:%d\r\n", allowAt-now, tat-now)
+	}
+	tat += interval
+	f.tats[key] = tat
+	return fmt.Sprintf("*3\r\n:1\r\n:0\r\n:%d\r\n", tat-now)
+}
+
+func TestRedisStore(t *testing.T) {
+	// Start a Redis stand-in
+	server := newFakeRedis(t, "secret")
+
+	// Create a store
+	store := NewRedisStore(server.listener.Addr().String(), "secret", 1, "goteway:", time.Second, 2)
+	defer store.Close()
+
+	// The burst is allowed at once
+	for i := 0; i < 3; i++ {
+		result, err := store.AllowGCRA("client", time.Second, 3)
+		if err != nil {
+			t.Fatalf("AllowGCRA() error = %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("request %d not allowed", i)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("request %d Remaining = %v, want %v", i, result.Remaining, 2-i)
+		}
+	}
+
+	// The next request is rejected
+	result, err := store.AllowGCRA("client", time.Second, 3)
+	if err != nil {
+		t.Fatalf("AllowGCRA() error = %v", err)
+	}
+	if result.Allowed {
+		t.Error("request over burst allowed")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Errorf("RetryAfter = %v, want within (0, 1s]", result.RetryAfter)
+	}
+
+	// The script is only sent once, later calls use its digest
+	if server.evals != 1 {
+		t.Errorf("EVAL calls = %v, want %v", server.evals, 1)
+	}
+	if _, ok := server.tats["goteway:client"]; !ok {
+		t.Error("key not prefixed")
+	}
+
+	// A refunded request can be made again
+	if err := store.RefundGCRA("client", time.Second); err != nil {
+		t.Fatalf("RefundGCRA() error = %v", err)
+	}
+	if result, err := store.AllowGCRA("client", time.Second, 3); err != nil || !result.Allowed {
+		t.Errorf("AllowGCRA() after refund = %+v, %v, want allowed", result, err)
+	}
+}
+
+func TestRedisStoreErrors(t *testing.T) {
+	// Wrong password
+	server := newFakeRedis(t, "secret")
+	store := NewRedisStore(server.listener.Addr().String(), "wrong", 0, "", time.Second, 1)
+	if _, err := store.AllowGCRA("client", time.Second, 1); err == nil {
+		t.Error("AllowGCRA() with wrong password error = nil, want error")
+	}
+
+	// Unreachable server falls back to a local limiter
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	store = NewRedisStore(address, "", 0, "", 50*time.Millisecond, 1)
+	limiter, err := NewStoreLimiter(store, "/api", 1, time.Minute, 0, FailureLocal, logger.New(logger.INFO))
+	if err != nil {
+		t.Fatalf("NewStoreLimiter() error = %v", err)
+	}
+	if !limiter.Allow("client").Allowed {
+		t.Error("first request not allowed by local fallback")
+	}
+	if limiter.Allow("client").Allowed {
+		t.Error("second request allowed by local fallback")
+	}
+
+	// Connections are not attempted again until the cooldown has passed
+	if _, err := store.AllowGCRA("client", time.Second, 1); !errors.Is(err, errRedisCooldown) {
+		t.Errorf("AllowGCRA() during cooldown error = %v, want %v", err, errRedisCooldown)
+	}
+	store.retryAt.Store(0)
+	if _, err := store.AllowGCRA("client", time.Second, 1); err == nil || errors.Is(err, errRedisCooldown) {
+		t.Errorf("AllowGCRA() after cooldown error = %v, want a connection error", err)
+	}
+}
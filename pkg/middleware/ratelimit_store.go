@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+const (
+	// FailureLocal falls back to an in-process limiter when the store is unreachable
+	FailureLocal = "local"
+	// FailureAllow allows all requests when the store is unreachable
+	FailureAllow = "allow"
+	// FailureDeny rejects all requests when the store is unreachable
+	FailureDeny = "deny"
+)
+
+// RateLimitStore represents storage for rate limit state that can be shared
+// between gateway replicas. Implementations apply the GCRA algorithm atomically,
+// so concurrent replicas never admit more than the configured limit.
+type RateLimitStore interface {
+	// AllowGCRA consumes one request for the key, earning one request per interval
+	// with the given burst
+	AllowGCRA(key string, interval time.Duration, burst int) (Result, error)
+	// RefundGCRA gives back a request consumed by AllowGCRA
+	RefundGCRA(key string, interval time.Duration) error
+}
+
+// MemoryStore represents an in-process rate limit store
+type MemoryStore struct {
+	tats      map[string]time.Time
+	lastSweep time.Time
+	mu        sync.Mutex
+	now       func() time.Time
+}
+
+// NewMemoryStore creates a new in-process rate limit store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tats: make(map[string]time.Time),
+		now:  time.Now,
+	}
+}
+
+// AllowGCRA consumes one request for the key
+func (s *MemoryStore) AllowGCRA(key string, interval time.Duration, burst int) (Result, error) {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget keys whose arrival time has passed, they are back at their full burst
+	if now.Sub(s.lastSweep) >= minSweepInterval {
+		for k, tat := range s.tats {
+			if !tat.After(now) {
+				delete(s.tats, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	return gcra(s.tats[key], now, interval, burst, 0, func(tat time.Time) {
+		s.tats[key] = tat
+	}), nil
+}
+
+// RefundGCRA gives back a request consumed by AllowGCRA
+func (s *MemoryStore) RefundGCRA(key string, interval time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tat, ok := s.tats[key]; ok {
+		s.tats[key] = tat.Add(-interval)
+	}
+	return nil
+}
+
+// StoreLimiter represents a rate limiter keeping its state in a rate limit store
+type StoreLimiter struct {
+	store       RateLimitStore
+	namespace   string
+	limit       int
+	window      time.Duration
+	burst       int
+	interval    time.Duration
+	failureMode string
+	local       *RateLimiter
+	degraded    atomic.Bool
+	log         *logger.Logger
+}
+
+// NewStoreLimiter creates a new rate limiter backed by a store. Keys are prefixed
+// with namespace so limiters sharing a store do not collide. failureMode decides
+// what happens while the store is unreachable and defaults to FailureLocal.
+func NewStoreLimiter(store RateLimitStore, namespace string, limit int, window time.Duration, burst int, failureMode string, log *logger.Logger) (*StoreLimiter, error) {
+	switch failureMode {
+	case "":
+		failureMode = FailureLocal
+	case FailureLocal, FailureAllow, FailureDeny:
+	default:
+		return nil, fmt.Errorf("unknown rate limit store failure mode: %s", failureMode)
+	}
+
+	// The local limiter doubles as validation of the limit settings
+	local, err := NewLimiter(GCRA, limit, window, burst, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StoreLimiter{
+		store:       store,
+		namespace:   namespace,
+		limit:       limit,
+		window:      window,
+		burst:       local.burst,
+		interval:    local.interval,
+		failureMode: failureMode,
+		local:       local,
+		log:         log,
+	}, nil
+}
+
+// Allow consumes one request for the key and reports whether it is allowed
+func (l *StoreLimiter) Allow(key string) Result {
+	result, err := l.store.AllowGCRA(l.namespace+":"+key, l.interval, l.burst)
+	if err != nil {
+		if !l.degraded.Swap(true) {
+			l.log.Error("Rate limit store unreachable, using failure mode %s: %v", l.failureMode, err)
+		}
+
+		switch l.failureMode {
+		case FailureAllow:
+			return Result{Allowed: true, Limit: l.limit, Window: l.window, Remaining: l.burst}
+		case FailureDeny:
+			return Result{Limit: l.limit, Window: l.window, RetryAfter: l.interval}
+		default:
+			return l.local.Allow(key)
+		}
+	}
+	if l.degraded.Swap(false) {
+		l.log.Info("Rate limit store reachable again")
+	}
+
+	result.Limit = l.limit
+	result.Window = l.window
+	if !result.Allowed {
+		l.log.Warn("Rate limit exceeded for %s", key)
+	}
+	return result
+}
+
+// Refund gives back a request consumed by Allow
+func (l *StoreLimiter) Refund(key string) {
+	if err := l.store.RefundGCRA(l.namespace+":"+key, l.interval); err != nil && l.failureMode == FailureLocal {
+		l.local.Refund(key)
+	}
+}
+
+// Window returns the period the limit applies to
+func (l *StoreLimiter) Window() time.Duration {
+	return l.window
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+// failingStore is a rate limit store that is always unreachable
+type failingStore struct{}
+
+func (failingStore) AllowGCRA(key string, interval time.Duration, burst int) (Result, error) {
+	return Result{}, errors.New("connection refused")
+}
+
+func (failingStore) RefundGCRA(key string, interval time.Duration) error {
+	return errors.New("connection refused")
+}
+
+func TestMemoryStore(t *testing.T) {
+	// Create a store
+	store := NewMemoryStore()
+	now := time.Unix(1000, 0)
+	store.now = func() time.Time { return now }
+
+	// The burst is allowed at once
+	for i := 0; i < 2; i++ {
+		result, err := store.AllowGCRA("client", 100*time.Millisecond, 2)
+		if err != nil {
+			t.Fatalf("AllowGCRA() error = %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("request %d not allowed", i)
+		}
+	}
+
+	// The next request has to wait
+	result, _ := store.AllowGCRA("client", 100*time.Millisecond, 2)
+	if result.Allowed {
+		t.Error("request over burst allowed")
+	}
+	if result.RetryAfter != 100*time.Millisecond {
+		t.Errorf("RetryAfter = %v, want %v", result.RetryAfter, 100*time.Millisecond)
+	}
+
+	// Idle keys are forgotten
+	now = now.Add(2 * minSweepInterval)
+	store.AllowGCRA("other", 100*time.Millisecond, 2)
+	if _, ok := store.tats["client"]; ok {
+		t.Error("idle key not evicted")
+	}
+}
+
+func TestStoreLimiter(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Two limiters sharing a store behave like one
+	store := NewMemoryStore()
+	first, err := NewStoreLimiter(store, "/api", 3, time.Minute, 0, "", log)
+	if err != nil {
+		t.Fatalf("NewStoreLimiter() error = %v", err)
+	}
+	second, err := NewStoreLimiter(store, "/api", 3, time.Minute, 0, "", log)
+	if err != nil {
+		t.Fatalf("NewStoreLimiter() error = %v", err)
+	}
+
+	allowed := 0
+	for i := 0; i < 3; i++ {
+		if first.Allow("client").Allowed {
+			allowed++
+		}
+		if second.Allow("client").Allowed {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("Allowed requests = %v, want %v", allowed, 3)
+	}
+
+	// Namespaces keep limiters apart
+	other, err := NewStoreLimiter(store, "/other", 3, time.Minute, 0, "", log)
+	if err != nil {
+		t.Fatalf("NewStoreLimiter() error = %v", err)
+	}
+	if !other.Allow("client").Allowed {
+		t.Error("other namespace not allowed")
+	}
+}
+
+func TestStoreLimiterFailureModes(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Test cases
+	tests := []struct {
+		failureMode string
+		wantAllowed int
+	}{
+		{failureMode: FailureLocal, wantAllowed: 2},
+		{failureMode: FailureAllow, wantAllowed: 5},
+		{failureMode: FailureDeny, wantAllowed: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.failureMode, func(t *testing.T) {
+			// Create a limiter on an unreachable store
+			limiter, err := NewStoreLimiter(failingStore{}, "/api", 2, time.Minute, 0, tt.failureMode, log)
+			if err != nil {
+				t.Fatalf("NewStoreLimiter() error = %v", err)
+			}
+
+			// Make requests
+			allowed := 0
+			for i := 0; i < 5; i++ {
+				if limiter.Allow("client").Allowed {
+					allowed++
+				}
+			}
+
+			// Check results
+			if allowed != tt.wantAllowed {
+				t.Errorf("Allowed requests = %v, want %v", allowed, tt.wantAllowed)
+			}
+		})
+	}
+
+	if _, err := NewStoreLimiter(failingStore{}, "/api", 2, time.Minute, 0, "retry", log); err == nil {
+		t.Error("NewStoreLimiter() with unknown failure mode error = nil, want error")
+	}
+}
@@ -172,3 +172,207 @@ func TestRateLimitMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestLimiterAlgorithms(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	for _, algorithm := range []string{TokenBucket, GCRA} {
+		t.Run(algorithm, func(t *testing.T) {
+			// Create a limiter allowing 10 requests per second with a burst of 3
+			limiter, err := NewLimiter(algorithm, 10, time.Second, 3, log)
+			if err != nil {
+				t.Fatalf("NewLimiter() error = %v", err)
+			}
+			now := time.Unix(1000, 0)
+			limiter.now = func() time.Time { return now }
+
+			// The burst is allowed at once
+			for i := 0; i < 3; i++ {
+				result := limiter.Allow("client")
+				if !result.Allowed {
+					t.Fatalf("request %d not allowed", i)
+				}
+				if result.Remaining != 2-i {
+					t.Errorf("request %d Remaining = %v, want %v", i, result.Remaining, 2-i)
+				}
+			}
+
+			// The next request has to wait for one emission interval
+			result := limiter.Allow("client")
+			if result.Allowed {
+				t.Fatal("request over burst allowed")
+			}
+			if result.RetryAfter != 100*time.Millisecond {
+				t.Errorf("RetryAfter = %v, want %v", result.RetryAfter, 100*time.Millisecond)
+			}
+
+			// Other keys are independent
+			if !limiter.Allow("other").Allowed {
+				t.Error("other key not allowed")
+			}
+
+			// One request is earned back after the interval
+			now = now.Add(100 * time.Millisecond)
+			if !limiter.Allow("client").Allowed {
+				t.Error("request after interval not allowed")
+			}
+			if limiter.Allow("client").Allowed {
+				t.Error("second request after interval allowed")
+			}
+
+			// A refunded request can be made again
+			limiter.Refund("client")
+			if !limiter.Allow("client").Allowed {
+				t.Error("request after refund not allowed")
+			}
+		})
+	}
+}
+
+func TestLimiterEviction(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	for _, algorithm := range []string{TokenBucket, GCRA} {
+		t.Run(algorithm, func(t *testing.T) {
+			// Create a limiter
+			limiter, err := NewLimiter(algorithm, 10, time.Second, 0, log)
+			if err != nil {
+				t.Fatalf("NewLimiter() error = %v", err)
+			}
+			now := time.Unix(1000, 0)
+			limiter.now = func() time.Time { return now }
+
+			// Use a key
+			limiter.Allow("idle")
+			shard := limiter.shard("idle")
+			if _, ok := shard.states["idle"]; !ok {
+				t.Fatal("key state not created")
+			}
+
+			// Access the shard again after the sweep interval
+			now = now.Add(2 * minSweepInterval)
+			limiter.Allow("idle")
+			if len(shard.states) != 1 {
+				t.Errorf("len(shard states) = %v, want %v", len(shard.states), 1)
+			}
+
+			// The key state was recreated with a full burst
+			if result := limiter.Allow("idle"); result.Remaining != 8 {
+				t.Errorf("Remaining = %v, want %v", result.Remaining, 8)
+			}
+		})
+	}
+}
+
+func TestNewLimiterErrors(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	if _, err := NewLimiter("slidinglog", 10, time.Second, 0, log); err == nil {
+		t.Error("NewLimiter() with unknown algorithm error = nil, want error")
+	}
+	if _, err := NewLimiter(GCRA, 0, time.Second, 0, log); err == nil {
+		t.Error("NewLimiter() with zero limit error = nil, want error")
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Test cases
+	tests := []struct {
+		name         string
+		style        string
+		wantAllowed  map[string]string
+		wantRejected map[string]string
+	}{
+		{
+			name:  "x-ratelimit",
+			style: HeadersXRateLimit,
+			wantAllowed: map[string]string{
+				"X-RateLimit-Limit":     "2",
+				"X-RateLimit-Remaining": "1",
+				"X-RateLimit-Reset":     "30",
+				"RateLimit":             "",
+			},
+			wantRejected: map[string]string{
+				"X-RateLimit-Remaining": "0",
+				"Retry-After":           "30",
+				"Content-Type":          "application/json",
+			},
+		},
+		{
+			name:  "ietf",
+			style: HeadersIETF,
+			wantAllowed: map[string]string{
+				"RateLimit-Policy":  `"ip";q=2;w=60`,
+				"RateLimit":         `"ip";r=1;t=30`,
+				"X-RateLimit-Limit": "",
+			},
+			wantRejected: map[string]string{
+				"RateLimit":   `"ip";r=0;t=60`,
+				"Retry-After": "30",
+			},
+		},
+		{
+			name:  "none",
+			style: HeadersNone,
+			wantAllowed: map[string]string{
+				"X-RateLimit-Limit": "",
+				"RateLimit":         "",
+			},
+			wantRejected: map[string]string{
+				"Retry-After": "30",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a limiter allowing 2 requests per minute
+			limiter, err := NewLimiter(GCRA, 2, time.Minute, 0, log)
+			if err != nil {
+				t.Fatalf("NewLimiter() error = %v", err)
+			}
+			now := time.Unix(1000, 0)
+			limiter.now = func() time.Time { return now }
+
+			// Apply the rate limit middleware
+			policy := RateLimitPolicy{Name: "ip", Limiter: limiter, Key: ClientIPKey}
+			wrappedHandler := RateLimitPoliciesMiddleware(tt.style, policy)(handler)
+
+			// Make requests
+			var responses []*httptest.ResponseRecorder
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+				req.RemoteAddr = "192.168.1.1:12345"
+				w := httptest.NewRecorder()
+				wrappedHandler.ServeHTTP(w, req)
+				responses = append(responses, w)
+			}
+
+			// Check the headers of the first allowed and the rejected response
+			for key, want := range tt.wantAllowed {
+				if got := responses[0].Header().Get(key); got != want {
+					t.Errorf("Allowed header %q = %q, want %q", key, got, want)
+				}
+			}
+			if responses[2].Code != http.StatusTooManyRequests {
+				t.Fatalf("Status code = %v, want %v", responses[2].Code, http.StatusTooManyRequests)
+			}
+			for key, want := range tt.wantRejected {
+				if got := responses[2].Header().Get(key); got != want {
+					t.Errorf("Rejected header %q = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mstgnz/goteway/pkg/logger"
+)
+
+func TestURLSigner(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Test cases
+	tests := []struct {
+		name       string
+		bindIP     bool
+		bindMethod bool
+		expires    time.Duration
+		tamper     func(*url.URL)
+		remoteAddr string
+		method     string
+		wantErr    error
+	}{
+		{
+			name:       "valid signature",
+			expires:    time.Hour,
+			tamper:     func(u *url.URL) {},
+			remoteAddr: "192.168.1.1:12345",
+			method:     "GET",
+			wantErr:    nil,
+		},
+		{
+			name:       "expired",
+			expires:    -time.Hour,
+			tamper:     func(u *url.URL) {},
+			remoteAddr: "192.168.1.1:12345",
+			method:     "GET",
+			wantErr:    ErrSignatureExpired,
+		},
+		{
+			name:    "tampered path",
+			expires: time.Hour,
+			tamper: func(u *url.URL) {
+				u.Path = "/files/other.zip"
+			},
+			remoteAddr: "192.168.1.1:12345",
+			method:     "GET",
+			wantErr:    ErrSignatureInvalid,
+		},
+		{
+			name:    "tampered expiry",
+			expires: time.Hour,
+			tamper: func(u *url.URL) {
+				q := u.Query()
+				q.Set(SignedURLExpiresParam, "99999999999")
+				u.RawQuery = q.Encode()
+			},
+			remoteAddr: "192.168.1.1:12345",
+			method:     "GET",
+			wantErr:    ErrSignatureInvalid,
+		},
+		{
+			name:    "missing signature",
+			expires: time.Hour,
+			tamper: func(u *url.URL) {
+				q := u.Query()
+				q.Del(SignedURLSignatureParam)
+				u.RawQuery = q.Encode()
+			},
+			remoteAddr: "192.168.1.1:12345",
+			method:     "GET",
+			wantErr:    ErrSignatureMissing,
+		},
+		{
+			name:       "bound to another ip",
+			bindIP:     true,
+			expires:    time.Hour,
+			tamper:     func(u *url.URL) {},
+			remoteAddr: "10.0.0.1:12345",
+			method:     "GET",
+			wantErr:    ErrSignatureInvalid,
+		},
+		{
+			name:       "bound to another method",
+			bindMethod: true,
+			expires:    time.Hour,
+			tamper:     func(u *url.URL) {},
+			remoteAddr: "192.168.1.1:12345",
+			method:     "DELETE",
+			wantErr:    ErrSignatureInvalid,
+		},
+		{
+			name:       "bound ip and method match",
+			bindIP:     true,
+			bindMethod: true,
+			expires:    time.Hour,
+			tamper:     func(u *url.URL) {},
+			remoteAddr: "192.168.1.1:12345",
+			method:     "GET",
+			wantErr:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a signer
+			signer := NewURLSigner("secret", tt.bindIP, tt.bindMethod, log)
+
+			// Sign a URL
+			signed, err := signer.Sign("http://example.com/files/report.zip?version=2", time.Now().Add(tt.expires), "192.168.1.1", "GET")
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+
+			// Tamper with the URL
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatalf("Failed to parse signed URL: %v", err)
+			}
+			tt.tamper(u)
+
+			// Create a request
+			req := httptest.NewRequest(tt.method, u.String(), nil)
+			req.RemoteAddr = tt.remoteAddr
+
+			// Verify
+			if err := signer.Verify(req); err != tt.wantErr {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignedURLMiddleware(t *testing.T) {
+	// Create a logger
+	log := logger.New(logger.INFO)
+
+	// Create a handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Apply the signed URL middleware
+	signer := NewURLSigner("secret", false, false, log)
+	wrappedHandler := SignedURLMiddleware(signer, log)(handler)
+
+	// Sign a URL
+	signed, err := signer.Sign("http://example.com/files/report.zip", time.Now().Add(time.Minute), "", "")
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	// Test cases
+	tests := []struct {
+		name           string
+		url            string
+		wantStatusCode int
+	}{
+		{
+			name:           "signed",
+			url:            signed,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "unsigned",
+			url:            "http://example.com/files/report.zip",
+			wantStatusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create a request
+			req := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+
+			// Call the handler
+			wrappedHandler.ServeHTTP(w, req)
+
+			// Check the response
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Errorf("Status code = %v, want %v", resp.StatusCode, tt.wantStatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package stats
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric represents the value of a counter or gauge at one point in time
+type Metric struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"` // "counter" or "gauge"
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// Counter represents a monotonically increasing count
+type Counter struct {
+	value atomic.Int64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n int64) {
+	c.value.Add(n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+// Gauge represents a value that can go up and down
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set sets the gauge value
+func (g *Gauge) Set(value float64) {
+	g.bits.Store(math.Float64bits(value))
+}
+
+// Value returns the current gauge value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// series represents a registered counter or gauge with its labels
+type series struct {
+	name    string
+	labels  map[string]string
+	counter *Counter
+	gauge   *Gauge
+}
+
+// Registry represents a set of named metrics. It is safe for concurrent use.
+type Registry struct {
+	series map[string]*series
+	mu     sync.RWMutex
+}
+
+// NewRegistry creates a new metrics registry
+func NewRegistry() *Registry {
+	return &Registry{
+		series: make(map[string]*series),
+	}
+}
+
+// Counter returns the counter with the given name and labels, creating it on
+// first use. Labels are given as alternating names and values. A counter and a
+// gauge with the same name and labels are separate series.
+func (r *Registry) Counter(name string, labels ...string) *Counter {
+	return r.get("counter", name, labels, func(s *series) { s.counter = &Counter{} }).counter
+}
+
+// Gauge returns the gauge with the given name and labels, creating it on first
+// use. Labels are given as alternating names and values.
+func (r *Registry) Gauge(name string, labels ...string) *Gauge {
+	return r.get("gauge", name, labels, func(s *series) { s.gauge = &Gauge{} }).gauge
+}
+
+// get returns a series of a kind, creating it with init if it does not exist
+func (r *Registry) get(kind, name string, labels []string, init func(*series)) *series {
+	id := seriesID(kind, name, labels)
+
+	r.mu.RLock()
+	s, ok := r.series[id]
+	r.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.series[id]; ok {
+		return s
+	}
+	s = &series{name: name, labels: make(map[string]string)}
+	for i := 0; i+1 < len(labels); i += 2 {
+		s.labels[labels[i]] = labels[i+1]
+	}
+	init(s)
+	r.series[id] = s
+
+	return s
+}
+
+// Snapshot returns the current value of every metric, sorted by name and labels
+func (r *Registry) Snapshot() []Metric {
+	r.mu.RLock()
+	ids := make([]string, 0, len(r.series))
+	for id := range r.series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	metrics := make([]Metric, 0, len(ids))
+	for _, id := range ids {
+		s := r.series[id]
+		metric := Metric{Name: s.name, Labels: s.labels}
+		if s.counter != nil {
+			metric.Type = "counter"
+			metric.Value = float64(s.counter.Value())
+		} else {
+			metric.Type = "gauge"
+			metric.Value = s.gauge.Value()
+		}
+		if len(metric.Labels) == 0 {
+			metric.Labels = nil
+		}
+		metrics = append(metrics, metric)
+	}
+	r.mu.RUnlock()
+
+	return metrics
+}
+
+// seriesID returns the registry key of a metric kind, name and labels. The
+// kind comes last, so that the keys sort by name and labels.
+func seriesID(kind, name string, labels []string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, label := range labels {
+		b.WriteByte(0)
+		b.WriteString(label)
+	}
+	b.WriteByte(0)
+	b.WriteString(kind)
+	return b.String()
+}
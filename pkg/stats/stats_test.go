@@ -0,0 +1,62 @@
+package stats
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	// Create a registry
+	registry := NewRegistry()
+
+	// Count concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			registry.Counter("requests", "consumer", "acme").Inc()
+		}()
+	}
+	wg.Wait()
+	registry.Counter("requests", "consumer", "globex").Add(2)
+	registry.Gauge("limit", "route", "/api").Set(12.5)
+
+	// The same name and labels return the same metric
+	if got := registry.Counter("requests", "consumer", "acme").Value(); got != 10 {
+		t.Errorf("Counter().Value() = %v, want %v", got, 10)
+	}
+
+	// Check the snapshot
+	metrics := registry.Snapshot()
+	if len(metrics) != 3 {
+		t.Fatalf("Snapshot() returned %d metrics, want %d", len(metrics), 3)
+	}
+	if metrics[0].Name != "limit" || metrics[0].Type != "gauge" || metrics[0].Value != 12.5 {
+		t.Errorf("metrics[0] = %+v", metrics[0])
+	}
+	if metrics[1].Labels["consumer"] != "acme" || metrics[1].Value != 10 {
+		t.Errorf("metrics[1] = %+v", metrics[1])
+	}
+	if metrics[2].Labels["consumer"] != "globex" || metrics[2].Type != "counter" || metrics[2].Value != 2 {
+		t.Errorf("metrics[2] = %+v", metrics[2])
+	}
+}
+
+func TestRegistryKinds(t *testing.T) {
+	// Create a counter and a gauge with the same name and labels
+	registry := NewRegistry()
+	registry.Counter("inflight", "route", "/api").Add(3)
+	registry.Gauge("inflight", "route", "/api").Set(1.5)
+
+	// Both are kept as separate series
+	if got := registry.Counter("inflight", "route", "/api").Value(); got != 3 {
+		t.Errorf("Counter().Value() = %v, want %v", got, 3)
+	}
+	if got := registry.Gauge("inflight", "route", "/api").Value(); got != 1.5 {
+		t.Errorf("Gauge().Value() = %v, want %v", got, 1.5)
+	}
+	if metrics := registry.Snapshot(); len(metrics) != 2 {
+		t.Errorf("Snapshot() returned %d metrics, want %d", len(metrics), 2)
+	}
+}